@@ -0,0 +1,397 @@
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+// evpn route types and attribute values, vxlan evpn is described in RFC 7432 and RFC 8365
+const (
+	evpnMACIP = 2
+	evpnIMET  = 3
+
+	pmsiIngressReplication = 6
+	encapVXLAN             = 8
+	esiLen                 = 10
+	macBits                = 48
+)
+
+// evpnRoute is an evpn mac/ip advertisement (type 2) or inclusive multicast ethernet tag (type 3) route
+// vxlan evpn uses ethernet tag 0, and carries the vni in the label field
+type evpnRoute struct {
+	typ uint8
+	rd  []byte
+	vni int
+	mac net.HardwareAddr
+	ip  net.IP
+	// origin is the originating router's address of a type 3 route, the session's next hop if an originated route has none
+	origin net.IP
+	// vtep is the source address of the local vxlan an originated route is advertised with, the session's next hop if nil
+	vtep net.IP
+}
+
+// key identifies the route in advertisements and withdrawals, the label is not part of it
+func (r *evpnRoute) key() string {
+	return fmt.Sprintf("%d %x %v %v %v", r.typ, r.rd, r.mac, r.ip, r.origin)
+}
+
+// routeDistinguisher is router-id:vni, with the vni truncated to 16 bits
+func routeDistinguisher(rid net.IP, vni int) []byte {
+	rd := []byte{0, 1}
+	rd = append(rd, rid.To4()...)
+	return append(rd, u16(uint16(vni))...)
+}
+
+func label(vni int) []byte {
+	return []byte{byte(vni >> 16), byte(vni >> 8), byte(vni)}
+}
+
+func ipWithLen(ip net.IP) []byte {
+	if ip == nil {
+		return []byte{0}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return append([]byte{net.IPv4len * 8}, ip4...)
+	}
+	return append([]byte{net.IPv6len * 8}, ip.To16()...)
+}
+
+// encodeEVPN encodes an evpn nlri, a type 3 route without an origin is originated from nextHop
+func encodeEVPN(r *evpnRoute, nextHop net.IP) []byte {
+	v := append([]byte{}, r.rd...)
+	switch r.typ {
+	case evpnMACIP:
+		v = append(v, make([]byte, esiLen+4)...)
+		v = append(v, macBits)
+		v = append(v, r.mac...)
+		v = append(v, ipWithLen(r.ip)...)
+		v = append(v, label(r.vni)...)
+	case evpnIMET:
+		origin := r.origin
+		if origin == nil {
+			origin = nextHop
+		}
+		v = append(v, make([]byte, 4)...)
+		v = append(v, ipWithLen(origin)...)
+	}
+	return append([]byte{r.typ, byte(len(v))}, v...)
+}
+
+// decodeIPWithLen decodes a length in bits followed by an address, returning the rest of b
+func decodeIPWithLen(b []byte) (net.IP, []byte, bool) {
+	if len(b) < 1 {
+		return nil, nil, false
+	}
+	l := int(b[0]) / 8
+	if (l != 0 && l != net.IPv4len && l != net.IPv6len) || len(b) < 1+l {
+		return nil, nil, false
+	}
+	if l == 0 {
+		return nil, b[1:], true
+	}
+	return net.IP(append([]byte{}, b[1:1+l]...)), b[1+l:], true
+}
+
+// decodeEVPN decodes evpn nlri, skipping route types other than 2 and 3
+// the vni of a type 3 route is -1, since it is carried in the pmsi tunnel attribute
+func decodeEVPN(b []byte) ([]*evpnRoute, error) {
+	malformed := &notification{code: errUpdate, subcode: errUpdateAttr}
+	r := []*evpnRoute{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, malformed
+		}
+		t, v := b[0], b[2:2+int(b[1])]
+		b = b[2+int(b[1]):]
+
+		var ok bool
+		switch t {
+		case evpnMACIP:
+			// rd, esi, ethernet tag, mac length, mac
+			if len(v) < 8+esiLen+4+1+6 || v[8+esiLen+4] != macBits {
+				return nil, malformed
+			}
+			er := &evpnRoute{
+				typ: t,
+				rd:  append([]byte{}, v[:8]...),
+				mac: net.HardwareAddr(append([]byte{}, v[8+esiLen+5:8+esiLen+11]...)),
+			}
+			if er.ip, v, ok = decodeIPWithLen(v[8+esiLen+11:]); !ok || len(v) < 3 {
+				return nil, malformed
+			}
+			er.vni = int(v[0])<<16 | int(v[1])<<8 | int(v[2])
+			r = append(r, er)
+		case evpnIMET:
+			// rd, ethernet tag, originating router's address
+			if len(v) < 8+4 {
+				return nil, malformed
+			}
+			er := &evpnRoute{typ: t, rd: append([]byte{}, v[:8]...), vni: -1}
+			if er.origin, _, ok = decodeIPWithLen(v[12:]); !ok || er.origin == nil {
+				return nil, malformed
+			}
+			r = append(r, er)
+		}
+	}
+	return r, nil
+}
+
+// encodeEVPNUpdate builds one UPDATE message body advertising reach, if it isn't nil, and withdrawing unreach
+// advertised routes each get their own message, since the route target and pmsi tunnel attributes carry their vni
+func encodeEVPNUpdate(reach *evpnRoute, unreach []*evpnRoute, nextHop net.IP, asn uint32, asPath []uint32, as4, ibgp bool) []byte {
+	var attrs []byte
+
+	if len(unreach) > 0 {
+		v := append(u16(afiL2VPN), safiEVPN)
+		for _, r := range unreach {
+			v = append(v, encodeEVPN(r, nextHop)...)
+		}
+		attrs = append(attrs, attr(flagOptional, attrMPUnreach, v)...)
+	}
+
+	if reach != nil {
+		attrs = append(attrs, pathAttrs(asPath, as4)...)
+
+		// remote vteps send vxlan traffic to the local vxlan, which may use a different address family than the session
+		if reach.vtep != nil {
+			nextHop = reach.vtep
+		}
+
+		nh := nextHop.To4()
+		if nh == nil {
+			nh = nextHop.To16()
+		}
+		v := append(u16(afiL2VPN), safiEVPN, byte(len(nh)))
+		v = append(v, nh...)
+		v = append(v, 0)
+		v = append(v, encodeEVPN(reach, nextHop)...)
+		attrs = append(attrs, attr(flagOptional, attrMPReach, v)...)
+
+		if ibgp {
+			attrs = append(attrs, attr(flagTransitive, attrLocalPref, u32(defaultLPref))...)
+		}
+
+		// the route target is asn:vni, and the encapsulation is vxlan
+		var rt []byte
+		if asn <= 0xffff {
+			rt = append([]byte{0x00, 0x02}, u16(uint16(asn))...)
+			rt = append(rt, u32(uint32(reach.vni))...)
+		} else {
+			rt = append([]byte{0x02, 0x02}, u32(asn)...)
+			rt = append(rt, u16(uint16(reach.vni))...)
+		}
+		encap := []byte{0x03, 0x0c, 0, 0, 0, 0, 0, encapVXLAN}
+		attrs = append(attrs, attr(flagOptional|flagTransitive, attrExtCommunity, append(rt, encap...))...)
+
+		if reach.typ == evpnIMET {
+			v = append([]byte{0, pmsiIngressReplication}, label(reach.vni)...)
+			v = append(v, nh...)
+			attrs = append(attrs, attr(flagOptional|flagTransitive, attrPMSITunnel, v)...)
+		}
+	}
+
+	b := u16(0)
+	b = append(b, u16(uint16(len(attrs)))...)
+	return append(b, attrs...)
+}
+
+type learnedEVPN struct {
+	route   *evpnRoute
+	nextHop net.IP
+	id      net.IP
+}
+
+// SyncVNI originates a type 3 route for the vni of vxl and a type 2 route for each of local, and withdraws the
+// other routes previously originated for it. The routes are advertised via the vxlan's source address, if it has one.
+// The vxlan is programmed with the routes learned for the vni
+func (s *Speaker) SyncVNI(vxl *vxlan.Vxlan, local []vxlan.MACIP) error {
+	vni, err := vxl.VNI()
+	if err != nil {
+		return err
+	}
+	log := s.log.WithField("Func", "SyncVNI()").WithField("vni", vni)
+	log.Debug()
+
+	_, vtep, err := vxl.Underlay()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]*evpnRoute)
+	rd := routeDistinguisher(s.cfg.RouterID, vni)
+	imet := &evpnRoute{typ: evpnIMET, rd: rd, vni: vni, origin: vtep, vtep: vtep}
+	want[imet.key()] = imet
+	for _, m := range local {
+		r := &evpnRoute{typ: evpnMACIP, rd: rd, vni: vni, mac: m.MAC, ip: m.IP, vtep: vtep}
+		want[r.key()] = r
+	}
+
+	var announce, withdraw []*evpnRoute
+	s.l.Lock()
+	s.vnis[vni] = vxl
+	for k, r := range s.originatedEVPN {
+		if _, ok := want[k]; r.vni != vni || ok {
+			continue
+		}
+		delete(s.originatedEVPN, k)
+		withdraw = append(withdraw, r)
+	}
+	for k, r := range want {
+		if _, ok := s.originatedEVPN[k]; ok {
+			continue
+		}
+		s.originatedEVPN[k] = r
+		announce = append(announce, r)
+	}
+	err = s.programVNI(vni)
+	s.l.Unlock()
+
+	for _, p := range s.peers {
+		for _, r := range withdraw {
+			p.queueEVPN(r, false)
+		}
+		for _, r := range announce {
+			p.queueEVPN(r, true)
+		}
+	}
+	return err
+}
+
+// WithdrawVNI withdraws every route originated for vni, and stops programming it's vxlan
+func (s *Speaker) WithdrawVNI(vni int) {
+	s.log.WithField("Func", "WithdrawVNI()").WithField("vni", vni).Debug()
+
+	var withdraw []*evpnRoute
+	s.l.Lock()
+	delete(s.vnis, vni)
+	for k, r := range s.originatedEVPN {
+		if r.vni != vni {
+			continue
+		}
+		delete(s.originatedEVPN, k)
+		withdraw = append(withdraw, r)
+	}
+	s.l.Unlock()
+
+	for _, p := range s.peers {
+		for _, r := range withdraw {
+			p.queueEVPN(r, false)
+		}
+	}
+}
+
+func (s *Speaker) originatedEVPNRoutes() []*evpnRoute {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	r := []*evpnRoute{}
+	for _, er := range s.originatedEVPN {
+		r = append(r, er)
+	}
+	return r
+}
+
+// learnEVPN records (or with a nil le, forgets) an evpn route from a peer and programs the vxlan of it's vni
+func (s *Speaker) learnEVPN(p *peer, r *evpnRoute, le *learnedEVPN) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	k := r.key()
+	vni := r.vni
+	if le == nil {
+		// withdrawals don't carry the vni of type 3 routes
+		if cur, ok := s.learnedEVPN[k][p]; ok {
+			vni = cur.route.vni
+		}
+		delete(s.learnedEVPN[k], p)
+	} else {
+		if s.learnedEVPN[k] == nil {
+			s.learnedEVPN[k] = make(map[*peer]*learnedEVPN)
+		}
+		s.learnedEVPN[k][p] = le
+	}
+	if len(s.learnedEVPN[k]) == 0 {
+		delete(s.learnedEVPN, k)
+	}
+
+	if err := s.programVNI(vni); err != nil {
+		s.log.WithField("Func", "learnEVPN()").WithField("vni", vni).WithError(err).Error("failed to program vxlan")
+	}
+}
+
+// forgetEVPN removes all evpn routes learned from a peer, s.l must be held
+func (s *Speaker) forgetEVPN(p *peer) {
+	vnis := make(map[int]struct{})
+	for k, paths := range s.learnedEVPN {
+		lr, ok := paths[p]
+		if !ok {
+			continue
+		}
+		delete(paths, p)
+		if len(paths) == 0 {
+			delete(s.learnedEVPN, k)
+		}
+		vnis[lr.route.vni] = struct{}{}
+	}
+	for vni := range vnis {
+		if err := s.programVNI(vni); err != nil {
+			s.log.WithField("Func", "forgetEVPN()").WithField("vni", vni).WithError(err).Error("failed to program vxlan")
+		}
+	}
+}
+
+// programVNI programs the vxlan of vni with the best path of each route learned for it, s.l must be held
+// vnis without a local evpn network are ignored. A mac or address advertised by several vteps goes to the lowest one
+func (s *Speaker) programVNI(vni int) error {
+	vxl, ok := s.vnis[vni]
+	if !ok {
+		return nil
+	}
+
+	macs := make(map[string]*vxlan.Remote)
+	neighs := make(map[string]*vxlan.Remote)
+	flood := make(map[string]net.IP)
+	for _, paths := range s.learnedEVPN {
+		var best *learnedEVPN
+		for _, lr := range paths {
+			if best == nil || bytes.Compare(lr.id.To4(), best.id.To4()) < 0 {
+				best = lr
+			}
+		}
+		if best == nil || best.route.vni != vni {
+			continue
+		}
+
+		r := best.route
+		if r.typ == evpnIMET {
+			flood[best.nextHop.String()] = best.nextHop
+			continue
+		}
+		rem := &vxlan.Remote{MACIP: vxlan.MACIP{MAC: r.mac, IP: r.ip}, VTEP: best.nextHop}
+		if cur, ok := macs[r.mac.String()]; !ok || bytes.Compare(rem.VTEP.To16(), cur.VTEP.To16()) < 0 { // nolint: vetshadow
+			macs[r.mac.String()] = rem
+		}
+		if r.ip == nil {
+			continue
+		}
+		if cur, ok := neighs[r.ip.String()]; !ok || bytes.Compare(rem.VTEP.To16(), cur.VTEP.To16()) < 0 { // nolint: vetshadow
+			neighs[r.ip.String()] = rem
+		}
+	}
+
+	remotes := []vxlan.Remote{}
+	for _, m := range macs {
+		remotes = append(remotes, vxlan.Remote{MACIP: vxlan.MACIP{MAC: m.MAC}, VTEP: m.VTEP})
+	}
+	for _, n := range neighs {
+		remotes = append(remotes, vxlan.Remote{MACIP: n.MACIP, VTEP: macs[n.MAC.String()].VTEP})
+	}
+	vteps := []net.IP{}
+	for _, f := range flood {
+		vteps = append(vteps, f)
+	}
+	return vxl.SyncRemotes(remotes, vteps)
+}
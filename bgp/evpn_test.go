@@ -0,0 +1,271 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+func TestEVPNRoundTrip(t *testing.T) {
+	nh := net.ParseIP("192.0.2.1")
+	mac, _ := net.ParseMAC("02:42:0a:00:00:07")
+	for _, tc := range []struct {
+		name string
+		r    *evpnRoute
+	}{
+		{"mac", &evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(nh, 5000), vni: 5000, mac: mac}},
+		{"mac and ipv4", &evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(nh, 5000), vni: 5000, mac: mac, ip: net.ParseIP("10.0.0.7").To4()}},
+		{"mac and ipv6", &evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(nh, 70000), vni: 70000, mac: mac, ip: net.ParseIP("2001:db8::7")}},
+		{"imet", &evpnRoute{typ: evpnIMET, rd: routeDistinguisher(nh, 5000), vni: 5000}},
+	} {
+		u, err := decodeUpdate(encodeEVPNUpdate(tc.r, nil, nh, testASN, []uint32{testASN}, true, false), true)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if len(u.evpnReach) != 1 || !u.evpnNextHop.Equal(nh) {
+			t.Fatalf("%v: expected one route via %v, got %v via %v", tc.name, nh, u.evpnReach, u.evpnNextHop)
+		}
+		got := u.evpnReach[0]
+		// the advertised type 3 route is originated from the next hop
+		want := *tc.r
+		if want.typ == evpnIMET {
+			want.origin = nh.To4()
+		}
+		if got.key() != want.key() || got.vni != want.vni {
+			t.Errorf("%v: expected %v vni %v, got %v vni %v", tc.name, want.key(), want.vni, got.key(), got.vni)
+		}
+
+		u, err = decodeUpdate(encodeEVPNUpdate(nil, []*evpnRoute{tc.r}, nh, testASN, nil, true, false), true)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if len(u.evpnUnreach) != 1 || u.evpnUnreach[0].key() != want.key() || len(u.evpnReach) != 0 {
+			t.Errorf("%v: expected %v to be withdrawn, got %v", tc.name, want.key(), u.evpnUnreach)
+		}
+	}
+}
+
+func TestFitEVPNWithdrawals(t *testing.T) {
+	nh := net.ParseIP("192.0.2.1")
+	var unreach []*evpnRoute
+	for i := 0; i < 500; i++ {
+		mac := net.HardwareAddr{0x02, 0x42, 0, 0, byte(i >> 8), byte(i)}
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::%x", i))
+		unreach = append(unreach, &evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(nh, 70000), vni: 70000, mac: mac, ip: ip})
+	}
+
+	msgs := fitUpdates(len(unreach), func(lo, hi int) []byte {
+		return encodeEVPNUpdate(nil, unreach[lo:hi], nh, testASN, []uint32{testASN}, true, false)
+	})
+	if len(msgs) < 2 {
+		t.Errorf("expected the withdrawals to be split over several messages")
+	}
+	got := make(map[string]bool)
+	for _, b := range msgs {
+		if headerLen+len(b) > maxMsgLen {
+			t.Fatalf("message of %v bytes is over the maximum length", headerLen+len(b))
+		}
+		u, err := decodeUpdate(b, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range u.evpnUnreach {
+			got[r.key()] = true
+		}
+	}
+	if len(got) != len(unreach) {
+		t.Errorf("expected %v withdrawn routes, got %v", len(unreach), len(got))
+	}
+}
+
+func TestDecodeEVPNMalformed(t *testing.T) {
+	nh := net.ParseIP("192.0.2.1")
+	b := encodeEVPN(&evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(nh, 5000), vni: 5000, mac: net.HardwareAddr{2, 0, 0, 0, 0, 1}}, nh)
+	if _, err := decodeEVPN(b[:len(b)-2]); err == nil {
+		t.Errorf("expected a truncated route to fail")
+	}
+	// unknown route types are skipped
+	r, err := decodeEVPN(append([]byte{5, 2, 0, 0}, b...))
+	if err != nil || len(r) != 1 {
+		t.Errorf("expected the type 2 route after an unknown one, got %v %v", r, err)
+	}
+}
+
+func testEVPNVxlan(t *testing.T, name, vni string) (*vxlan.Vxlan, int) {
+	vxl, err := vxlan.New(name, map[string]string{"vxlanid": vni, "evpn": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := kernel.Get().LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vxl, l.Attrs().Index
+}
+
+// fdb returns the static fdb entries of the vxlan with index idx as mac to vtep
+func fdb(t *testing.T, idx int) map[string]string {
+	ns, err := kernel.Get().NeighList(idx, syscall.AF_BRIDGE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make(map[string]string)
+	for _, n := range ns {
+		if n.State&netlink.NUD_PERMANENT != 0 {
+			r[n.HardwareAddr.String()] = n.IP.String()
+		}
+	}
+	return r
+}
+
+// neighs returns the neighbor entries of the vxlan with index idx as address to mac
+func neighs(t *testing.T, idx int) map[string]string {
+	ns, err := kernel.Get().NeighList(idx, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make(map[string]string)
+	for _, n := range ns {
+		r[n.IP.String()] = n.HardwareAddr.String()
+	}
+	return r
+}
+
+func TestEVPNAdvertise(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	vxl, _ := testEVPNVxlan(t, "eva", "5000")
+	mac, _ := net.ParseMAC("02:42:0a:00:00:07")
+	if err := s.SyncVNI(vxl, []vxlan.MACIP{{MAC: mac, IP: net.ParseIP("10.0.0.7")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.establish(family(afiIPv4, safiUnicast), family(afiL2VPN, safiEVPN))
+	got := make(map[uint8]*evpnRoute)
+	for len(got) < 2 {
+		u := p.expectUpdate()
+		if len(u.evpnReach) != 1 || !u.evpnNextHop.Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatalf("expected one evpn route via 127.0.0.1, got %v via %v", u.evpnReach, u.evpnNextHop)
+		}
+		got[u.evpnReach[0].typ] = u.evpnReach[0]
+		if u.evpnReach[0].typ == evpnIMET && (!u.hasPMSI || u.pmsiLabel != 5000) {
+			t.Errorf("expected the type 3 route to carry vni 5000 in a pmsi tunnel, got %v", u.pmsiLabel)
+		}
+	}
+	if r := got[evpnMACIP]; r == nil || r.mac.String() != mac.String() || !r.ip.Equal(net.ParseIP("10.0.0.7")) || r.vni != 5000 {
+		t.Errorf("expected a type 2 route for %v 10.0.0.7 in vni 5000, got %+v", mac, r)
+	}
+	if r := got[evpnIMET]; r == nil || !r.origin.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected a type 3 route originated from 127.0.0.1, got %+v", r)
+	}
+
+	// the container is gone
+	if err := s.SyncVNI(vxl, nil); err != nil {
+		t.Fatal(err)
+	}
+	u := p.expectUpdate()
+	if len(u.evpnUnreach) != 1 || u.evpnUnreach[0].typ != evpnMACIP || u.evpnUnreach[0].mac.String() != mac.String() {
+		t.Errorf("expected the type 2 route to be withdrawn, got %v", u.evpnUnreach)
+	}
+
+	s.WithdrawVNI(5000)
+	u = p.expectUpdate()
+	if len(u.evpnUnreach) != 1 || u.evpnUnreach[0].typ != evpnIMET {
+		t.Errorf("expected the type 3 route to be withdrawn, got %v", u.evpnUnreach)
+	}
+}
+
+func TestEVPNAdvertiseUnderlay(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	// a v6 underlay is advertised over a v4 session
+	vtep := net.ParseIP("2001:db8::1")
+	vxl, err := vxlan.New("evu", map[string]string{"vxlanid": "5002", "evpn": "true", "srcaddr": vtep.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, _ := net.ParseMAC("02:42:0a:00:00:08")
+	if err = s.SyncVNI(vxl, []vxlan.MACIP{{MAC: mac}}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.establish(family(afiIPv4, safiUnicast), family(afiL2VPN, safiEVPN))
+	got := make(map[uint8]*evpnRoute)
+	for len(got) < 2 {
+		u := p.expectUpdate()
+		if len(u.evpnReach) != 1 || !u.evpnNextHop.Equal(vtep) {
+			t.Fatalf("expected one evpn route via %v, got %v via %v", vtep, u.evpnReach, u.evpnNextHop)
+		}
+		got[u.evpnReach[0].typ] = u.evpnReach[0]
+	}
+	if r := got[evpnIMET]; !r.origin.Equal(vtep) {
+		t.Errorf("expected a type 3 route originated from %v, got %v", vtep, r.origin)
+	}
+}
+
+func TestEVPNLearn(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+
+	vxl, idx := testEVPNVxlan(t, "evl", "5001")
+	if err := s.SyncVNI(vxl, nil); err != nil {
+		t.Fatal(err)
+	}
+	p.establish(family(afiIPv4, safiUnicast), family(afiL2VPN, safiEVPN))
+
+	vtep := net.ParseIP("192.0.2.30")
+	path := []uint32{testPeerASN}
+	rd := routeDistinguisher(testPeerID, 5001)
+	mac, _ := net.ParseMAC("02:42:0a:00:00:08")
+	other, _ := net.ParseMAC("02:42:0a:00:00:09")
+	imet := &evpnRoute{typ: evpnIMET, rd: rd, vni: 5001}
+	macip := &evpnRoute{typ: evpnMACIP, rd: rd, vni: 5001, mac: mac, ip: net.ParseIP("10.0.0.8").To4()}
+	p.send(msgUpdate, encodeEVPNUpdate(imet, nil, vtep, testPeerASN, path, true, false))
+	p.send(msgUpdate, encodeEVPNUpdate(macip, nil, vtep, testPeerASN, path, true, false))
+	// routes for a vni without a local network are not programmed
+	p.send(msgUpdate, encodeEVPNUpdate(&evpnRoute{typ: evpnMACIP, rd: routeDistinguisher(testPeerID, 5002), vni: 5002, mac: other}, nil, vtep, testPeerASN, path, true, false))
+
+	if !eventually(func() bool { return len(fdb(t, idx)) == 2 && len(neighs(t, idx)) == 1 }) {
+		t.Fatalf("expected a flood and a mac fdb entry and a neighbor, got %v %v", fdb(t, idx), neighs(t, idx))
+	}
+	if f := fdb(t, idx); f["00:00:00:00:00:00"] != vtep.String() || f[mac.String()] != vtep.String() {
+		t.Errorf("expected flood and %v entries to %v, got %v", mac, vtep, f)
+	}
+	if n := neighs(t, idx); n["10.0.0.8"] != mac.String() {
+		t.Errorf("expected 10.0.0.8 at %v, got %v", mac, n)
+	}
+
+	// withdrawing the type 2 route removes it's fdb and neighbor entries
+	p.send(msgUpdate, encodeEVPNUpdate(nil, []*evpnRoute{macip}, vtep, testPeerASN, nil, true, false))
+	if !eventually(func() bool { return len(fdb(t, idx)) == 1 && len(neighs(t, idx)) == 0 }) {
+		t.Fatalf("expected only the flood entry, got %v %v", fdb(t, idx), neighs(t, idx))
+	}
+
+	// the routes of a closed session are forgotten
+	s.Stop()
+	if f := fdb(t, idx); len(f) != 0 {
+		t.Errorf("expected the flood entry to be removed on stop, got %v", f)
+	}
+}
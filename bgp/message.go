@@ -0,0 +1,489 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// message types
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+)
+
+// path attribute flags and types
+const (
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtLen     = 0x10
+
+	attrOrigin       = 1
+	attrASPath       = 2
+	attrNextHop      = 3
+	attrLocalPref    = 5
+	attrOriginatorID = 9
+	attrMPReach      = 14
+	attrMPUnreach    = 15
+	attrExtCommunity = 16
+	attrPMSITunnel   = 22
+)
+
+// capabilities, address families and misc protocol values
+const (
+	capMultiprotocol = 1
+	capAS4           = 65
+
+	afiIPv4     = 1
+	afiIPv6     = 2
+	afiL2VPN    = 25
+	safiUnicast = 1
+	safiEVPN    = 70
+
+	headerLen     = 19
+	maxMsgLen     = 4096
+	bgpVersion    = 4
+	asTrans       = 23456
+	asSequence    = 2
+	originIGP     = 0
+	defaultLPref  = 100
+	optParamCaps  = 2
+	errHeader     = 1
+	errOpen       = 2
+	errUpdate     = 3
+	errHoldTimer  = 4
+	errCease      = 6
+	errOpenBadAS  = 2
+	errOpenBadID  = 3
+	errOpenHold   = 6
+	errUpdateAttr = 1
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+// notification is sent and received as an error to close a session
+type notification struct {
+	code    uint8
+	subcode uint8
+	data    []byte
+}
+
+func (n *notification) Error() string {
+	return fmt.Sprintf("bgp notification code %d subcode %d", n.code, n.subcode)
+}
+
+type open struct {
+	as       uint32
+	holdTime uint16
+	id       net.IP
+	as4      bool
+	families map[uint32]bool
+}
+
+// update holds the decoded contents of an UPDATE message
+// both classic ipv4 and multiprotocol nlri are merged into reach and unreach, evpn nlri are kept apart
+type update struct {
+	unreach      []*net.IPNet
+	reach        []*net.IPNet
+	nextHop      net.IP
+	asPath       []uint32
+	originatorID net.IP
+
+	evpnUnreach []*evpnRoute
+	evpnReach   []*evpnRoute
+	evpnNextHop net.IP
+	// pmsiLabel is the label of the pmsi tunnel attribute, the vni of a type 3 route
+	pmsiLabel int
+	hasPMSI   bool
+}
+
+func family(afi uint16, safi uint8) uint32 {
+	return uint32(afi)<<8 | uint32(safi)
+}
+
+func readMsg(r io.Reader) (uint8, []byte, error) {
+	h := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(h[:16], marker) {
+		return 0, nil, &notification{code: errHeader, subcode: 1}
+	}
+	l := int(binary.BigEndian.Uint16(h[16:18]))
+	if l < headerLen || l > maxMsgLen {
+		return 0, nil, &notification{code: errHeader, subcode: 2}
+	}
+	b := make([]byte, l-headerLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return h[18], b, nil
+}
+
+func writeMsg(w io.Writer, t uint8, body []byte) error {
+	b := make([]byte, headerLen, headerLen+len(body))
+	copy(b, marker)
+	binary.BigEndian.PutUint16(b[16:], uint16(headerLen+len(body)))
+	b[18] = t
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+func encodeOpen(o *open) []byte {
+	caps := []byte{}
+	for f := range o.families {
+		caps = append(caps, capMultiprotocol, 4, byte(f>>16), byte(f>>8), 0, byte(f))
+	}
+	if o.as4 {
+		caps = append(caps, capAS4, 4)
+		caps = append(caps, u32(o.as)...)
+	}
+
+	as := o.as
+	if as > 0xffff {
+		as = asTrans
+	}
+	b := []byte{bgpVersion}
+	b = append(b, u16(uint16(as))...)
+	b = append(b, u16(o.holdTime)...)
+	b = append(b, o.id.To4()...)
+	b = append(b, byte(len(caps)+2), optParamCaps, byte(len(caps)))
+	return append(b, caps...)
+}
+
+func decodeOpen(b []byte) (*open, error) {
+	if len(b) < 10 {
+		return nil, &notification{code: errHeader, subcode: 2}
+	}
+	if b[0] != bgpVersion {
+		return nil, &notification{code: errOpen, subcode: 1, data: u16(bgpVersion)}
+	}
+	o := &open{
+		as:       uint32(binary.BigEndian.Uint16(b[1:3])),
+		holdTime: binary.BigEndian.Uint16(b[3:5]),
+		id:       net.IP(append([]byte{}, b[5:9]...)),
+		families: make(map[uint32]bool),
+	}
+	pl := int(b[9])
+	p := b[10:]
+	if len(p) < pl {
+		return nil, &notification{code: errOpen, subcode: 0}
+	}
+	p = p[:pl]
+	for len(p) >= 2 {
+		t, l := p[0], int(p[1])
+		if len(p) < 2+l {
+			return nil, &notification{code: errOpen, subcode: 0}
+		}
+		v := p[2 : 2+l]
+		p = p[2+l:]
+		if t != optParamCaps {
+			continue
+		}
+		for len(v) >= 2 {
+			ct, cl := v[0], int(v[1])
+			if len(v) < 2+cl {
+				return nil, &notification{code: errOpen, subcode: 0}
+			}
+			cv := v[2 : 2+cl]
+			v = v[2+cl:]
+			switch {
+			case ct == capMultiprotocol && cl == 4:
+				o.families[family(binary.BigEndian.Uint16(cv), cv[3])] = true
+			case ct == capAS4 && cl == 4:
+				o.as4 = true
+				o.as = binary.BigEndian.Uint32(cv)
+			}
+		}
+	}
+	return o, nil
+}
+
+func encodeNotification(n *notification) []byte {
+	return append([]byte{n.code, n.subcode}, n.data...)
+}
+
+func decodeNotification(b []byte) *notification {
+	n := &notification{}
+	if len(b) >= 2 {
+		n.code, n.subcode, n.data = b[0], b[1], b[2:]
+	}
+	return n
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func encodePrefix(p *net.IPNet) []byte {
+	ones, _ := p.Mask.Size()
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	return append([]byte{byte(ones)}, ip[:(ones+7)/8]...)
+}
+
+func decodePrefixes(b []byte, ipLen int) ([]*net.IPNet, error) {
+	r := []*net.IPNet{}
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > ipLen*8 || len(b) < 1+n {
+			return nil, &notification{code: errUpdate, subcode: 10}
+		}
+		ip := make(net.IP, ipLen)
+		copy(ip, b[1:1+n])
+		r = append(r, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, ipLen*8)})
+		b = b[1+n:]
+	}
+	return r, nil
+}
+
+func attr(flags, t uint8, v []byte) []byte {
+	if len(v) > 0xff {
+		return append(append([]byte{flags | flagExtLen, t}, u16(uint16(len(v)))...), v...)
+	}
+	return append([]byte{flags, t, byte(len(v))}, v...)
+}
+
+// pathAttrs returns the origin and as path attributes, which every advertisement carries
+func pathAttrs(asPath []uint32, as4 bool) []byte {
+	attrs := attr(flagTransitive, attrOrigin, []byte{originIGP})
+
+	var path []byte
+	if len(asPath) > 0 {
+		path = []byte{asSequence, byte(len(asPath))}
+		for _, as := range asPath {
+			if as4 {
+				path = append(path, u32(as)...)
+				continue
+			}
+			if as > 0xffff {
+				as = asTrans
+			}
+			path = append(path, u16(uint16(as))...)
+		}
+	}
+	return append(attrs, attr(flagTransitive, attrASPath, path)...)
+}
+
+// encodeUpdate builds one UPDATE message body for a single address family
+// path attributes are only included when there are reachable prefixes
+func encodeUpdate(afi uint16, reach, unreach []*net.IPNet, nextHop net.IP, asPath []uint32, as4, ibgp bool) []byte {
+	var withdrawn, nlri, attrs []byte
+
+	if afi == afiIPv4 {
+		for _, p := range unreach {
+			withdrawn = append(withdrawn, encodePrefix(p)...)
+		}
+		for _, p := range reach {
+			nlri = append(nlri, encodePrefix(p)...)
+		}
+	} else if len(unreach) > 0 {
+		v := append(u16(afi), safiUnicast)
+		for _, p := range unreach {
+			v = append(v, encodePrefix(p)...)
+		}
+		attrs = append(attrs, attr(flagOptional, attrMPUnreach, v)...)
+	}
+
+	if len(reach) > 0 {
+		attrs = append(attrs, pathAttrs(asPath, as4)...)
+
+		if afi == afiIPv4 {
+			attrs = append(attrs, attr(flagTransitive, attrNextHop, nextHop.To4())...)
+		} else {
+			v := append(u16(afi), safiUnicast, net.IPv6len)
+			v = append(v, nextHop.To16()...)
+			v = append(v, 0)
+			for _, p := range reach {
+				v = append(v, encodePrefix(p)...)
+			}
+			attrs = append(attrs, attr(flagOptional, attrMPReach, v)...)
+		}
+
+		if ibgp {
+			attrs = append(attrs, attr(flagTransitive, attrLocalPref, u32(defaultLPref))...)
+		}
+	}
+
+	b := append(u16(uint16(len(withdrawn))), withdrawn...)
+	b = append(b, u16(uint16(len(attrs)))...)
+	b = append(b, attrs...)
+	return append(b, nlri...)
+}
+
+// fitUpdates encodes n routes with enc, which encodes the routes from lo up to hi in one UPDATE message body
+// batches are halved until every message fits in the maximum message length
+func fitUpdates(n int, enc func(lo, hi int) []byte) [][]byte {
+	var r [][]byte
+	var split func(lo, hi int)
+	split = func(lo, hi int) {
+		b := enc(lo, hi)
+		if headerLen+len(b) <= maxMsgLen || hi-lo <= 1 {
+			r = append(r, b)
+			return
+		}
+		mid := lo + (hi-lo)/2
+		split(lo, mid)
+		split(mid, hi)
+	}
+	if n > 0 {
+		split(0, n)
+	}
+	return r
+}
+
+func decodeUpdate(b []byte, as4 bool) (*update, error) {
+	malformed := &notification{code: errUpdate, subcode: errUpdateAttr}
+	u := &update{}
+
+	if len(b) < 2 {
+		return nil, malformed
+	}
+	wl := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+wl+2 {
+		return nil, malformed
+	}
+	var err error
+	if u.unreach, err = decodePrefixes(b[2:2+wl], net.IPv4len); err != nil {
+		return nil, err
+	}
+	b = b[2+wl:]
+	al := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+al {
+		return nil, malformed
+	}
+	attrs := b[2 : 2+al]
+	nlri := b[2+al:]
+
+	for len(attrs) >= 3 {
+		flags, t := attrs[0], attrs[1]
+		var l, hl int
+		if flags&flagExtLen != 0 {
+			if len(attrs) < 4 {
+				return nil, malformed
+			}
+			l, hl = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		} else {
+			l, hl = int(attrs[2]), 3
+		}
+		if len(attrs) < hl+l {
+			return nil, malformed
+		}
+		v := attrs[hl : hl+l]
+		attrs = attrs[hl+l:]
+
+		switch t {
+		case attrASPath:
+			asLen := 2
+			if as4 {
+				asLen = 4
+			}
+			for len(v) >= 2 {
+				n := int(v[1])
+				if len(v) < 2+n*asLen {
+					return nil, malformed
+				}
+				for i := 0; i < n; i++ {
+					a := v[2+i*asLen : 2+(i+1)*asLen]
+					if as4 {
+						u.asPath = append(u.asPath, binary.BigEndian.Uint32(a))
+					} else {
+						u.asPath = append(u.asPath, uint32(binary.BigEndian.Uint16(a)))
+					}
+				}
+				v = v[2+n*asLen:]
+			}
+		case attrNextHop:
+			if len(v) != net.IPv4len {
+				return nil, malformed
+			}
+			u.nextHop = net.IP(append([]byte{}, v...))
+		case attrOriginatorID:
+			if len(v) == net.IPv4len {
+				u.originatorID = net.IP(append([]byte{}, v...))
+			}
+		case attrPMSITunnel:
+			if len(v) >= 5 {
+				u.pmsiLabel = int(v[2])<<16 | int(v[3])<<8 | int(v[4])
+				u.hasPMSI = true
+			}
+		case attrMPReach:
+			if len(v) < 5 {
+				continue
+			}
+			nhl := int(v[3])
+			if binary.BigEndian.Uint16(v) == afiL2VPN && v[2] == safiEVPN {
+				if len(v) < 5+nhl || (nhl != net.IPv4len && nhl != net.IPv6len) {
+					return nil, malformed
+				}
+				u.evpnNextHop = net.IP(append([]byte{}, v[4:4+nhl]...))
+				var r []*evpnRoute
+				if r, err = decodeEVPN(v[5+nhl:]); err != nil {
+					return nil, err
+				}
+				u.evpnReach = append(u.evpnReach, r...)
+				continue
+			}
+			if binary.BigEndian.Uint16(v) != afiIPv6 || v[2] != safiUnicast {
+				continue
+			}
+			if len(v) < 5+nhl || nhl < net.IPv6len {
+				return nil, malformed
+			}
+			// a 32 byte next hop is global followed by link local, use the global
+			u.nextHop = net.IP(append([]byte{}, v[4:4+net.IPv6len]...))
+			var r []*net.IPNet
+			if r, err = decodePrefixes(v[5+nhl:], net.IPv6len); err != nil {
+				return nil, err
+			}
+			u.reach = append(u.reach, r...)
+		case attrMPUnreach:
+			if len(v) >= 3 && binary.BigEndian.Uint16(v) == afiL2VPN && v[2] == safiEVPN {
+				var r []*evpnRoute
+				if r, err = decodeEVPN(v[3:]); err != nil {
+					return nil, err
+				}
+				u.evpnUnreach = append(u.evpnUnreach, r...)
+				continue
+			}
+			if len(v) < 3 || binary.BigEndian.Uint16(v) != afiIPv6 || v[2] != safiUnicast {
+				continue
+			}
+			var r []*net.IPNet
+			if r, err = decodePrefixes(v[3:], net.IPv6len); err != nil {
+				return nil, err
+			}
+			u.unreach = append(u.unreach, r...)
+		}
+	}
+
+	r, err := decodePrefixes(nlri, net.IPv4len)
+	if err != nil {
+		return nil, err
+	}
+	u.reach = append(u.reach, r...)
+
+	// vxlan evpn carries the vni of a type 3 route in it's pmsi tunnel attribute
+	for _, er := range u.evpnReach {
+		if er.typ == evpnIMET && u.hasPMSI {
+			er.vni = u.pmsiLabel
+		}
+	}
+
+	return u, nil
+}
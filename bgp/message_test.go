@@ -0,0 +1,75 @@
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func hostRoutes(t *testing.T, format string, n int) []*net.IPNet {
+	r := []*net.IPNet{}
+	for i := 0; i < n; i++ {
+		_, d, err := net.ParseCIDR(fmt.Sprintf(format, i/256, i%256))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+func TestFitUpdates(t *testing.T) {
+	for _, tc := range []struct {
+		afi     uint16
+		format  string
+		nextHop string
+	}{
+		{afiIPv4, "10.%d.%d.1/32", "192.0.2.1"},
+		{afiIPv6, "2001:db8::%x:%x/128", "2001:db8:ffff::1"},
+	} {
+		reach := hostRoutes(t, tc.format, 1000)
+		unreach := hostRoutes(t, "10.200.%d.%d/32", 300)
+		if tc.afi == afiIPv6 {
+			unreach = hostRoutes(t, "2001:db8:1::%x:%x/128", 300)
+		}
+		all := append(append([]*net.IPNet{}, unreach...), reach...)
+
+		msgs := fitUpdates(len(all), func(lo, hi int) []byte {
+			var r, u []*net.IPNet
+			for i := lo; i < hi; i++ {
+				if i < len(unreach) {
+					u = append(u, all[i])
+				} else {
+					r = append(r, all[i])
+				}
+			}
+			return encodeUpdate(tc.afi, r, u, net.ParseIP(tc.nextHop), []uint32{65001}, true, false)
+		})
+		if len(msgs) < 2 {
+			t.Errorf("afi %v: expected the routes to be split over several messages", tc.afi)
+		}
+
+		gotReach, gotUnreach := make(map[string]bool), make(map[string]bool)
+		for _, b := range msgs {
+			if headerLen+len(b) > maxMsgLen {
+				t.Fatalf("afi %v: message of %v bytes is over the maximum length", tc.afi, headerLen+len(b))
+			}
+			u, err := decodeUpdate(b, true)
+			if err != nil {
+				t.Fatalf("afi %v: %v", tc.afi, err)
+			}
+			if len(u.reach) > 0 && !u.nextHop.Equal(net.ParseIP(tc.nextHop)) {
+				t.Errorf("afi %v: expected next hop %v, got %v", tc.afi, tc.nextHop, u.nextHop)
+			}
+			for _, d := range u.reach {
+				gotReach[d.String()] = true
+			}
+			for _, d := range u.unreach {
+				gotUnreach[d.String()] = true
+			}
+		}
+		if len(gotReach) != len(reach) || len(gotUnreach) != len(unreach) {
+			t.Errorf("afi %v: expected %v advertised and %v withdrawn routes, got %v and %v", tc.afi, len(reach), len(unreach), len(gotReach), len(gotUnreach))
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const writeTimeout = 10 * time.Second
+
+type peer struct {
+	s   *Speaker
+	cfg *PeerConfig
+	log *log.Entry
+
+	l        sync.Mutex
+	active   *session
+	sessions map[*session]struct{}
+}
+
+type session struct {
+	p      *peer
+	conn   net.Conn
+	dialed bool
+	log    *log.Entry
+
+	remoteID net.IP
+	afi      uint16
+	evpn     bool
+	as4      bool
+	ibgp     bool
+	holdTime time.Duration
+	nextHop  net.IP
+
+	l       sync.Mutex
+	pending map[string]*pendingRoute
+	notify  chan struct{}
+	closing chan *notification
+	done    chan struct{}
+}
+
+type pendingRoute struct {
+	dst   *net.IPNet
+	evpn  *evpnRoute
+	reach bool
+}
+
+func newPeer(s *Speaker, pc *PeerConfig) *peer {
+	return &peer{
+		s:        s,
+		cfg:      pc,
+		log:      s.log.WithField("Peer", pc.String()),
+		sessions: make(map[*session]struct{}),
+	}
+}
+
+// connectLoop keeps trying to connect to the peer while there is no established session
+func (p *peer) connectLoop() {
+	defer p.s.wg.Done()
+	log := p.log.WithField("Func", "connectLoop()")
+
+	for {
+		// jitter avoids both sides repeatedly colliding
+		wait := time.Duration(rand.Int63n(int64(connectRetry)))
+		if s := p.established(); s != nil {
+			select {
+			case <-s.done:
+				continue
+			case <-p.s.stop:
+				return
+			}
+		}
+
+		conn, err := net.DialTimeout("tcp", p.cfg.String(), dialTimeout)
+		if err != nil {
+			log.WithError(err).Debug("failed to connect")
+			wait += connectRetry
+		} else {
+			p.runSession(conn, true)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-p.s.stop:
+			return
+		}
+	}
+}
+
+func (p *peer) established() *session {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return p.active
+}
+
+// claim makes s the active session for the peer, resolving connection collisions
+// the connection initiated by the speaker with the higher router id wins, as in RFC 4271 6.8
+func (p *peer) claim(s *session) error {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.active == nil {
+		p.active = s
+		return nil
+	}
+
+	if bytes.Compare(s.initiatorID(), p.active.initiatorID()) > 0 {
+		p.active.close(&notification{code: errCease, subcode: 7})
+		p.active = s
+		return nil
+	}
+	return &notification{code: errCease, subcode: 7}
+}
+
+func (p *peer) release(s *session) bool {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	delete(p.sessions, s)
+	if p.active != s {
+		return false
+	}
+	p.active = nil
+	return true
+}
+
+func (p *peer) closeAll(n *notification) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	for s := range p.sessions {
+		s.close(n)
+	}
+}
+
+// queue queues a route to be advertised or withdrawn on the active session
+func (p *peer) queue(dst *net.IPNet, reach bool) {
+	s := p.established()
+	if s == nil {
+		return
+	}
+	s.queue(dst, reach)
+}
+
+// queueEVPN queues an evpn route to be advertised or withdrawn on the active session
+func (p *peer) queueEVPN(r *evpnRoute, reach bool) {
+	s := p.established()
+	if s == nil {
+		return
+	}
+	s.queueEVPN(r, reach)
+}
+
+func (p *peer) runSession(conn net.Conn, dialed bool) {
+	s := &session{
+		p:       p,
+		conn:    conn,
+		dialed:  dialed,
+		log:     p.log.WithField("local", conn.LocalAddr().String()).WithField("remote", conn.RemoteAddr().String()),
+		afi:     afiIPv4,
+		pending: make(map[string]*pendingRoute),
+		notify:  make(chan struct{}, 1),
+		closing: make(chan *notification, 1),
+		done:    make(chan struct{}),
+	}
+	if ta, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		s.nextHop = ta.IP
+		if ta.IP.To4() == nil {
+			s.afi = afiIPv6
+		}
+	}
+
+	p.l.Lock()
+	p.sessions[s] = struct{}{}
+	p.l.Unlock()
+
+	err := s.run()
+	close(s.done)
+	conn.Close() // nolint: errcheck
+
+	if p.release(s) {
+		p.s.forget(p)
+	}
+	if err != nil {
+		s.log.WithError(err).Info("bgp session closed")
+	}
+}
+
+func (s *session) initiatorID() []byte {
+	if s.dialed {
+		return s.p.s.cfg.RouterID.To4()
+	}
+	return s.remoteID.To4()
+}
+
+// close asks the session to send a notification and shut down
+func (s *session) close(n *notification) {
+	select {
+	case s.closing <- n:
+	default:
+	}
+}
+
+func (s *session) queue(dst *net.IPNet, reach bool) {
+	if (dst.IP.To4() != nil) != (s.afi == afiIPv4) {
+		return
+	}
+	s.l.Lock()
+	s.pending[dst.String()] = &pendingRoute{dst: dst, reach: reach}
+	s.l.Unlock()
+	s.wake()
+}
+
+// queueEVPN only queues routes on sessions which negotiated the evpn address family
+func (s *session) queueEVPN(r *evpnRoute, reach bool) {
+	if !s.evpn {
+		return
+	}
+	s.l.Lock()
+	s.pending["evpn "+r.key()] = &pendingRoute{evpn: r, reach: reach}
+	s.l.Unlock()
+	s.wake()
+}
+
+func (s *session) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *session) write(t uint8, b []byte) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	return writeMsg(s.conn, t, b)
+}
+
+func (s *session) notifyAndClose(n *notification) error {
+	s.write(msgNotification, encodeNotification(n)) // nolint: errcheck
+	return n
+}
+
+type msg struct {
+	t   uint8
+	b   []byte
+	err error
+}
+
+// run brings up the session and handles it until it closes
+func (s *session) run() error {
+	sp := s.p.s
+	ours := &open{
+		as:       sp.cfg.ASN,
+		holdTime: uint16(sp.cfg.HoldTime / time.Second),
+		id:       sp.cfg.RouterID,
+		as4:      true,
+		families: map[uint32]bool{family(s.afi, safiUnicast): true, family(afiL2VPN, safiEVPN): true},
+	}
+	if err := s.write(msgOpen, encodeOpen(ours)); err != nil {
+		return err
+	}
+
+	msgs := make(chan *msg)
+	go func() {
+		for {
+			t, b, err := readMsg(s.conn)
+			select {
+			case msgs <- &msg{t, b, err}:
+			case <-s.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	established := false
+	hold := time.NewTimer(4 * time.Minute)
+	defer hold.Stop()
+	var keepalive <-chan time.Time
+
+	for {
+		select {
+		case <-sp.stop:
+			return s.notifyAndClose(&notification{code: errCease, subcode: 2})
+		case n := <-s.closing:
+			return s.notifyAndClose(n)
+		case <-hold.C:
+			return s.notifyAndClose(&notification{code: errHoldTimer})
+		case <-keepalive:
+			if err := s.write(msgKeepalive, nil); err != nil {
+				return err
+			}
+		case <-s.notify:
+			// routes queued in OpenConfirm are sent once the session is established
+			if !established {
+				continue
+			}
+			if err := s.flush(); err != nil {
+				return err
+			}
+		case m := <-msgs:
+			if m.err != nil {
+				if n, ok := m.err.(*notification); ok {
+					return s.notifyAndClose(n)
+				}
+				return m.err
+			}
+			if s.holdTime > 0 {
+				hold.Reset(s.holdTime)
+			}
+
+			switch {
+			case m.t == msgNotification:
+				return decodeNotification(m.b)
+			case m.t == msgOpen && s.remoteID == nil:
+				if err := s.handleOpen(m.b, ours); err != nil {
+					return err
+				}
+				if s.holdTime > 0 {
+					t := time.NewTicker(s.holdTime / 3)
+					defer t.Stop()
+					keepalive = t.C
+					hold.Reset(s.holdTime)
+				} else {
+					hold.Stop()
+				}
+			case m.t == msgKeepalive && s.remoteID != nil:
+				if established {
+					continue
+				}
+				established = true
+				s.log.Info("bgp session established")
+				for _, d := range sp.originatedRoutes() {
+					s.queue(d, true)
+				}
+				for _, r := range sp.originatedEVPNRoutes() {
+					s.queueEVPN(r, true)
+				}
+				if err := s.flush(); err != nil {
+					return err
+				}
+			case m.t == msgUpdate && established:
+				if err := s.handleUpdate(m.b); err != nil {
+					return err
+				}
+			default:
+				return s.notifyAndClose(&notification{code: 5}) // finite state machine error
+			}
+		}
+	}
+}
+
+func (s *session) handleOpen(b []byte, ours *open) error {
+	o, err := decodeOpen(b)
+	if err != nil {
+		if n, ok := err.(*notification); ok {
+			return s.notifyAndClose(n)
+		}
+		return err
+	}
+	if o.as != s.p.cfg.ASN {
+		return s.notifyAndClose(&notification{code: errOpen, subcode: errOpenBadAS})
+	}
+	if o.id.Equal(ours.id) || o.id.Equal(net.IPv4zero) {
+		return s.notifyAndClose(&notification{code: errOpen, subcode: errOpenBadID})
+	}
+	if o.holdTime == 1 || o.holdTime == 2 {
+		return s.notifyAndClose(&notification{code: errOpen, subcode: errOpenHold})
+	}
+	if s.afi == afiIPv6 && !o.families[family(afiIPv6, safiUnicast)] {
+		s.log.Warn("peer does not support ipv6 unicast, no routes will be exchanged")
+	}
+
+	s.remoteID = o.id
+	s.evpn = o.families[family(afiL2VPN, safiEVPN)]
+	s.as4 = o.as4
+	s.ibgp = o.as == s.p.s.cfg.ASN
+	s.holdTime = time.Duration(o.holdTime) * time.Second
+	if ours.holdTime < o.holdTime {
+		s.holdTime = time.Duration(ours.holdTime) * time.Second
+	}
+	s.log = s.log.WithField("remoteID", o.id.String())
+
+	if err = s.p.claim(s); err != nil {
+		s.log.Debug("lost connection collision")
+		return s.notifyAndClose(err.(*notification))
+	}
+	return s.write(msgKeepalive, nil)
+}
+
+// flush sends all pending advertisements and withdrawals, split into messages which fit the maximum message length
+func (s *session) flush() error {
+	s.l.Lock()
+	pending := s.pending
+	s.pending = make(map[string]*pendingRoute)
+	s.l.Unlock()
+
+	var asPath []uint32
+	if !s.ibgp {
+		asPath = []uint32{s.p.s.cfg.ASN}
+	}
+
+	var routes []*pendingRoute
+	var evpnUnreach []*evpnRoute
+	for _, pr := range pending {
+		switch {
+		case pr.evpn != nil && pr.reach:
+			// advertised evpn routes each get their own message
+			b := encodeEVPNUpdate(pr.evpn, nil, s.nextHop, s.p.s.cfg.ASN, asPath, s.as4, s.ibgp)
+			if err := s.write(msgUpdate, b); err != nil {
+				return err
+			}
+		case pr.evpn != nil:
+			evpnUnreach = append(evpnUnreach, pr.evpn)
+		default:
+			routes = append(routes, pr)
+		}
+	}
+
+	msgs := fitUpdates(len(routes), func(lo, hi int) []byte {
+		var reach, unreach []*net.IPNet
+		for _, pr := range routes[lo:hi] {
+			if pr.reach {
+				reach = append(reach, pr.dst)
+			} else {
+				unreach = append(unreach, pr.dst)
+			}
+		}
+		return encodeUpdate(s.afi, reach, unreach, s.nextHop, asPath, s.as4, s.ibgp)
+	})
+	msgs = append(msgs, fitUpdates(len(evpnUnreach), func(lo, hi int) []byte {
+		return encodeEVPNUpdate(nil, evpnUnreach[lo:hi], s.nextHop, s.p.s.cfg.ASN, asPath, s.as4, s.ibgp)
+	})...)
+	for _, b := range msgs {
+		if err := s.write(msgUpdate, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *session) handleUpdate(b []byte) error {
+	u, err := decodeUpdate(b, s.as4)
+	if err != nil {
+		if n, ok := err.(*notification); ok {
+			return s.notifyAndClose(n)
+		}
+		return err
+	}
+
+	for _, d := range u.unreach {
+		s.p.s.learn(s.p, d, nil)
+	}
+	for _, r := range u.evpnUnreach {
+		s.p.s.learnEVPN(s.p, r, nil)
+	}
+
+	if len(u.reach) == 0 && len(u.evpnReach) == 0 {
+		return nil
+	}
+	if err = s.checkLoop(u); err != nil {
+		s.log.WithError(err).Debug("ignoring routes")
+		return nil
+	}
+
+	if len(u.reach) > 0 && u.nextHop == nil {
+		s.log.Warn("ignoring routes without a next hop")
+	} else {
+		for _, d := range u.reach {
+			if ones, bits := d.Mask.Size(); ones != bits {
+				s.log.WithField("Dst", d.String()).Debug("ignoring non host route")
+				continue
+			}
+			s.p.s.learn(s.p, d, &learnedRoute{nextHop: u.nextHop, id: s.remoteID})
+		}
+	}
+
+	for _, r := range u.evpnReach {
+		if r.vni < 0 {
+			s.log.WithField("origin", r.origin.String()).Debug("ignoring type 3 route without a pmsi tunnel")
+			continue
+		}
+		s.p.s.learnEVPN(s.p, r, &learnedEVPN{route: r, nextHop: u.evpnNextHop, id: s.remoteID})
+	}
+	return nil
+}
+
+func (s *session) checkLoop(u *update) error {
+	cfg := s.p.s.cfg
+	if u.originatorID.Equal(cfg.RouterID) {
+		return fmt.Errorf("route originated by this speaker")
+	}
+	for _, as := range u.asPath {
+		if as == cfg.ASN && !s.ibgp {
+			return fmt.Errorf("local as in as path")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+// Package bgp is a minimal BGP-4 speaker. It originates the host routes vxrouter claims
+// and installs the host routes learned from its peers into the kernel, so no external
+// routing daemon is required. On evpn networks it also advertises the mac addresses
+// behind each vxlan, and programs the vxlan's fdb with the ones learned from its peers.
+package bgp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+const (
+	defaultPort     = 179
+	defaultHoldTime = 90 * time.Second
+	connectRetry    = 5 * time.Second
+	dialTimeout     = 5 * time.Second
+)
+
+var (
+	learnedProto  = vxrouter.GetEnvIntWithDefault(vxrouter.EnvPrefix+"BGP_ROUTE_PROTO", "", vxrouter.DefaultBGPRouteProto)
+	learnedMetric = vxrouter.GetEnvIntWithDefault(vxrouter.EnvPrefix+"BGP_ROUTE_METRIC", "", vxrouter.DefaultBGPRouteMetric)
+)
+
+// Config is the configuration of a Speaker
+type Config struct {
+	ASN      uint32
+	RouterID net.IP
+	// Listen is the address to accept connections from peers on, empty to only connect outbound
+	Listen   string
+	HoldTime time.Duration
+	Peers    []*PeerConfig
+}
+
+// PeerConfig is a bgp neighbor
+type PeerConfig struct {
+	Address net.IP
+	Port    int
+	ASN     uint32
+}
+
+// ParsePeer parses a neighbor in the form asn@address, asn@address:port or asn@[address]:port
+func ParsePeer(s string) (*PeerConfig, error) {
+	p := strings.SplitN(s, "@", 2)
+	if len(p) != 2 {
+		return nil, fmt.Errorf("peer %q is not in the form asn@address[:port]", s)
+	}
+	asn, err := strconv.ParseUint(p[0], 10, 32)
+	if err != nil || asn == 0 {
+		return nil, fmt.Errorf("invalid peer asn %q", p[0])
+	}
+
+	pc := &PeerConfig{ASN: uint32(asn), Port: defaultPort}
+	host := p[1]
+	if ip := net.ParseIP(host); ip == nil {
+		var port string
+		host, port, err = net.SplitHostPort(p[1])
+		if err != nil {
+			return nil, err
+		}
+		pc.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer port %q", port)
+		}
+	}
+	pc.Address = net.ParseIP(host)
+	if pc.Address == nil {
+		return nil, fmt.Errorf("invalid peer address %q", host)
+	}
+	return pc, nil
+}
+
+func (pc *PeerConfig) String() string {
+	return net.JoinHostPort(pc.Address.String(), strconv.Itoa(pc.Port))
+}
+
+type learnedRoute struct {
+	nextHop net.IP
+	id      net.IP
+}
+
+// Speaker is a bgp speaker
+type Speaker struct {
+	cfg   Config
+	log   *log.Entry
+	peers []*peer
+	ln    net.Listener
+	stop  chan struct{}
+	wg    sync.WaitGroup
+
+	l          sync.Mutex
+	originated map[string]*net.IPNet
+	learned    map[string]map[*peer]*learnedRoute
+	installed  map[string]*netlink.Route
+
+	// evpn routes, and the vxlans of the local evpn networks by vni
+	originatedEVPN map[string]*evpnRoute
+	learnedEVPN    map[string]map[*peer]*learnedEVPN
+	vnis           map[int]*vxlan.Vxlan
+}
+
+// New creates a bgp speaker, it will not connect to peers until Start is called
+func New(cfg Config) (*Speaker, error) {
+	if cfg.ASN == 0 {
+		return nil, fmt.Errorf("bgp asn is required")
+	}
+	if cfg.RouterID.To4() == nil {
+		return nil, fmt.Errorf("bgp router id must be an ipv4 address")
+	}
+	if cfg.HoldTime == 0 {
+		cfg.HoldTime = defaultHoldTime
+	}
+	if cfg.HoldTime < 3*time.Second {
+		return nil, fmt.Errorf("bgp hold time must be at least 3s")
+	}
+
+	s := &Speaker{
+		cfg:        cfg,
+		log:        log.WithField("bgp", cfg.RouterID.String()),
+		stop:       make(chan struct{}),
+		originated: make(map[string]*net.IPNet),
+		learned:    make(map[string]map[*peer]*learnedRoute),
+		installed:  make(map[string]*netlink.Route),
+
+		originatedEVPN: make(map[string]*evpnRoute),
+		learnedEVPN:    make(map[string]map[*peer]*learnedEVPN),
+		vnis:           make(map[int]*vxlan.Vxlan),
+	}
+	for _, pc := range cfg.Peers {
+		s.peers = append(s.peers, newPeer(s, pc))
+	}
+	return s, nil
+}
+
+// Start removes stale learned routes from the kernel, then starts listening and connecting to peers
+func (s *Speaker) Start() error {
+	log := s.log.WithField("Func", "Start()")
+	log.Debug()
+
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: learnedProto}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.WithError(err).Error("failed to list stale bgp routes")
+		return err
+	}
+	for i := range routes {
+		if err = kernel.Get().RouteDel(&routes[i]); err != nil {
+			log.WithError(err).WithField("Dst", routes[i].Dst.String()).Warn("failed to delete stale bgp route")
+		}
+	}
+
+	if s.cfg.Listen != "" {
+		s.ln, err = net.Listen("tcp", s.cfg.Listen)
+		if err != nil {
+			log.WithError(err).Error("failed to listen")
+			return err
+		}
+		s.wg.Add(1)
+		go s.acceptLoop()
+	}
+
+	for _, p := range s.peers {
+		s.wg.Add(1)
+		go p.connectLoop()
+	}
+	return nil
+}
+
+// Stop closes all sessions and removes learned routes and fdb entries from the kernel
+func (s *Speaker) Stop() {
+	log := s.log.WithField("Func", "Stop()")
+	log.Debug()
+
+	close(s.stop)
+	if s.ln != nil {
+		s.ln.Close() // nolint: errcheck
+	}
+	for _, p := range s.peers {
+		p.closeAll(&notification{code: errCease, subcode: 2})
+	}
+	s.wg.Wait()
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	for k, r := range s.installed {
+		if err := kernel.Get().RouteDel(r); err != nil {
+			log.WithError(err).WithField("Dst", k).Warn("failed to delete bgp route")
+		}
+		delete(s.installed, k)
+	}
+
+	s.learnedEVPN = make(map[string]map[*peer]*learnedEVPN)
+	for vni := range s.vnis {
+		if err := s.programVNI(vni); err != nil {
+			log.WithError(err).WithField("vni", vni).Warn("failed to remove evpn fdb entries")
+		}
+	}
+}
+
+// Addr returns the address the speaker is listening on, or nil if it is not listening
+func (s *Speaker) Addr() net.Addr {
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Speaker) acceptLoop() {
+	defer s.wg.Done()
+	log := s.log.WithField("Func", "acceptLoop()")
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			log.WithError(err).Error("failed to accept connection")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var p *peer
+		if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			for _, pp := range s.peers {
+				if pp.cfg.Address.Equal(ta.IP) {
+					p = pp
+					break
+				}
+			}
+		}
+		if p == nil {
+			log.WithField("remote", conn.RemoteAddr().String()).Warn("rejecting connection from unconfigured peer")
+			conn.Close() // nolint: errcheck
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			p.runSession(conn, false)
+		}()
+	}
+}
+
+func hostRoute(dst *net.IPNet) *net.IPNet {
+	if ip := dst.IP.To4(); ip != nil {
+		ones, _ := dst.Mask.Size()
+		if len(dst.Mask) == net.IPv6len {
+			ones -= 96
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}
+	}
+	return &net.IPNet{IP: dst.IP.To16(), Mask: dst.Mask}
+}
+
+// Announce originates dst to all peers
+func (s *Speaker) Announce(dst *net.IPNet) {
+	dst = hostRoute(dst)
+	s.log.WithField("Func", "Announce()").WithField("Dst", dst.String()).Debug()
+
+	s.l.Lock()
+	s.originated[dst.String()] = dst
+	s.l.Unlock()
+
+	for _, p := range s.peers {
+		p.queue(dst, true)
+	}
+}
+
+// Withdraw stops originating dst to all peers
+func (s *Speaker) Withdraw(dst *net.IPNet) {
+	dst = hostRoute(dst)
+	s.log.WithField("Func", "Withdraw()").WithField("Dst", dst.String()).Debug()
+
+	s.l.Lock()
+	delete(s.originated, dst.String())
+	s.l.Unlock()
+
+	for _, p := range s.peers {
+		p.queue(dst, false)
+	}
+}
+
+func (s *Speaker) originatedRoutes() []*net.IPNet {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	r := []*net.IPNet{}
+	for _, d := range s.originated {
+		r = append(r, d)
+	}
+	return r
+}
+
+// Learned returns the best next hop for each route currently learned from peers
+func (s *Speaker) Learned() map[string]net.IP {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	r := make(map[string]net.IP)
+	for k, rt := range s.installed {
+		r[k] = rt.Gw
+	}
+	return r
+}
+
+// learn records (or with a nil next hop, forgets) a route from a peer and updates the kernel
+func (s *Speaker) learn(p *peer, dst *net.IPNet, lr *learnedRoute) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	k := dst.String()
+	if lr == nil {
+		delete(s.learned[k], p)
+	} else {
+		if s.learned[k] == nil {
+			s.learned[k] = make(map[*peer]*learnedRoute)
+		}
+		s.learned[k][p] = lr
+	}
+	s.updateKernel(dst)
+}
+
+// forget removes all routes learned from a peer
+func (s *Speaker) forget(p *peer) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	for k, paths := range s.learned {
+		if _, ok := paths[p]; !ok {
+			continue
+		}
+		delete(paths, p)
+		_, dst, err := net.ParseCIDR(k)
+		if err != nil {
+			continue
+		}
+		s.updateKernel(dst)
+	}
+	s.forgetEVPN(p)
+}
+
+// updateKernel installs the best learned path for dst, s.l must be held
+// the best path is from the peer with the lowest router id, which is stable across all hosts
+func (s *Speaker) updateKernel(dst *net.IPNet) {
+	k := dst.String()
+	log := s.log.WithField("Func", "updateKernel()").WithField("Dst", k)
+
+	var best *learnedRoute
+	for _, lr := range s.learned[k] {
+		if best == nil || bytes.Compare(lr.id.To4(), best.id.To4()) < 0 {
+			best = lr
+		}
+	}
+	if len(s.learned[k]) == 0 {
+		delete(s.learned, k)
+	}
+
+	cur := s.installed[k]
+	if cur != nil && best != nil && cur.Gw.Equal(best.nextHop) {
+		return
+	}
+
+	if cur != nil {
+		if err := kernel.Get().RouteDel(cur); err != nil {
+			log.WithError(err).Warn("failed to delete learned route")
+		}
+		delete(s.installed, k)
+	}
+
+	if best == nil {
+		return
+	}
+
+	r := &netlink.Route{
+		Dst:      dst,
+		Gw:       best.nextHop,
+		Protocol: learnedProto,
+		Priority: learnedMetric,
+	}
+	if err := kernel.Get().RouteAdd(r); err != nil {
+		log.WithError(err).WithField("Gw", best.nextHop.String()).Error("failed to install learned route")
+		return
+	}
+	s.installed[k] = r
+}
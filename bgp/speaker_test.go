@@ -0,0 +1,404 @@
+package bgp
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/kernel/kerneltest"
+)
+
+const (
+	testASN     = 65000
+	testPeerASN = 65001
+)
+
+var (
+	testRouterID = net.ParseIP("192.0.2.1")
+	testPeerID   = net.ParseIP("192.0.2.2")
+)
+
+// standIn is a scripted bgp peer on a localhost listener, which the speaker under test connects to
+type standIn struct {
+	t    *testing.T
+	ln   net.Listener
+	conn net.Conn
+}
+
+func newStandIn(t *testing.T, addr string) *standIn {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %v: %v", addr, err)
+	}
+	return &standIn{t: t, ln: ln}
+}
+
+func (p *standIn) close() {
+	p.ln.Close() // nolint: errcheck
+	if p.conn != nil {
+		p.conn.Close() // nolint: errcheck
+	}
+}
+
+// peerConfig returns the configuration for the speaker to connect to the stand in
+func (p *standIn) peerConfig() *PeerConfig {
+	ta := p.ln.Addr().(*net.TCPAddr)
+	return &PeerConfig{Address: ta.IP, Port: ta.Port, ASN: testPeerASN}
+}
+
+func (p *standIn) accept() {
+	if tl, ok := p.ln.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	}
+	conn, err := p.ln.Accept()
+	if err != nil {
+		p.t.Fatalf("speaker did not connect: %v", err)
+	}
+	p.conn = conn
+}
+
+func (p *standIn) send(typ uint8, b []byte) {
+	if err := writeMsg(p.conn, typ, b); err != nil {
+		p.t.Fatalf("failed to send message type %v: %v", typ, err)
+	}
+}
+
+// next returns the next message other than a keepalive, or false if none arrives within wait
+func (p *standIn) next(wait time.Duration) (uint8, []byte, bool) {
+	deadline := time.Now().Add(wait)
+	for {
+		p.conn.SetReadDeadline(deadline) // nolint: errcheck
+		typ, b, err := readMsg(p.conn)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return 0, nil, false
+		}
+		if err != nil {
+			p.t.Fatalf("failed to read message: %v", err)
+		}
+		if typ != msgKeepalive {
+			return typ, b, true
+		}
+	}
+}
+
+func (p *standIn) expect(typ uint8) []byte {
+	t, b, ok := p.next(5 * time.Second)
+	if !ok {
+		p.t.Fatalf("no message of type %v received", typ)
+	}
+	if t != typ {
+		p.t.Fatalf("expected a message of type %v, got %v", typ, t)
+	}
+	return b
+}
+
+func (p *standIn) expectKeepalive() {
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	typ, _, err := readMsg(p.conn)
+	if err != nil || typ != msgKeepalive {
+		p.t.Fatalf("expected a keepalive, got type %v %v", typ, err)
+	}
+}
+
+func (p *standIn) expectUpdate() *update {
+	u, err := decodeUpdate(p.expect(msgUpdate), true)
+	if err != nil {
+		p.t.Fatalf("failed to decode update: %v", err)
+	}
+	return u
+}
+
+// open exchanges open messages with the speaker, offering families, and returns the speaker's open
+// the session is in OpenConfirm afterwards, until the stand in sends a keepalive
+func (p *standIn) open(holdTime uint16, families ...uint32) *open {
+	p.accept()
+	o, err := decodeOpen(p.expect(msgOpen))
+	if err != nil {
+		p.t.Fatalf("failed to decode open: %v", err)
+	}
+	fs := make(map[uint32]bool)
+	for _, f := range families {
+		fs[f] = true
+	}
+	p.send(msgOpen, encodeOpen(&open{as: testPeerASN, holdTime: holdTime, id: testPeerID, as4: true, families: fs}))
+	p.expectKeepalive()
+	return o
+}
+
+// establish opens the session and confirms it
+func (p *standIn) establish(families ...uint32) {
+	p.open(3, families...)
+	p.send(msgKeepalive, nil)
+}
+
+func useFakeKernel() (*kerneltest.Netlink, func()) {
+	k := kerneltest.New()
+	old := kernel.Set(k)
+	return k, func() { kernel.Set(old) }
+}
+
+func startSpeaker(t *testing.T, peers ...*PeerConfig) *Speaker {
+	s, err := New(Config{ASN: testASN, RouterID: testRouterID, HoldTime: 3 * time.Second, Peers: peers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	_, d, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func containsRoute(ds []*net.IPNet, d *net.IPNet) bool {
+	for _, x := range ds {
+		if x.String() == d.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// learnedRoutes returns the routes installed by the speaker, keyed by destination
+func learnedRoutes(t *testing.T) map[string]netlink.Route {
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: vxrouter.DefaultBGPRouteProto}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make(map[string]netlink.Route)
+	for _, rt := range routes {
+		r[rt.Dst.String()] = rt
+	}
+	return r
+}
+
+func eventually(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestOpenNegotiation(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	o := p.open(30, family(afiIPv4, safiUnicast))
+	if o.as != testASN || !o.as4 {
+		t.Errorf("expected 4 byte asn %v, got %v (as4 %v)", testASN, o.as, o.as4)
+	}
+	if !o.id.Equal(testRouterID) {
+		t.Errorf("expected router id %v, got %v", testRouterID, o.id)
+	}
+	if o.holdTime != 3 {
+		t.Errorf("expected hold time 3, got %v", o.holdTime)
+	}
+	if !o.families[family(afiIPv4, safiUnicast)] || !o.families[family(afiL2VPN, safiEVPN)] {
+		t.Errorf("expected ipv4 unicast and evpn to be offered, got %v", o.families)
+	}
+}
+
+func TestOpenBadAS(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	p.accept()
+	p.expect(msgOpen)
+	p.send(msgOpen, encodeOpen(&open{as: testPeerASN + 1, holdTime: 3, id: testPeerID, as4: true}))
+	n := decodeNotification(p.expect(msgNotification))
+	if n.code != errOpen || n.subcode != errOpenBadAS {
+		t.Errorf("expected a bad peer as notification, got %v/%v", n.code, n.subcode)
+	}
+}
+
+func TestAnnounceWithdrawIPv4(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	before := mustCIDR(t, "10.9.0.4/32")
+	during := mustCIDR(t, "10.9.0.5/32")
+	s.Announce(before)
+
+	p.open(3, family(afiIPv4, safiUnicast))
+	// nothing may be sent in OpenConfirm
+	s.Announce(during)
+	if typ, _, ok := p.next(300 * time.Millisecond); ok {
+		t.Fatalf("received message type %v before the session was established", typ)
+	}
+	p.send(msgKeepalive, nil)
+
+	got := []*net.IPNet{}
+	for len(got) < 2 {
+		u := p.expectUpdate()
+		if !u.nextHop.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("expected next hop 127.0.0.1, got %v", u.nextHop)
+		}
+		if len(u.asPath) != 1 || u.asPath[0] != testASN {
+			t.Errorf("expected as path [%v], got %v", testASN, u.asPath)
+		}
+		got = append(got, u.reach...)
+	}
+	if !containsRoute(got, before) || !containsRoute(got, during) {
+		t.Errorf("expected %v and %v to be advertised, got %v", before, during, got)
+	}
+
+	s.Withdraw(before)
+	u := p.expectUpdate()
+	if len(u.unreach) != 1 || u.unreach[0].String() != before.String() || len(u.reach) != 0 {
+		t.Errorf("expected %v to be withdrawn, got %v %v", before, u.unreach, u.reach)
+	}
+}
+
+func TestAnnounceWithdrawIPv6(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "[::1]:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	d := mustCIDR(t, "2001:db8::5/128")
+	p.establish(family(afiIPv6, safiUnicast))
+	// an ipv4 route can't be sent on a session over ipv6
+	s.Announce(mustCIDR(t, "10.9.0.6/32"))
+	s.Announce(d)
+
+	u := p.expectUpdate()
+	if len(u.reach) != 1 || u.reach[0].String() != d.String() {
+		t.Fatalf("expected %v to be advertised, got %v", d, u.reach)
+	}
+	if !u.nextHop.Equal(net.ParseIP("::1")) {
+		t.Errorf("expected next hop ::1, got %v", u.nextHop)
+	}
+
+	s.Withdraw(d)
+	u = p.expectUpdate()
+	if len(u.unreach) != 1 || u.unreach[0].String() != d.String() {
+		t.Errorf("expected %v to be withdrawn, got %v", d, u.unreach)
+	}
+}
+
+func TestLearnedRoutes(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	p.establish(family(afiIPv4, safiUnicast))
+
+	host := mustCIDR(t, "10.9.1.7/32")
+	nh := net.ParseIP("192.0.2.20")
+	path := []uint32{testPeerASN}
+	p.send(msgUpdate, encodeUpdate(afiIPv4, []*net.IPNet{host, mustCIDR(t, "10.9.2.0/24")}, nil, nh, path, true, false))
+	// routes through this speaker's as are loops
+	p.send(msgUpdate, encodeUpdate(afiIPv4, []*net.IPNet{mustCIDR(t, "10.9.1.8/32")}, nil, nh, []uint32{testPeerASN, testASN}, true, false))
+
+	if !eventually(func() bool { _, ok := learnedRoutes(t)[host.String()]; return ok }) {
+		t.Fatalf("learned route to %v not installed", host)
+	}
+	r := learnedRoutes(t)[host.String()]
+	if !r.Gw.Equal(nh) || r.Priority != vxrouter.DefaultBGPRouteMetric {
+		t.Errorf("expected a route via %v with metric %v, got %v metric %v", nh, vxrouter.DefaultBGPRouteMetric, r.Gw, r.Priority)
+	}
+	if n := len(learnedRoutes(t)); n != 1 {
+		t.Errorf("expected only the host route without a loop to be installed, got %v routes", n)
+	}
+	if !s.Learned()[host.String()].Equal(nh) {
+		t.Errorf("expected Learned to report %v via %v, got %v", host, nh, s.Learned())
+	}
+
+	p.send(msgUpdate, encodeUpdate(afiIPv4, nil, []*net.IPNet{host}, nil, nil, true, false))
+	if !eventually(func() bool { return len(learnedRoutes(t)) == 0 }) {
+		t.Errorf("withdrawn route not removed, got %v", learnedRoutes(t))
+	}
+}
+
+func TestHoldTimerExpiry(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+	defer s.Stop()
+
+	p.establish(family(afiIPv4, safiUnicast))
+	host := mustCIDR(t, "10.9.3.7/32")
+	p.send(msgUpdate, encodeUpdate(afiIPv4, []*net.IPNet{host}, nil, net.ParseIP("192.0.2.20"), []uint32{testPeerASN}, true, false))
+	if !eventually(func() bool { return len(learnedRoutes(t)) == 1 }) {
+		t.Fatalf("learned route to %v not installed", host)
+	}
+
+	// the stand in stops sending keepalives, so the 3 second hold time expires
+	start := time.Now()
+	n := decodeNotification(p.expect(msgNotification))
+	if n.code != errHoldTimer {
+		t.Errorf("expected a hold timer expired notification, got %v/%v", n.code, n.subcode)
+	}
+	if el := time.Since(start); el < 2*time.Second {
+		t.Errorf("hold timer expired after %v, before the hold time", el)
+	}
+	if !eventually(func() bool { return len(learnedRoutes(t)) == 0 }) {
+		t.Errorf("routes learned from the expired session not removed, got %v", learnedRoutes(t))
+	}
+}
+
+func TestStopRemovesLearnedRoutes(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	p := newStandIn(t, "127.0.0.1:0")
+	defer p.close()
+	s := startSpeaker(t, p.peerConfig())
+
+	p.establish(family(afiIPv4, safiUnicast))
+	for i := 1; i <= 3; i++ {
+		d := mustCIDR(t, "10.9.4."+strconv.Itoa(i)+"/32")
+		p.send(msgUpdate, encodeUpdate(afiIPv4, []*net.IPNet{d}, nil, net.ParseIP("192.0.2.20"), []uint32{testPeerASN}, true, false))
+	}
+	if !eventually(func() bool { return len(learnedRoutes(t)) == 3 }) {
+		t.Fatalf("expected 3 learned routes, got %v", learnedRoutes(t))
+	}
+
+	s.Stop()
+	n := decodeNotification(p.expect(msgNotification))
+	if n.code != errCease {
+		t.Errorf("expected a cease notification, got %v/%v", n.code, n.subcode)
+	}
+	if r := learnedRoutes(t); len(r) != 0 {
+		t.Errorf("learned routes not removed on stop, got %v", r)
+	}
+}
@@ -12,4 +12,6 @@ const (
 	IpamDriver              = "vxrIpam"
 	DefaultReqAddrSleepTime = 100 * time.Millisecond
 	DefaultRouteProto       = 192
+	DefaultBGPRouteProto    = 186
+	DefaultBGPRouteMetric   = 32
 )
@@ -0,0 +1,119 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/metrics"
+)
+
+const (
+	// ConflictPolicyNone only logs and counts duplicate claims
+	ConflictPolicyNone = "none"
+	// ConflictPolicyAddress releases the claim on the host with the higher underlay address.
+	// Both hosts come to the same decision without talking to each other, which is not possible
+	// with something like container age, since a host only knows about it's own containers.
+	ConflictPolicyAddress = "address"
+)
+
+// ValidConflictPolicy returns an error if p is not a known conflict policy
+func ValidConflictPolicy(p string) error {
+	switch p {
+	case ConflictPolicyNone, ConflictPolicyAddress:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %q", p)
+}
+
+// WatchConflicts watches the routing table for other hosts claiming addresses held by this host
+// and handles them according to policy. It blocks until ctx is cancelled.
+func (c *Core) WatchConflicts(ctx context.Context, policy string) {
+	log := log.WithField("func", "WatchConflicts()")
+
+	for {
+		conflicts := make(chan *host.Conflict)
+		errc := make(chan error, 1)
+		go func() { errc <- host.WatchConflicts(ctx.Done(), conflicts) }()
+
+	handle:
+		for {
+			select {
+			case hc := <-conflicts:
+				go c.handleConflict(hc, policy)
+			case err := <-errc:
+				if err != nil {
+					log.WithError(err).Error("failed to watch for conflicts")
+				}
+				break handle
+			}
+		}
+
+		select {
+		case <-time.After(eventsRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Core) handleConflict(hc *host.Conflict, policy string) {
+	log := log.WithField("func", "handleConflict()").WithField("ip", hc.IP.String()).WithField("network", hc.Network)
+	if hc.Route.Gw != nil {
+		log = log.WithField("gateway", hc.Route.Gw.String())
+	}
+
+	k := hc.IP.String()
+	c.claimsL.Lock()
+	if _, ok := c.conflicts[k]; ok {
+		c.claimsL.Unlock()
+		return
+	}
+	c.conflicts[k] = struct{}{}
+	c.claimsL.Unlock()
+	defer func() {
+		c.claimsL.Lock()
+		delete(c.conflicts, k)
+		c.claimsL.Unlock()
+	}()
+
+	// selectAddress resolves collisions within the propagation time on it's own
+	time.Sleep(c.propTime)
+	exists, err := hc.Exists()
+	if err != nil {
+		log.WithError(err).Error("failed to check conflict")
+		return
+	}
+	if !exists {
+		log.Debug("conflict resolved itself")
+		return
+	}
+
+	metrics.DuplicateClaims.WithLabelValues(hc.Network).Inc()
+	log.Error("address claimed by this host was also claimed by another host")
+
+	if policy != ConflictPolicyAddress {
+		return
+	}
+
+	local, err := hc.LocalAddress()
+	if err != nil {
+		log.WithError(err).Warn("unable to tie-break conflict")
+		return
+	}
+	if bytes.Compare(local.To16(), hc.Route.Gw.To16()) < 0 {
+		log.WithField("local", local.String()).Info("keeping claim, this host has the lower address")
+		return
+	}
+
+	if err = c.releaseAddress(hc.IP, host.MainTable); err != nil {
+		log.WithError(err).Error("failed to release claim")
+		return
+	}
+	metrics.DuplicateClaimsReleased.WithLabelValues(hc.Network).Inc()
+	log.WithField("local", local.String()).Error("released claim, this host has the higher address. The container using this address must be restarted")
+}
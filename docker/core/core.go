@@ -3,10 +3,12 @@ package core
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"golang.org/x/net/context"
@@ -22,14 +24,42 @@ const (
 	dockerTimeout     = 5 * time.Second
 )
 
+// ErrNetworkNotFound is returned when no docker network uses a pool, as happens while docker is still creating it
+var ErrNetworkNotFound = fmt.Errorf("network resource not found")
+
+// ErrNoHashKey is returned when a network using the hash allocation strategy is asked for an address without a mac address to derive it from
+var ErrNoHashKey = fmt.Errorf("allocstrategy hash needs the endpoint's mac address, set --mac-address or request an address with --ip")
+
+// DockerClient is the subset of the docker client used by Core
+type DockerClient interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+}
+
 // Core is a wrapper for docker client type things
 type Core struct {
-	dc       *client.Client
+	dc       DockerClient
 	propTime time.Duration
 	respTime time.Duration
 	getNr    chan *getNr
 	delNr    chan string
 	putNr    chan *types.NetworkResource
+
+	// reconcileL serializes full and event driven reconciles
+	reconcileL sync.Mutex
+	claimsL    sync.Mutex
+	claims     map[string]time.Time
+	conflicts  map[string]struct{}
+
+	// spaces maps named address spaces to their routing tables
+	spacesL sync.RWMutex
+	spaces  map[string]int
+
+	// journal is nil unless OpenJournal was called
+	journal *journal
 }
 
 // New creates a new client
@@ -39,17 +69,25 @@ func New(propTime, respTime time.Duration) (*Core, error) {
 		return nil, err
 	}
 
+	return NewWithClient(dc, propTime, respTime), nil
+}
+
+// NewWithClient creates a new core using an existing docker client
+func NewWithClient(dc DockerClient, propTime, respTime time.Duration) *Core {
 	c := &Core{
-		dc:       dc,
-		propTime: propTime,
-		respTime: respTime,
-		getNr:    make(chan *getNr),
-		delNr:    make(chan string),
-		putNr:    make(chan *types.NetworkResource),
+		dc:        dc,
+		propTime:  propTime,
+		respTime:  respTime,
+		getNr:     make(chan *getNr),
+		delNr:     make(chan string),
+		putNr:     make(chan *types.NetworkResource),
+		claims:    make(map[string]time.Time),
+		conflicts: make(map[string]struct{}),
+		spaces:    make(map[string]int),
 	}
 
 	go nrCacheLoop(c.getNr, c.delNr, c.putNr)
-	return c, nil
+	return c
 }
 
 // getNetworkResourceByID gets a network resource by ID (checks cache first)
@@ -77,12 +115,13 @@ func (c *Core) getNetworkResourceByID(id string) (*types.NetworkResource, error)
 	return nr, nil
 }
 
-// getNetworkResourceByPool gets a network resource by it's subnet
-func (c *Core) getNetworkResourceByPool(pool string) (*types.NetworkResource, error) {
-	log := log.WithField("pool", pool)
+// getNetworkResourceByPool gets a network resource by it's subnet and address space
+func (c *Core) getNetworkResourceByPool(space, pool string) (*types.NetworkResource, error) {
+	log := log.WithField("pool", pool).WithField("space", space)
 	log.Debug("getNetworkResourceByPool")
 
-	nr := c.getNrFromCache(pool)
+	key := poolKey(space, pool)
+	nr := c.getNrFromCache(key)
 	if nr != nil {
 		return nr, nil
 	}
@@ -102,48 +141,108 @@ func (c *Core) getNetworkResourceByPool(pool string) (*types.NetworkResource, er
 		if err != nil {
 			continue
 		}
-		tp, _ := poolFromNR(nr) // nolint: errcheck
-		if tp == pool {
-			return nr, nil
+		for _, tp := range poolsFromNR(nr) {
+			if poolKey(spaceFromNR(nr), tp) == key {
+				return nr, nil
+			}
 		}
 	}
 
-	return nil, fmt.Errorf("network resource not found")
+	return nil, ErrNetworkNotFound
+}
+
+// UsedSubnets returns the ipv4 or ipv6 subnets of all vxrnet networks in space, and the destinations of all routes
+// in the space's table. Automatically allocated pools must not overlap any of them
+func (c *Core) UsedSubnets(space string, v6 bool) ([]*net.IPNet, error) {
+	log := log.WithField("v6", v6).WithField("space", space)
+	log.Debug("UsedSubnets()")
+
+	table, err := c.spaceTable(space)
+	if err != nil {
+		return nil, err
+	}
+	used, err := host.RouteDestinations(v6, table)
+	if err != nil {
+		return nil, err
+	}
+
+	flts := filters.NewArgs()
+	flts.Add("driver", networkDriverName)
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	nl, err := c.dc.NetworkList(ctx, types.NetworkListOptions{Filters: flts})
+	if err != nil {
+		log.WithError(err).Error("failed to list networks")
+		return nil, err
+	}
+
+	for i := range nl {
+		if !SameAddressSpace(spaceFromNR(&nl[i]), space) {
+			continue
+		}
+		for _, p := range poolsFromNR(&nl[i]) {
+			var sn *net.IPNet
+			_, sn, err = net.ParseCIDR(p)
+			if err != nil {
+				continue
+			}
+			if (sn.IP.To4() == nil) != v6 {
+				continue
+			}
+			used = append(used, sn)
+		}
+	}
+	return used, nil
 }
 
 // Uncache uncaches the network resources
 func (c *Core) Uncache(poolid string) {
-	pool := poolFromID(poolid)
-	c.delNrInCache(pool)
+	c.delNrInCache(poolKey(SpaceFromID(poolid), PoolFromID(poolid)))
 }
 
 func (c *Core) connectIfNotConnected(addr, nrID string) (bool, error) {
 	ip := net.ParseIP(addr)
-	numRoutes, err := host.VxroutesTo(ip)
+	nr, err := c.getNetworkResourceByID(nrID)
+	if err != nil {
+		return false, err
+	}
+	table, err := c.tableFromNR(nr)
+	if err != nil {
+		return false, err
+	}
+	numRoutes, err := host.VxroutesTo(ip, table)
 	if err != nil {
 		return false, err
 	}
 	if numRoutes > 0 {
 		return false, nil
 	}
-	nr, err := c.getNetworkResourceByID(nrID)
+	numRoutes, err = host.RoutesTo(ip, table)
+	if err != nil {
+		return false, err
+	}
+	if numRoutes > 0 {
+		return false, fmt.Errorf("%v is claimed by another host", ip)
+	}
+	pool, err := poolFromAddress(nr, ip)
 	if err != nil {
 		return false, err
 	}
-	_, err = c.connectAndGetAddress(ip, nr)
+	_, err = c.connectAndGetAddress(ip, pool, "", nr)
 	return true, err
 }
 
 // ConnectAndGetAddress connects the host to the network for the
-// passed in pool, and returns either an available random or the
-// requested address if it's available
-func (c *Core) ConnectAndGetAddress(addr, poolid string) (*net.IPNet, error) {
+// passed in pool, and returns either an available address picked by the
+// network's allocation strategy or the requested address if it's available
+// key identifies the endpoint for the hash allocation strategy
+func (c *Core) ConnectAndGetAddress(addr, poolid, key string) (*net.IPNet, error) {
 	log := log.WithField("addr", addr)
 	log = log.WithField("poolid", poolid)
 	log.Debug("ConnectAndGetAddress()")
 
-	pool := poolFromID(poolid)
-	nr, err := c.getNetworkResourceByPool(pool)
+	pool := PoolFromID(poolid)
+	nr, err := c.getNetworkResourceByPool(SpaceFromID(poolid), pool)
 	if err != nil {
 		log.WithError(err).Error("failed to get network resource")
 		return nil, err
@@ -151,49 +250,114 @@ func (c *Core) ConnectAndGetAddress(addr, poolid string) (*net.IPNet, error) {
 
 	ip := net.ParseIP(addr)
 
-	return c.connectAndGetAddress(ip, nr)
+	return c.connectAndGetAddress(ip, pool, key, nr)
 }
 
-func (c *Core) connectAndGetAddress(addr net.IP, nr *types.NetworkResource) (*net.IPNet, error) {
-	if nr.IPAM.Driver != vxrouter.IpamDriver || nr.Driver != vxrouter.NetworkDriver {
+func (c *Core) connectAndGetAddress(addr net.IP, pool, key string, nr *types.NetworkResource) (*net.IPNet, error) {
+	if !isVxrNet(nr) {
 		log.WithField("ipam-driver", nr.IPAM.Driver).WithField("network-driver", nr.Driver).Debug("not a vxrnet, refusing to connectAndGetAddress")
 		return nil, nil
 	}
-	gw, err := GatewayFromNR(nr)
+	_, sn, err := net.ParseCIDR(pool)
 	if err != nil {
-		log.WithError(err).Error("failed to get gateway")
+		log.WithError(err).Error("failed to parse pool")
+		return nil, err
+	}
+	gws, err := GatewaysFromNR(nr)
+	if err != nil {
+		log.WithError(err).Error("failed to get gateways")
 		return nil, err
 	}
 
 	//exclude network and (normal) broadcast addresses by default
-	xf := vxrouter.GetEnvIntWithDefault(envPrefix+"excludefirst", nr.Options["excludefirst"], 1)
-	xl := vxrouter.GetEnvIntWithDefault(envPrefix+"excludelast", nr.Options["excludelast"], 1)
+	alloc := &host.Allocation{
+		Strategy:     vxrouter.GetEnvStringWithDefault(envPrefix+"allocstrategy", nr.Options["allocstrategy"], host.AllocRandom),
+		Key:          key,
+		ExcludeFirst: vxrouter.GetEnvIntWithDefault(envPrefix+"excludefirst", nr.Options["excludefirst"], 1),
+		ExcludeLast:  vxrouter.GetEnvIntWithDefault(envPrefix+"excludelast", nr.Options["excludelast"], 1),
+	}
+	if err = host.ValidAllocStrategy(alloc.Strategy); err != nil {
+		log.WithError(err).Error("invalid allocation strategy")
+		return nil, err
+	}
+	// docker only passes a mac address when one was set, and a random address would not be stable across restarts
+	if alloc.Strategy == host.AllocHash && key == "" && addr == nil {
+		log.WithError(ErrNoHashKey).Error("no key for the hash allocation strategy")
+		return nil, ErrNoHashKey
+	}
+	alloc.Exclude, err = host.ParseExclude(vxrouter.GetEnvStringWithDefault(envPrefix+"exclude", nr.Options["exclude"], ""))
+	if err != nil {
+		log.WithError(err).Error("invalid excluded addresses")
+		return nil, err
+	}
+	alloc.Range, err = ipRangeFromNR(nr, pool)
+	if err != nil {
+		log.WithError(err).Error("failed to parse ip range")
+		return nil, err
+	}
+	alloc.Exclude = append(alloc.Exclude, auxAddressesFromNR(nr)...)
+
+	table, err := c.tableFromNR(nr)
+	if err != nil {
+		log.WithError(err).Error("failed to get routing table")
+		return nil, err
+	}
 
-	hi, err := host.GetOrCreateInterface(nr.Name, gw, nr.Options)
+	hi, err := host.GetOrCreateInterface(nr.Name, gws, nr.Options, table, hostGatewayFromNR(nr))
 	if err != nil {
 		log.WithError(err).Error("failed to get or create host interface")
 		return nil, err
 	}
 
-	return hi.SelectAddress(addr, c.propTime, c.respTime, xf, xl)
+	a, err := hi.SelectAddress(sn, addr, c.propTime, c.respTime, alloc)
+	if err != nil {
+		return nil, err
+	}
+	c.markClaimed(a.IP)
+	return a, nil
 }
 
-// GetGatewayByNetID loops over the IPAMConfig array, combine gw and sn into a cidr
-func (c *Core) GetGatewayByNetID(netid string) (*net.IPNet, error) {
+func isVxrNet(nr *types.NetworkResource) bool {
+	return nr.IPAM.Driver == vxrouter.IpamDriver && nr.Driver == vxrouter.NetworkDriver
+}
+
+// GetGatewaysByNetID loops over the IPAMConfig array, combine gw and sn into a cidr for each subnet
+func (c *Core) GetGatewaysByNetID(netid string) ([]*net.IPNet, error) {
 	log := log.WithField("netid", netid)
-	log.Debug("GetGatewayByNetID()")
+	log.Debug("GetGatewaysByNetID()")
 
 	nr, err := c.getNetworkResourceByID(netid)
 	if err != nil {
 		log.WithError(err).WithField("NetworkID", netid).Error("failed to get network resource")
 		return nil, err
 	}
-	return GatewayFromNR(nr)
+	return GatewaysFromNR(nr)
+}
+
+// IsInternalByNetID returns true if the network is an internal network, which containers get no gateway on
+func (c *Core) IsInternalByNetID(netid string) (bool, error) {
+	nr, err := c.getNetworkResourceByID(netid)
+	if err != nil {
+		log.WithError(err).WithField("NetworkID", netid).Error("failed to get network resource")
+		return false, err
+	}
+	return nr.Internal, nil
+}
+
+// HasOwnMACByNetID returns true if the containers on the network get their own mac address
+func (c *Core) HasOwnMACByNetID(netid string) (bool, error) {
+	nr, err := c.getNetworkResourceByID(netid)
+	if err != nil {
+		log.WithError(err).WithField("NetworkID", netid).Error("failed to get network resource")
+		return false, err
+	}
+	return host.HasOwnMAC(nr.Options), nil
 }
 
 // CreateContainerInterface creates the macvlan to be put into a container namespace
+// with the mac address mac, or a random one if mac is nil
 // returns the name of the interface
-func (c *Core) CreateContainerInterface(netid, endpointid string) (string, error) {
+func (c *Core) CreateContainerInterface(netid, endpointid string, mac net.HardwareAddr) (string, error) {
 	log := log.WithField("netid", netid)
 	log = log.WithField("endpointid", endpointid)
 	log.Debug("CreateContainerInterface()")
@@ -204,19 +368,25 @@ func (c *Core) CreateContainerInterface(netid, endpointid string) (string, error
 		return "", err
 	}
 
-	gw, err := GatewayFromNR(nr)
+	gws, err := GatewaysFromNR(nr)
+	if err != nil {
+		log.WithError(err).Error("failed to get gateways")
+		return "", err
+	}
+
+	table, err := c.tableFromNR(nr)
 	if err != nil {
-		log.WithError(err).Error("failed to get gateway")
+		log.WithError(err).Error("failed to get routing table")
 		return "", err
 	}
 
-	hi, err := host.GetOrCreateInterface(nr.Name, gw, nr.Options)
+	hi, err := host.GetOrCreateInterface(nr.Name, gws, nr.Options, table, hostGatewayFromNR(nr))
 	if err != nil {
 		return "", err
 	}
 
 	mvlName := "cmvl_" + endpointid[:7]
-	err = hi.CreateMacvlan(mvlName)
+	err = hi.CreateMacvlan(mvlName, mac)
 	if err != nil {
 		log.WithError(err).Error("failed to create macvlan for container")
 		return "", err
@@ -253,9 +423,19 @@ func (c *Core) DeleteContainerInterface(netid, endpointid string) error {
 	return nil
 }
 
-// DeleteRoute deletes a route and attempts to delete the host interface
-func (c *Core) DeleteRoute(address string) error {
-	hi, err := c.deleteRoute(net.ParseIP(address))
+// DeleteRoute deletes the route to an address in the pool's address space and attempts to delete the host interface
+func (c *Core) DeleteRoute(poolid, address string) error {
+	table, err := c.spaceTable(SpaceFromID(poolid))
+	if err != nil {
+		return err
+	}
+	return c.releaseAddress(net.ParseIP(address), table)
+}
+
+// releaseAddress deletes the route to ip in table and attempts to delete the host interface
+func (c *Core) releaseAddress(ip net.IP, table int) error {
+	c.forgetClaim(ip)
+	hi, err := c.deleteRoute(ip, table)
 	if err != nil {
 		return err
 	}
@@ -271,8 +451,8 @@ func (c *Core) DeleteRoute(address string) error {
 
 // deleteRoute only deletes the route, passing back host.interface
 // so that the caller can decide if it wants to call hi.Delete()
-func (c *Core) deleteRoute(addr net.IP) (*host.Interface, error) {
-	hi, err := host.GetInterfaceFromDestinationAddress(addr)
+func (c *Core) deleteRoute(addr net.IP, table int) (*host.Interface, error) {
+	hi, err := host.GetInterfaceFromDestinationAddress(addr, table)
 	if err != nil {
 		return nil, err
 	}
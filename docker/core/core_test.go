@@ -0,0 +1,705 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/context"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/kernel/kerneltest"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+// fakeDocker is a DockerClient serving a fixed set of networks and containers
+// messages sent on events are delivered to the subscriber of the event stream
+type fakeDocker struct {
+	l          sync.Mutex
+	networks   []types.NetworkResource
+	containers map[string]*types.ContainerJSON
+	events     chan events.Message
+}
+
+func newFakeDocker(nrs ...types.NetworkResource) *fakeDocker {
+	return &fakeDocker{networks: nrs, containers: make(map[string]*types.ContainerJSON), events: make(chan events.Message)}
+}
+
+// run adds or replaces a container with an address on each network in addrs, keyed by network id
+func (f *fakeDocker) run(id string, running bool, addrs map[string]string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	ctr := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, State: &types.ContainerState{Running: running}},
+		NetworkSettings:   &types.NetworkSettings{Networks: make(map[string]*network.EndpointSettings)},
+	}
+	for netid, a := range addrs {
+		for _, nr := range f.networks {
+			if nr.ID == netid {
+				ctr.NetworkSettings.Networks[nr.Name] = &network.EndpointSettings{NetworkID: netid, EndpointID: id + netid, IPAddress: a}
+			}
+		}
+	}
+	f.containers[id] = ctr
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	nets := options.Filters.Get("network")
+	r := []types.Container{}
+	for _, c := range f.containers {
+		if !c.State.Running {
+			continue
+		}
+		ctr := types.Container{ID: c.ID, NetworkSettings: &types.SummaryNetworkSettings{Networks: c.NetworkSettings.Networks}}
+		if len(nets) == 0 {
+			r = append(r, ctr)
+			continue
+		}
+		for _, es := range c.NetworkSettings.Networks {
+			if es.NetworkID == nets[0] {
+				r = append(r, ctr)
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	c, ok := f.containers[container]
+	if !ok {
+		return types.ContainerJSON{}, fmt.Errorf("no such container %v", container)
+	}
+	return *c, nil
+}
+
+// Events ends the stream with the context's error once it is done, like the docker client
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	errs := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		errs <- ctx.Err()
+	}()
+	return f.events, errs
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	for _, nr := range f.networks {
+		if nr.ID == networkID || nr.Name == networkID {
+			return nr, nil
+		}
+	}
+	return types.NetworkResource{}, fmt.Errorf("no such network %v", networkID)
+}
+
+func (f *fakeDocker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return append([]types.NetworkResource{}, f.networks...), nil
+}
+
+func testNetwork(id, name, vni, subnet, gateway string) types.NetworkResource {
+	return types.NetworkResource{
+		ID:      id,
+		Name:    name,
+		Driver:  vxrouter.NetworkDriver,
+		Options: map[string]string{"vxlanid": vni, "allocstrategy": "sequential"},
+		IPAM: network.IPAM{
+			Driver: vxrouter.IpamDriver,
+			Config: []network.IPAMConfig{{Subnet: subnet, Gateway: gateway}},
+		},
+	}
+}
+
+func useFakeKernel() (*kerneltest.Netlink, func()) {
+	k := kerneltest.New()
+	old := kernel.Set(k)
+	return k, func() { kernel.Set(old) }
+}
+
+// claimedRoutes returns the destinations of the vxrouter routes in the main table
+func claimedRoutes(t *testing.T) map[string]netlink.Route {
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: vxrouter.DefaultRouteProto}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make(map[string]netlink.Route)
+	for _, rt := range routes {
+		r[rt.Dst.IP.String()] = rt
+	}
+	return r
+}
+
+func linkExists(name string) bool {
+	_, err := kernel.Get().LinkByName(name)
+	return err == nil
+}
+
+// eventually polls cond for up to a second, for work done in the background
+func eventually(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestConnectAndGetAddress(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netca", "ca", "200", "10.2.0.0/24", "10.2.0.1")
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+	poolid := PoolID(LocalAddressSpace, "10.2.0.0/24")
+
+	a, err := c.ConnectAndGetAddress("", poolid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "10.2.0.2/24" {
+		t.Errorf("expected the first free address 10.2.0.2/24, got %v", a)
+	}
+	mvl, err := kernel.Get().LinkByName("hmvl_ca")
+	if err != nil {
+		t.Fatalf("host macvlan not created: %v", err)
+	}
+	r, ok := claimedRoutes(t)["10.2.0.2"]
+	if !ok || r.LinkIndex != mvl.Attrs().Index {
+		t.Fatalf("expected a route to 10.2.0.2 through the host macvlan, got %v", r)
+	}
+
+	a, err = c.ConnectAndGetAddress("10.2.0.30", poolid, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "10.2.0.30/24" {
+		t.Errorf("expected the requested address, got %v", a)
+	}
+
+	mac := net.HardwareAddr{0x02, 0x42, 10, 2, 0, 2}
+	name, err := c.CreateContainerInterface("netca", "0123456789abcdef", mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmvl, err := kernel.Get().LinkByName(name)
+	if err != nil {
+		t.Fatalf("container macvlan not created: %v", err)
+	}
+	if cmvl.Attrs().HardwareAddr.String() != mac.String() || cmvl.Attrs().ParentIndex != mvl.Attrs().ParentIndex {
+		t.Errorf("expected a macvlan on the vxlan with mac %v, got %v on %v", mac, cmvl.Attrs().HardwareAddr, cmvl.Attrs().ParentIndex)
+	}
+	if err = c.DeleteContainerInterface("netca", "0123456789abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if linkExists(name) {
+		t.Errorf("container macvlan not deleted")
+	}
+
+	if err = c.DeleteRoute(poolid, "10.2.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok = claimedRoutes(t)["10.2.0.2"]; ok {
+		t.Errorf("route to 10.2.0.2 not deleted")
+	}
+	if !linkExists("ca") {
+		t.Errorf("vxlan deleted while 10.2.0.30 is claimed")
+	}
+
+	if err = c.DeleteRoute(poolid, "10.2.0.30"); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return !linkExists("ca") && !linkExists("hmvl_ca") }) {
+		t.Errorf("host interface not deleted after the last address was released")
+	}
+}
+
+func TestConnectAndGetAddressUnknownPool(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	c := NewWithClient(newFakeDocker(testNetwork("netup", "up", "201", "10.3.0.0/24", "10.3.0.1")), 0, time.Second)
+	if _, err := c.ConnectAndGetAddress("", PoolID(LocalAddressSpace, "10.4.0.0/24"), ""); err != ErrNetworkNotFound {
+		t.Errorf("expected ErrNetworkNotFound, got %v", err)
+	}
+	if linkExists("up") {
+		t.Errorf("host interface created for another network")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	k, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netrc", "rc", "202", "10.5.0.0/24", "10.5.0.1")
+	fd := newFakeDocker(nr)
+	c := NewWithClient(fd, 0, time.Second)
+
+	// a container whose route is missing, and a route no container uses
+	fd.run("ctr1", true, map[string]string{"netrc": "10.5.0.5"})
+	if _, err := c.ConnectAndGetAddress("10.5.0.9", PoolID(LocalAddressSpace, "10.5.0.0/24"), ""); err != nil {
+		t.Fatal(err)
+	}
+	c.forgetClaim(net.ParseIP("10.5.0.9"))
+	// a container whose address is routed to another host
+	fd.run("ctr2", true, map[string]string{"netrc": "10.5.0.7"})
+	err := k.RouteAdd(&netlink.Route{Dst: netlink.NewIPNet(net.ParseIP("10.5.0.7")), Gw: net.ParseIP("10.5.0.254"), Protocol: 186})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Reconcile()
+
+	routes := claimedRoutes(t)
+	if _, ok := routes["10.5.0.5"]; !ok {
+		t.Errorf("missing route to 10.5.0.5 not added")
+	}
+	if _, ok := routes["10.5.0.9"]; ok {
+		t.Errorf("orphaned route to 10.5.0.9 not deleted")
+	}
+	if _, ok := routes["10.5.0.7"]; ok {
+		t.Errorf("claimed 10.5.0.7, which is routed to another host")
+	}
+
+	// once the container is seen running its address is no longer protected, and stopping it releases the address
+	c.reconcileContainer("ctr1")
+	fd.run("ctr1", false, map[string]string{"netrc": "10.5.0.5"})
+	c.reconcileContainer("ctr1")
+
+	if _, ok := claimedRoutes(t)["10.5.0.5"]; ok {
+		t.Errorf("route to 10.5.0.5 not deleted after the container stopped")
+	}
+	if linkExists("rc") || linkExists("hmvl_rc") {
+		t.Errorf("host interface not deleted after the last container stopped")
+	}
+}
+
+func TestReconcileGracePeriod(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netgp", "gp", "203", "10.6.0.0/24", "10.6.0.1")
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+
+	// the container using a freshly claimed address is not listed yet
+	if _, err := c.ConnectAndGetAddress("10.6.0.4", PoolID(LocalAddressSpace, "10.6.0.0/24"), ""); err != nil {
+		t.Fatal(err)
+	}
+	c.Reconcile()
+
+	if _, ok := claimedRoutes(t)["10.6.0.4"]; !ok {
+		t.Errorf("recently claimed route deleted")
+	}
+	if !linkExists("gp") {
+		t.Errorf("host interface of a recently claimed route deleted")
+	}
+}
+
+func TestConnectAndGetAddressHash(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netha", "ha", "204", "10.7.0.0/24", "10.7.0.1")
+	nr.Options["allocstrategy"] = "hash"
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+	poolid := PoolID(LocalAddressSpace, "10.7.0.0/24")
+
+	// without a mac address the address would not be stable, so none is handed out
+	if _, err := c.ConnectAndGetAddress("", poolid, ""); err != ErrNoHashKey {
+		t.Errorf("expected ErrNoHashKey, got %v", err)
+	}
+	if len(claimedRoutes(t)) != 0 || linkExists("ha") {
+		t.Errorf("claimed an address without a key")
+	}
+
+	a, err := c.ConnectAndGetAddress("", poolid, "02:42:0a:07:00:99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.DeleteRoute(poolid, a.IP.String()); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return !linkExists("ha") }) {
+		t.Fatalf("host interface not deleted after the address was released")
+	}
+	b, err := c.ConnectAndGetAddress("", poolid, "02:42:0a:07:00:99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.IP.Equal(b.IP) {
+		t.Errorf("expected the same mac to get the same address, got %v and %v", a, b)
+	}
+
+	// requested addresses need no key
+	if a, err = c.ConnectAndGetAddress("10.7.0.40", poolid, ""); err != nil || a.String() != "10.7.0.40/24" {
+		t.Errorf("expected the requested address, got %v %v", a, err)
+	}
+}
+
+// fakeEVPN records the vnis which are advertised
+type fakeEVPN struct {
+	l    sync.Mutex
+	vnis map[int]bool
+}
+
+func (f *fakeEVPN) SyncVNI(vxl *vxlan.Vxlan, local []vxlan.MACIP) error {
+	vni, err := vxl.VNI()
+	if err != nil {
+		return err
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.vnis[vni] = true
+	return nil
+}
+
+func (f *fakeEVPN) WithdrawVNI(vni int) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	delete(f.vnis, vni)
+}
+
+func (f *fakeEVPN) advertised(vni int) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.vnis[vni]
+}
+
+func TestEVPNWithdraw(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+	fe := &fakeEVPN{vnis: make(map[int]bool)}
+	host.SetEVPNAnnouncer(fe)
+	defer host.SetEVPNAnnouncer(nil)
+
+	nr := testNetwork("netev", "ev", "206", "10.10.0.0/24", "10.10.0.1")
+	nr.Options["evpn"] = "true"
+	fd := newFakeDocker(nr)
+	c := NewWithClient(fd, 0, time.Second)
+
+	fd.run("ctr1", true, map[string]string{"netev": "10.10.0.5"})
+	c.Reconcile()
+	if !linkExists("ev") || !fe.advertised(206) {
+		t.Fatalf("expected the vni of a network with a container to be advertised")
+	}
+
+	// the last container leaves, and it's address is released
+	fd.run("ctr1", false, map[string]string{"netev": "10.10.0.5"})
+	if err := c.DeleteRoute(PoolID(LocalAddressSpace, "10.10.0.0/24"), "10.10.0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return !linkExists("ev") }) {
+		t.Fatalf("host interface not deleted after the last address was released")
+	}
+	if fe.advertised(206) {
+		t.Errorf("vni still advertised after the host interface was deleted")
+	}
+
+	// a vxlan deleted behind our back is withdrawn on the next reconcile
+	fd.run("ctr1", true, map[string]string{"netev": "10.10.0.5"})
+	c.Reconcile()
+	if !fe.advertised(206) {
+		t.Fatalf("expected the vni to be advertised again")
+	}
+	if err := kernel.Get().LinkDel(&netlink.Vxlan{LinkAttrs: netlink.LinkAttrs{Name: "ev"}}); err != nil {
+		t.Fatal(err)
+	}
+	c.syncEVPN(&nr)
+	if fe.advertised(206) {
+		t.Errorf("vni still advertised after the vxlan was deleted")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	nr := testNetwork("netow", "ow", "205", "10.9.0.0/24", "10.9.0.1")
+	nr.Containers = map[string]types.EndpointResource{
+		"ctr1": {EndpointID: "ep1aaaaaaaa", IPv4Address: "10.9.0.2/24"},
+		"ctr2": {EndpointID: "ep2bbbbbbbb", IPv4Address: "10.9.0.3/24"},
+		"ctr3": {EndpointID: "ep3cccccccc", IPv4Address: "10.9.0.4/24"},
+	}
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+
+	ctrs, eps := c.Owners("ow", []net.IP{net.ParseIP("10.9.0.2")}, []string{"cmvl_ep3cccc"})
+	if fmt.Sprint(ctrs) != "[ctr1 ctr3]" || fmt.Sprint(eps) != "[ep1aaaaaaaa ep3cccccccc]" {
+		t.Errorf("expected ctr1 by address and ctr3 by macvlan, got %v %v", ctrs, eps)
+	}
+	if ctrs, eps = c.Owners("missing", nil, nil); ctrs != nil || eps != nil {
+		t.Errorf("expected nothing for a missing network, got %v %v", ctrs, eps)
+	}
+}
+
+func TestConnectAndGetAddressExclude(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netex", "ex", "207", "10.11.0.0/24", "10.11.0.1")
+	nr.Options["exclude"] = "10.11.0.2-10.11.0.20,10.11.0.22"
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+	poolid := PoolID(LocalAddressSpace, "10.11.0.0/24")
+
+	// a request inside a reserved range is refused, naming the range
+	_, err := c.ConnectAndGetAddress("10.11.0.15", poolid, "")
+	if err == nil || !strings.Contains(err.Error(), "reserved range 10.11.0.2-10.11.0.20") {
+		t.Errorf("expected the request to be refused for the reserved range, got %v", err)
+	}
+	if _, ok := claimedRoutes(t)["10.11.0.15"]; ok {
+		t.Errorf("claimed a reserved address")
+	}
+
+	// sequential allocation skips both reserved ranges
+	for _, want := range []string{"10.11.0.21/24", "10.11.0.23/24"} {
+		a, err := c.ConnectAndGetAddress("", poolid, "") // nolint: vetshadow
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.String() != want {
+			t.Errorf("expected %v, got %v", want, a)
+		}
+	}
+}
+
+func TestConnectAndGetAddressIPRange(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	for i, strategy := range []string{"sequential", "random"} {
+		subnet := fmt.Sprintf("10.%d.0.0/24", 12+i)
+		_, ipRange, _ := net.ParseCIDR(fmt.Sprintf("10.%d.0.128/28", 12+i))
+		nr := testNetwork("netir"+strategy, "ir"+strategy[:3], fmt.Sprint(208+i), subnet, fmt.Sprintf("10.%d.0.1", 12+i))
+		nr.Options["allocstrategy"] = strategy
+		nr.IPAM.Config[0].IPRange = ipRange.String()
+		c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+		poolid := PoolID(LocalAddressSpace, subnet)
+
+		for j := 0; j < 8; j++ {
+			a, err := c.ConnectAndGetAddress("", poolid, "")
+			if err != nil {
+				t.Fatalf("%v: %v", strategy, err)
+			}
+			if !ipRange.Contains(a.IP) || a.Mask.String() != net.CIDRMask(24, 32).String() {
+				t.Errorf("%v: expected an address of the subnet in %v, got %v", strategy, ipRange, a)
+			}
+			if strategy == "sequential" && j == 0 && !a.IP.Equal(ipRange.IP) {
+				t.Errorf("expected the first address of the range, got %v", a)
+			}
+		}
+
+		// requested addresses may be anywhere in the subnet
+		req := fmt.Sprintf("10.%d.0.5", 12+i)
+		if a, err := c.ConnectAndGetAddress(req, poolid, ""); err != nil || !a.IP.Equal(net.ParseIP(req)) {
+			t.Errorf("%v: expected the requested address outside the range, got %v %v", strategy, a, err)
+		}
+	}
+}
+
+func TestConnectAndGetAddressAux(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	for i, strategy := range []string{"sequential", "random"} {
+		subnet := fmt.Sprintf("10.%d.0.0/29", 15+i)
+		nr := testNetwork("netax"+strategy, "ax"+strategy[:3], fmt.Sprint(210+i), subnet, fmt.Sprintf("10.%d.0.1", 15+i))
+		nr.Options["allocstrategy"] = strategy
+		aux := map[string]string{"router": fmt.Sprintf("10.%d.0.2", 15+i), "dns": fmt.Sprintf("10.%d.0.4", 15+i)}
+		nr.IPAM.Config[0].AuxAddress = aux
+		// random allocation only gives up when the response time is over
+		c := NewWithClient(newFakeDocker(nr), 0, 300*time.Millisecond)
+		poolid := PoolID(LocalAddressSpace, subnet)
+
+		// .1 is the gateway, so only .3, .5 and .6 are handed out
+		got := make(map[string]bool)
+		for {
+			a, err := c.ConnectAndGetAddress("", poolid, "")
+			if err != nil {
+				break
+			}
+			got[a.IP.String()] = true
+		}
+		for _, ip := range aux {
+			if got[ip] {
+				t.Errorf("%v: aux address %v handed out", strategy, ip)
+			}
+		}
+		if len(got) != 3 {
+			t.Errorf("%v: expected the 3 other addresses to be handed out, got %v", strategy, got)
+		}
+
+		if _, err := c.ConnectAndGetAddress(aux["router"], poolid, ""); err == nil {
+			t.Errorf("%v: expected requesting an aux address to fail", strategy)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	_, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netwe", "we", "212", "10.17.0.0/24", "10.17.0.1")
+	nrd := testNetwork("netwd", "wd", "213", "10.18.0.0/24", "10.18.0.1")
+	fd := newFakeDocker(nr, nrd)
+	c := NewWithClient(fd, 0, time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Watch(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	ctrEvent := func(action, id string) {
+		fd.events <- events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: id}}
+	}
+	netEvent := func(action, id string, attrs map[string]string) {
+		fd.events <- events.Message{Type: events.NetworkEventType, Action: action, Actor: events.Actor{ID: id, Attributes: attrs}}
+	}
+	claimed := func(ip string) func() bool {
+		return func() bool {
+			_, ok := claimedRoutes(t)[ip]
+			return ok
+		}
+	}
+
+	// a started container gets it's route
+	fd.run("ctr1", true, map[string]string{"netwe": "10.17.0.5"})
+	ctrEvent("start", "ctr1")
+	if !eventually(claimed("10.17.0.5")) {
+		t.Fatalf("route to 10.17.0.5 not added after the container started")
+	}
+
+	// connects to networks of other drivers are ignored, events are handled in order
+	fd.run("ctr2", true, map[string]string{"netwe": "10.17.0.6"})
+	netEvent("connect", "netwe", map[string]string{"type": "bridge", "container": "ctr2"})
+	netEvent("connect", "netwd", map[string]string{"type": networkDriverName, "container": "ctr1"})
+	if _, ok := claimedRoutes(t)["10.17.0.6"]; ok {
+		t.Errorf("route to 10.17.0.6 added for a connect to another driver's network")
+	}
+	netEvent("connect", "netwe", map[string]string{"type": networkDriverName, "container": "ctr2"})
+	if !eventually(claimed("10.17.0.6")) {
+		t.Errorf("route to 10.17.0.6 not added after the container connected")
+	}
+
+	// a disconnected container's route is released once the network is reconciled
+	fd.run("ctr2", true, nil)
+	netEvent("disconnect", "netwe", map[string]string{"type": networkDriverName, "container": "ctr2"})
+	if !eventually(func() bool { return !claimed("10.17.0.6")() }) {
+		t.Errorf("route to 10.17.0.6 not deleted after the container disconnected")
+	}
+
+	// a stopped container's route is released, and the host interface with it
+	fd.run("ctr1", false, map[string]string{"netwe": "10.17.0.5"})
+	ctrEvent("die", "ctr1")
+	if !eventually(func() bool { return !claimed("10.17.0.5")() && !linkExists("we") && !linkExists("hmvl_we") }) {
+		t.Errorf("route to 10.17.0.5 and host interface not deleted after the container stopped")
+	}
+
+	// a destroyed network takes it's routes and host interface with it, even recently claimed ones
+	if _, err := c.ConnectAndGetAddress("10.18.0.9", PoolID(LocalAddressSpace, "10.18.0.0/24"), ""); err != nil {
+		t.Fatal(err)
+	}
+	netEvent("destroy", "netwd", map[string]string{"type": networkDriverName, "name": "wd"})
+	if !eventually(func() bool { return !claimed("10.18.0.9")() && !linkExists("wd") && !linkExists("hmvl_wd") }) {
+		t.Errorf("route to 10.18.0.9 and host interface not deleted after the network was destroyed")
+	}
+}
+
+func TestHandleConflict(t *testing.T) {
+	k, restore := useFakeKernel()
+	defer restore()
+
+	nr := testNetwork("netcf", "cf", "214", "10.19.0.0/24", "10.19.0.1")
+	c := NewWithClient(newFakeDocker(nr), 0, time.Second)
+	poolid := PoolID(LocalAddressSpace, "10.19.0.0/24")
+
+	// this host reaches the other hosts from 192.0.2.10
+	if err := k.RouteAdd(&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP("192.0.2.0"), Mask: net.CIDRMask(24, 32)}, Src: net.ParseIP("192.0.2.10")}); err != nil {
+		t.Fatal(err)
+	}
+	conflict := func(ip, gw string) *host.Conflict {
+		if _, err := c.ConnectAndGetAddress(ip, poolid, ""); err != nil {
+			t.Fatal(err)
+		}
+		r := netlink.Route{Dst: netlink.NewIPNet(net.ParseIP(ip)), Gw: net.ParseIP(gw), Protocol: 186, Priority: 32}
+		if err := k.RouteAdd(&r); err != nil {
+			t.Fatal(err)
+		}
+		return &host.Conflict{IP: net.ParseIP(ip), Network: "cf", Route: r}
+	}
+	claimed := func(ip string) bool {
+		_, ok := claimedRoutes(t)[ip]
+		return ok
+	}
+
+	// the none policy only reports the conflict
+	hc := conflict("10.19.0.5", "192.0.2.5")
+	c.handleConflict(hc, ConflictPolicyNone)
+	if !claimed("10.19.0.5") {
+		t.Errorf("claim on 10.19.0.5 released with the %v policy", ConflictPolicyNone)
+	}
+	// the other host gives up it's claim
+	if err := k.RouteDel(&hc.Route); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host with the lower underlay address keeps it's claim
+	hc = conflict("10.19.0.6", "192.0.2.20")
+	c.handleConflict(hc, ConflictPolicyAddress)
+	if !claimed("10.19.0.6") {
+		t.Errorf("claim on 10.19.0.6 released by the host with the lower address")
+	}
+
+	// conflicts which resolve themselves are left alone
+	hc = conflict("10.19.0.7", "192.0.2.5")
+	if err := k.RouteDel(&hc.Route); err != nil {
+		t.Fatal(err)
+	}
+	c.handleConflict(hc, ConflictPolicyAddress)
+	if !claimed("10.19.0.7") {
+		t.Errorf("claim on 10.19.0.7 released after the conflict was resolved")
+	}
+
+	// the host with the higher underlay address releases it's claim, as found by watching the routing table
+	// the conflict on 10.19.0.6 is still there, and is kept
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.WatchConflicts(ctx, ConflictPolicyAddress)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	conflict("10.19.0.8", "192.0.2.5")
+	if !eventually(func() bool { return !claimed("10.19.0.8") }) {
+		t.Errorf("claim on 10.19.0.8 not released by the host with the higher address")
+	}
+	for _, ip := range []string{"10.19.0.5", "10.19.0.6", "10.19.0.7"} {
+		if !claimed(ip) {
+			t.Errorf("claim on %v released by watching for conflicts", ip)
+		}
+	}
+}
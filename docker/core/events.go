@@ -0,0 +1,82 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+const eventsRetry = 5 * time.Second
+
+// Watch subscribes to docker container and network events and reconciles the affected
+// addresses and networks as they happen. It blocks until ctx is cancelled.
+func (c *Core) Watch(ctx context.Context) {
+	log := log.WithField("func", "Watch()")
+
+	for {
+		err := c.watch(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		log.WithError(err).Error("docker event stream closed, resubscribing")
+
+		select {
+		case <-time.After(eventsRetry):
+		case <-ctx.Done():
+			return
+		}
+		// events may have been missed while disconnected
+		c.Reconcile()
+	}
+}
+
+func (c *Core) watch(ctx context.Context) error {
+	flts := filters.NewArgs()
+	flts.Add("type", events.ContainerEventType)
+	flts.Add("type", events.NetworkEventType)
+	for _, e := range []string{"start", "die", "connect", "disconnect", "destroy"} {
+		flts.Add("event", e)
+	}
+
+	msgs, errs := c.dc.Events(ctx, types.EventsOptions{Filters: flts})
+	for {
+		select {
+		case m := <-msgs:
+			c.handleEvent(m)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (c *Core) handleEvent(m events.Message) {
+	log := log.WithField("func", "handleEvent()").WithField("type", m.Type).WithField("action", m.Action).WithField("id", m.Actor.ID)
+	log.Debug()
+
+	switch m.Type {
+	case events.ContainerEventType:
+		switch m.Action {
+		case "start", "die":
+			c.reconcileContainer(m.Actor.ID)
+		}
+	case events.NetworkEventType:
+		if m.Actor.Attributes["type"] != networkDriverName {
+			return
+		}
+		switch m.Action {
+		case "connect":
+			c.reconcileContainer(m.Actor.Attributes["container"])
+		case "disconnect":
+			c.reconcileNetwork(m.Actor.ID)
+		case "destroy":
+			c.networkDestroyed(m.Actor.ID, m.Actor.Attributes["name"])
+		}
+	}
+}
@@ -6,24 +6,106 @@ import (
 	"strings"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+var _ = options.Register(
+	options.Option{Name: "hostgateway", Kind: options.Bool, Usage: "add the gateways to the host macvlan, false for networks routed by something else"},
 )
 
-func poolFromNR(nr *types.NetworkResource) (string, error) {
+// ipamConfigsFromNR returns every ipam config with a valid subnet, skipping repeated subnets
+func ipamConfigsFromNR(nr *types.NetworkResource) []network.IPAMConfig {
+	seen := make(map[string]struct{})
+	r := []network.IPAMConfig{}
 	for _, c := range nr.IPAM.Config {
-		if c.Subnet != "" {
-			return c.Subnet, nil
+		_, sn, err := net.ParseCIDR(c.Subnet)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[sn.String()]; ok {
+			continue
 		}
+		seen[sn.String()] = struct{}{}
+		r = append(r, c)
 	}
-	return "", fmt.Errorf("pool not found")
+	return r
 }
 
-func poolFromID(poolid string) string {
-	return strings.TrimPrefix(poolid, ipamDriverName+"/")
+// poolsFromNR returns all the pools of a network resource
+func poolsFromNR(nr *types.NetworkResource) []string {
+	r := []string{}
+	for _, c := range ipamConfigsFromNR(nr) {
+		r = append(r, c.Subnet)
+	}
+	return r
+}
+
+// poolFromAddress returns the pool of a network resource that contains addr
+func poolFromAddress(nr *types.NetworkResource, addr net.IP) (string, error) {
+	for _, p := range poolsFromNR(nr) {
+		_, sn, err := net.ParseCIDR(p)
+		if err != nil {
+			continue
+		}
+		if sn.Contains(addr) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("pool not found for address")
+}
+
+// ipRangeFromNR returns the ip range (docker's --ip-range) of pool in a network resource, or nil if it has none
+func ipRangeFromNR(nr *types.NetworkResource, pool string) (*net.IPNet, error) {
+	for _, c := range ipamConfigsFromNR(nr) {
+		if c.Subnet != pool || c.IPRange == "" {
+			continue
+		}
+		_, r, err := net.ParseCIDR(c.IPRange)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	return nil, nil
+}
+
+// auxAddressesFromNR returns the auxiliary addresses (docker's --aux-address) of a network resource as reserved ranges
+func auxAddressesFromNR(nr *types.NetworkResource) []host.AddrRange {
+	r := []host.AddrRange{}
+	for _, c := range ipamConfigsFromNR(nr) {
+		for _, a := range c.AuxAddress {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				continue
+			}
+			r = append(r, host.AddrRange{Start: ip, End: ip})
+		}
+	}
+	return r
+}
+
+// hostGatewayFromNR returns false if the gateways of a network resource should not be added to the host macvlan
+// internal networks have no gateway, and the hostgateway option disables it for networks routed by something else
+func hostGatewayFromNR(nr *types.NetworkResource) bool {
+	return !nr.Internal && vxrouter.GetEnvBoolWithDefault(envPrefix+"hostgateway", nr.Options["hostgateway"], true)
+}
+
+// PoolFromID returns the pool cidr of an ipam pool id
+func PoolFromID(poolid string) string {
+	s := strings.TrimPrefix(poolid, ipamDriverName+"/")
+	if space := SpaceFromID(poolid); space != "" {
+		s = strings.TrimPrefix(s, space+"/")
+	}
+	return s
 }
 
 // IPNetFromReqInfo returns an an IPNet from an ipam request
 func IPNetFromReqInfo(poolid, reqAddr string) (*net.IPNet, error) {
-	_, n, err := net.ParseCIDR(poolFromID(poolid))
+	_, n, err := net.ParseCIDR(PoolFromID(poolid))
 	if err != nil {
 		return nil, err
 	}
@@ -34,22 +116,26 @@ func IPNetFromReqInfo(poolid, reqAddr string) (*net.IPNet, error) {
 	return n, nil
 }
 
-// GatewayFromNR loops over the IPAMConfig array, combine gw and sn into a cidr
-func GatewayFromNR(nr *types.NetworkResource) (*net.IPNet, error) {
-	for _, ic := range nr.IPAM.Config {
-		gws := ic.Gateway
-		sns := ic.Subnet
-		if gws != "" && sns != "" {
-			gw := net.ParseIP(gws)
-			if gw == nil {
-				err := fmt.Errorf("failed to parse gateway from ipam config")
-				return nil, err
-			}
-			var sn *net.IPNet
-			_, sn, err := net.ParseCIDR(sns)
-			return &net.IPNet{IP: gw, Mask: sn.Mask}, err
+// GatewaysFromNR loops over the IPAMConfig array, combining gw and sn into a cidr for each subnet
+func GatewaysFromNR(nr *types.NetworkResource) ([]*net.IPNet, error) {
+	r := []*net.IPNet{}
+	for _, ic := range ipamConfigsFromNR(nr) {
+		if ic.Gateway == "" {
+			continue
 		}
+		gw := net.ParseIP(ic.Gateway)
+		if gw == nil {
+			return nil, fmt.Errorf("failed to parse gateway from ipam config")
+		}
+		_, sn, err := net.ParseCIDR(ic.Subnet)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, &net.IPNet{IP: gw, Mask: sn.Mask})
 	}
 
-	return nil, fmt.Errorf("no gateway with subnet found in ipam config")
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no gateway with subnet found in ipam config")
+	}
+	return r, nil
 }
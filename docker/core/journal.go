@@ -0,0 +1,468 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/metrics"
+)
+
+const (
+	// claimPending is an address which has (or is about to have) a route, but may not have been handed to docker
+	claimPending = "pending"
+	// claimConfirmed is an address which docker created an endpoint with
+	claimConfirmed = "confirmed"
+)
+
+// compactRecords is the number of records the journal file may grow to before it's compacted,
+// as long as it's also more than twice the number of entries
+const compactRecords = 256
+
+type journalEntry struct {
+	IP       string    `json:"ip"`
+	Table    int       `json:"table,omitempty"`
+	Pool     string    `json:"pool"`
+	Key      string    `json:"key,omitempty"`
+	Endpoint string    `json:"endpoint,omitempty"`
+	State    string    `json:"state"`
+	Time     time.Time `json:"time"`
+}
+
+// journalRecord is a line in the journal file, setting the entry with Key, or removing it if Entry is nil
+type journalRecord struct {
+	Key   string        `json:"key"`
+	Entry *journalEntry `json:"entry,omitempty"`
+}
+
+// journal is an on-disk record of the addresses claimed by this host, keyed by claimKey
+// changes are appended to the file, which is rewritten with only the current entries once it grows
+// pending claims are written before Pending returns, confirmations and removals are batched and written in the background
+type journal struct {
+	path    string
+	l       sync.Mutex
+	entries map[string]*journalEntry
+	f       *os.File
+	// records is the number of records in the file, queued the records not written to it yet
+	records  int
+	queued   []journalRecord
+	flushing bool
+}
+
+// openJournal loads the journal at path, an empty journal is used if the file does not exist yet
+func openJournal(path string) (*journal, error) {
+	j := &journal{
+		path:    path,
+		entries: make(map[string]*journalEntry),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// journals written before records were appended are a single object of all entries
+	if err = json.Unmarshal(b, &j.entries); err != nil {
+		j.entries = make(map[string]*journalEntry)
+		if err = j.replay(b); err != nil {
+			return nil, err
+		}
+	}
+	// journals from before address spaces are keyed by the address alone
+	for k, e := range j.entries {
+		if e.IP == "" {
+			e.IP = k
+		}
+	}
+	// start from a file holding only the current entries
+	if err = j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay applies the records in b to the entries
+func (j *journal) replay(b []byte) error {
+	lines := bytes.Split(b, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r journalRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			// the last record may have been cut short by a crash
+			if i == len(lines)-1 {
+				log.WithError(err).WithField("path", j.path).Warn("ignoring incomplete last journal record")
+				return nil
+			}
+			return fmt.Errorf("failed to parse journal record %v: %v", i+1, err)
+		}
+		if r.Entry == nil {
+			delete(j.entries, r.Key)
+			continue
+		}
+		j.entries[r.Key] = r.Entry
+	}
+	return nil
+}
+
+// claimKey identifies a claim on ip in table, the same address may be claimed in the table of each address space
+func claimKey(ip net.IP, table int) string {
+	if table == host.MainTable {
+		return ip.String()
+	}
+	return fmt.Sprintf("%v@%v", ip, table)
+}
+
+// Pending records a claim on ip in table before it's route is added
+// the record is written to the file before returning, routes don't survive a reboot so it's not synced to disk
+func (j *journal) Pending(ip net.IP, table int, pool *net.IPNet, key string) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	k := claimKey(ip, table)
+	e := &journalEntry{
+		IP:    ip.String(),
+		Table: table,
+		Pool:  pool.String(),
+		Key:   key,
+		State: claimPending,
+		Time:  time.Now(),
+	}
+	// reconcile re-adding a route for a running container keeps the endpoint it was confirmed with
+	if old, ok := j.entries[k]; ok {
+		e.Endpoint = old.Endpoint
+	}
+	j.entries[k] = e
+	j.queue(k)
+	return j.flush()
+}
+
+// Forget removes the claim on ip in table
+func (j *journal) Forget(ip net.IP, table int) {
+	j.forget(claimKey(ip, table))
+}
+
+func (j *journal) forget(k string) {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	if _, ok := j.entries[k]; !ok {
+		return
+	}
+	delete(j.entries, k)
+	j.queue(k)
+	j.flushLater()
+}
+
+// confirm marks the claim with key k as used by endpoint, endpoint may be empty if it is not known
+func (j *journal) confirm(k string, endpoint string) error {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	e, ok := j.entries[k]
+	if !ok {
+		return nil
+	}
+	e.State = claimConfirmed
+	if endpoint != "" {
+		e.Endpoint = endpoint
+	}
+	e.Time = time.Now()
+	j.queue(k)
+	j.flushLater()
+	return nil
+}
+
+// snapshot returns a copy of the journal entries
+func (j *journal) snapshot() map[string]journalEntry {
+	j.l.Lock()
+	defer j.l.Unlock()
+
+	r := make(map[string]journalEntry, len(j.entries))
+	for k, e := range j.entries {
+		r[k] = *e
+	}
+	return r
+}
+
+// queue adds a record of the current state of the entry with key k, j.l must be held
+func (j *journal) queue(k string) {
+	r := journalRecord{Key: k}
+	if e, ok := j.entries[k]; ok {
+		ec := *e
+		r.Entry = &ec
+	}
+	j.queued = append(j.queued, r)
+}
+
+// flushLater writes the queued records in the background, along with any others queued until then, j.l must be held
+func (j *journal) flushLater() {
+	if j.flushing {
+		return
+	}
+	j.flushing = true
+	go func() {
+		j.l.Lock()
+		defer j.l.Unlock()
+		j.flushing = false
+		if err := j.flush(); err != nil {
+			log.WithError(err).WithField("path", j.path).Error("failed to write journal")
+		}
+	}()
+}
+
+// flush appends the queued records to the file, compacting it if it has grown too large, j.l must be held
+func (j *journal) flush() error {
+	if len(j.queued) == 0 {
+		return nil
+	}
+	if j.records+len(j.queued) > compactRecords && j.records+len(j.queued) > 2*len(j.entries) {
+		return j.compact()
+	}
+
+	var buf bytes.Buffer
+	for _, r := range j.queued {
+		b, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	if j.f == nil {
+		if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		j.f = f
+	}
+	if _, err := j.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	j.records += len(j.queued)
+	j.queued = nil
+	return nil
+}
+
+// compact writes the current entries to a temporary file and renames it over the old one, j.l must be held
+func (j *journal) compact() error {
+	var buf bytes.Buffer
+	for k, e := range j.entries {
+		b, err := json.Marshal(journalRecord{Key: k, Entry: e})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	// further records are appended to the new file
+	if j.f != nil {
+		j.f.Close() // nolint: errcheck
+		j.f = nil
+	}
+	j.records = len(j.entries)
+	j.queued = nil
+	return nil
+}
+
+// OpenJournal loads the claim journal at path and records all further claims in it
+func (c *Core) OpenJournal(path string) error {
+	j, err := openJournal(path)
+	if err != nil {
+		return err
+	}
+	c.journal = j
+	host.SetJournal(j)
+	return nil
+}
+
+// ConfirmAddress records that endpoint was created on network netid with addr, addr may be an address or a cidr
+func (c *Core) ConfirmAddress(netid, addr, endpoint string) error {
+	if c.journal == nil || addr == "" {
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(addr)
+	if err != nil {
+		ip = net.ParseIP(addr)
+	}
+	if ip == nil {
+		return nil
+	}
+	nr, err := c.getNetworkResourceByID(netid)
+	if err != nil {
+		return err
+	}
+	table, err := c.tableFromNR(nr)
+	if err != nil {
+		return err
+	}
+	return c.journal.confirm(claimKey(ip, table), endpoint)
+}
+
+// EndpointAddresses returns the addresses claimed in the journal for endpoint on network netid, and the mac address
+// requested when they were claimed, or nil if none was. It returns no addresses if the journal is disabled.
+func (c *Core) EndpointAddresses(netid, endpoint string) ([]net.IP, net.HardwareAddr, error) {
+	if c.journal == nil || endpoint == "" {
+		return nil, nil, nil
+	}
+	nr, err := c.getNetworkResourceByID(netid)
+	if err != nil {
+		return nil, nil, err
+	}
+	table, err := c.tableFromNR(nr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var addrs []net.IP
+	var mac net.HardwareAddr
+	for _, e := range c.journal.snapshot() {
+		if e.Endpoint != endpoint || e.Table != table {
+			continue
+		}
+		ip := net.ParseIP(e.IP)
+		if ip == nil {
+			continue
+		}
+		addrs = append(addrs, ip)
+		// the key is the mac address docker passed to ipam, if there was one
+		if m, perr := net.ParseMAC(e.Key); perr == nil {
+			mac = m
+		}
+	}
+	// the order of the journal is random, keep ipv4 addresses first
+	sort.SliceStable(addrs, func(i, j int) bool { return addrs[i].To4() != nil && addrs[j].To4() == nil })
+	return addrs, mac, nil
+}
+
+// Recover replays the journal. Pending claims which are not used by a running container were interrupted before docker
+// got the address and are rolled back, claims which no longer have a route or a container are dropped.
+// It is intended to run once at startup, before the drivers are served.
+func (c *Core) Recover() error {
+	log := log.WithField("func", "Recover()")
+	if c.journal == nil {
+		return nil
+	}
+
+	c.reconcileL.Lock()
+	defer c.reconcileL.Unlock()
+
+	byNet, err := c.getContainerIPsByNetwork(filters.NewArgs())
+	if err != nil {
+		return err
+	}
+	running := make(map[string]struct{})
+	for netid, es := range byNet {
+		var nr *types.NetworkResource
+		nr, err = c.getNetworkResourceByID(netid)
+		if err != nil {
+			continue
+		}
+		var table int
+		table, err = c.tableFromNR(nr)
+		if err != nil {
+			continue
+		}
+		for ip := range es {
+			running[claimKey(net.ParseIP(ip), table)] = struct{}{}
+		}
+	}
+
+	orphanedInts := make(map[string]*host.Interface)
+	for k, e := range c.journal.snapshot() {
+		log := log.WithField("ip", e.IP).WithField("table", e.Table).WithField("pool", e.Pool).WithField("state", e.State)
+		ip := net.ParseIP(e.IP)
+		if ip == nil || claimKey(ip, e.Table) != k {
+			log.Warn("dropping unparseable journal entry")
+			c.journal.forget(k)
+			continue
+		}
+
+		if _, ok := running[k]; ok {
+			if e.State == claimPending {
+				log.Debug("confirming pending claim used by a running container")
+				if err = c.journal.confirm(k, ""); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		var numRoutes int
+		numRoutes, err = host.VxroutesTo(ip, e.Table)
+		if err != nil {
+			return err
+		}
+		if numRoutes == 0 {
+			log.Debug("dropping claim without a route")
+			c.journal.forget(k)
+			continue
+		}
+
+		// confirmed claims without a running container are left for reconcile
+		if e.State != claimPending {
+			continue
+		}
+
+		log.Info("rolling back interrupted claim")
+		var hi *host.Interface
+		hi, err = c.deleteRoute(ip, e.Table)
+		if err != nil {
+			log.WithError(err).Error("failed to roll back claim")
+			continue
+		}
+		metrics.JournalRollbacks.Inc()
+		orphanedInts[hi.Name()] = hi
+	}
+
+	for _, hi := range orphanedInts {
+		if err = hi.Delete(); err != nil {
+			log.WithError(err).Error("error while deleting host interface")
+		}
+	}
+	return nil
+}
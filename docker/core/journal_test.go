@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempJournal(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "journal.json"), func() { os.RemoveAll(dir) } // nolint: errcheck
+}
+
+// written waits for the records queued in j to be written
+func written(j *journal) bool {
+	return eventually(func() bool {
+		j.l.Lock()
+		defer j.l.Unlock()
+		return len(j.queued) == 0
+	})
+}
+
+func fileRecords(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestJournalReplay(t *testing.T) {
+	path, cleanup := tempJournal(t)
+	defer cleanup()
+
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &net.IPNet{IP: net.ParseIP("10.8.0.0"), Mask: net.CIDRMask(24, 32)}
+	for _, a := range []string{"10.8.0.2", "10.8.0.3", "10.8.0.4"} {
+		if err = j.Pending(net.ParseIP(a), 0, pool, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// pending claims are on disk before Pending returns
+	if n := fileRecords(t, path); n != 3 {
+		t.Fatalf("expected 3 records, got %v", n)
+	}
+	if err = j.confirm("10.8.0.2", "ep2"); err != nil {
+		t.Fatal(err)
+	}
+	j.forget("10.8.0.3")
+	if !written(j) {
+		t.Fatalf("queued records not written")
+	}
+
+	j2, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := j2.snapshot()
+	if len(es) != 2 {
+		t.Fatalf("expected 2 entries, got %v", es)
+	}
+	if e := es["10.8.0.2"]; e.State != claimConfirmed || e.Endpoint != "ep2" || e.Pool != "10.8.0.0/24" {
+		t.Errorf("expected 10.8.0.2 to be confirmed for ep2, got %+v", e)
+	}
+	if e := es["10.8.0.4"]; e.State != claimPending {
+		t.Errorf("expected 10.8.0.4 to be pending, got %+v", e)
+	}
+	// opening compacts the file
+	if n := fileRecords(t, path); n != 2 {
+		t.Errorf("expected the reopened journal to hold 2 records, got %v", n)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path, cleanup := tempJournal(t)
+	defer cleanup()
+
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &net.IPNet{IP: net.ParseIP("10.8.0.0"), Mask: net.CIDRMask(24, 32)}
+	for i := 0; i < compactRecords; i++ {
+		if err = j.Pending(net.ParseIP("10.8.0.9"), 0, pool, ""); err != nil {
+			t.Fatal(err)
+		}
+		j.forget("10.8.0.9")
+	}
+	if err = j.Pending(net.ParseIP("10.8.0.10"), 0, pool, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !written(j) {
+		t.Fatalf("queued records not written")
+	}
+	if n := fileRecords(t, path); n > compactRecords {
+		t.Errorf("expected the journal to be compacted, got %v records", n)
+	}
+
+	j2, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es := j2.snapshot(); len(es) != 1 || es["10.8.0.10"].IP != "10.8.0.10" {
+		t.Errorf("expected only 10.8.0.10 after compaction, got %v", es)
+	}
+}
+
+func TestJournalOldFormat(t *testing.T) {
+	path, cleanup := tempJournal(t)
+	defer cleanup()
+
+	old := `{"10.8.0.2":{"pool":"10.8.0.0/24","state":"confirmed","time":"2020-01-02T03:04:05Z"},` +
+		`"10.8.0.3@10":{"ip":"10.8.0.3","table":10,"pool":"10.8.0.0/24","state":"pending","time":"2020-01-02T03:04:05Z"}}`
+	if err := ioutil.WriteFile(path, []byte(old), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := j.snapshot()
+	if len(es) != 2 || es["10.8.0.2"].IP != "10.8.0.2" || es["10.8.0.3@10"].Table != 10 {
+		t.Fatalf("expected both entries of the old journal, got %v", es)
+	}
+	if !es["10.8.0.2"].Time.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("expected the entry's time to be kept, got %v", es["10.8.0.2"].Time)
+	}
+	if n := fileRecords(t, path); n != 2 {
+		t.Errorf("expected the old journal to be rewritten as 2 records, got %v", n)
+	}
+}
+
+func TestJournalIncompleteRecord(t *testing.T) {
+	path, cleanup := tempJournal(t)
+	defer cleanup()
+
+	recs := `{"key":"10.8.0.2","entry":{"ip":"10.8.0.2","pool":"10.8.0.0/24","state":"pending","time":"2020-01-02T03:04:05Z"}}` + "\n" +
+		`{"key":"10.8.0.3","entry":{"ip":"10.8.0.3","po`
+	if err := ioutil.WriteFile(path, []byte(recs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if es := j.snapshot(); len(es) != 1 || es["10.8.0.2"].State != claimPending {
+		t.Errorf("expected only the complete record, got %v", es)
+	}
+}
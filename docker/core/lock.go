@@ -22,20 +22,18 @@ func nrCacheLoop(getNr <-chan *getNr, delNr <-chan string, putNr <-chan *types.N
 				break
 			}
 			delete(nrCache, nr.ID)
-			pool, err := poolFromNR(nr)
-			if err != nil {
-				log.Debug("failed to get pool from network resource, not deleting")
-				break
+			for _, pool := range poolsFromNR(nr) {
+				delete(nrCache, poolKey(spaceFromNR(nr), pool))
 			}
-			delete(nrCache, pool)
 		case nr := <-putNr:
 			nrCache[nr.ID] = nr
-			pool, err := poolFromNR(nr)
-			if err != nil {
+			pools := poolsFromNR(nr)
+			if len(pools) == 0 {
 				log.Debug("failed to get pool from network resource, not caching")
-				break
 			}
-			nrCache[pool] = nr
+			for _, pool := range pools {
+				nrCache[poolKey(spaceFromNR(nr), pool)] = nr
+			}
 		}
 	}
 }
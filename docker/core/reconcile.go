@@ -6,82 +6,325 @@ import (
 	"context"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/metrics"
+	"github.com/TrilliumIT/vxrouter/vxlan"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/network"
 )
 
-// Reconcile adds missing routes and deletes orphaned routes
+// claimGracePeriod protects newly claimed addresses from being deleted as orphans
+// it covers the time between ipam handing an address to docker and the container showing up as running
+const claimGracePeriod = 30 * time.Second
+
+// Reconcile adds missing routes and deletes orphaned routes on all networks
 func (c *Core) Reconcile() {
 	log := log.WithField("func", "Reconcile()")
 
-	// This is possibly racy, if a container starts up after containers are listed
-	// I might delete it's routes
-	// To compensate for this, I compare es before and after the run, if it's changed, run again immediately
-	es, err := c.getContainerIPsAndSubnets()
+	c.reconcileL.Lock()
+	defer c.reconcileL.Unlock()
+	start := time.Now()
+	defer func() { metrics.ReconcileDuration.Observe(time.Since(start).Seconds()) }()
+
+	byNet, err := c.getContainerIPsByNetwork(filters.NewArgs())
 	if err != nil {
 		log.WithError(err).Error("Error getting container IPs")
 		return
 	}
 
-	// Make sure all containers are connected
-	for ip, subnet := range es {
-		var connected bool
-		connected, err = c.connectIfNotConnected(ip, subnet)
+	// networks are reconciled one at a time, since the same address may be used in different address spaces
+	for _, es := range byNet {
+		c.addMissingRoutes(es)
+	}
+
+	flts := filters.NewArgs()
+	flts.Add("driver", networkDriverName)
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	nl, err := c.dc.NetworkList(ctx, types.NetworkListOptions{Filters: flts})
+	if err != nil {
+		log.WithError(err).Error("Error listing networks")
+		return
+	}
+
+	// routes in the main table are checked all at once, so routes left behind by deleted networks are cleaned up too
+	// networks in address spaces with their own table are checked on their own
+	mainEs := make(map[string]string)
+	for i := range nl {
+		nr := &nl[i]
+		c.syncPeers(nr)
+		c.syncEVPN(nr)
+
+		var table int
+		table, err = c.tableFromNR(nr)
 		if err != nil {
-			log.WithError(err).Error("Error connecting container")
+			log.WithError(err).WithField("network", nr.Name).Error("Error getting routing table")
+			continue
 		}
-		if connected {
-			log.WithField("ip", ip).Debug("added missing route")
+		if table == host.MainTable {
+			for ip, id := range byNet[nr.ID] {
+				mainEs[ip] = id
+			}
+			continue
 		}
+		c.deleteOrphanedNetworkRoutes(nr, byNet[nr.ID])
 	}
 
-	// remove errant routes
 	nets, err := host.AllVxRoutes()
 	if err != nil {
 		log.WithError(err).Error("Error getting routes")
 		return
 	}
 
-	orphanedInts := make(map[string]*host.Interface)
-	for _, n := range nets {
-		if _, ok := es[n.IP.String()]; ok {
+	c.deleteOrphanedRoutes(nets, mainEs, host.MainTable)
+}
+
+// reconcileNetwork adds missing routes and deletes orphaned routes on a single network
+func (c *Core) reconcileNetwork(netid string) {
+	log := log.WithField("func", "reconcileNetwork()").WithField("netid", netid)
+	log.Debug()
+
+	c.reconcileL.Lock()
+	defer c.reconcileL.Unlock()
+
+	nr, err := c.getNetworkResourceByID(netid)
+	if err != nil {
+		log.WithError(err).Error("failed to get network resource")
+		return
+	}
+	if !isVxrNet(nr) {
+		return
+	}
+
+	flts := filters.NewArgs()
+	flts.Add("network", netid)
+	byNet, err := c.getContainerIPsByNetwork(flts)
+	if err != nil {
+		log.WithError(err).Error("Error getting container IPs")
+		return
+	}
+	es := byNet[netid]
+
+	c.syncPeers(nr)
+	c.addMissingRoutes(es)
+	c.deleteOrphanedNetworkRoutes(nr, es)
+	c.syncEVPN(nr)
+}
+
+// syncPeers keeps the vxlan's flood entries in line with the network's peers, if it has a host interface
+func (c *Core) syncPeers(nr *types.NetworkResource) {
+	hi, err := host.GetInterface(nr.Name)
+	if err != nil {
+		return
+	}
+	if err = hi.SyncPeers(nr.Options); err != nil {
+		log.WithError(err).WithField("network", nr.Name).Error("Error syncing vxlan peers")
+	}
+}
+
+// syncEVPN advertises the mac addresses of the containers on an evpn network, or withdraws them if it has no host interface
+func (c *Core) syncEVPN(nr *types.NetworkResource) {
+	if !vxlan.EVPN(nr.Options) {
+		return
+	}
+	log := log.WithField("func", "syncEVPN()").WithField("network", nr.Name)
+
+	hi, err := host.GetInterface(nr.Name)
+	if err != nil {
+		// the vxlan is gone, so nothing may be advertised or programmed for it
+		host.WithdrawNetworkEVPN(nr.Options)
+		return
+	}
+
+	flts := filters.NewArgs()
+	flts.Add("network", nr.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	ctrs, err := c.dc.ContainerList(ctx, types.ContainerListOptions{Filters: flts})
+	if err != nil {
+		log.WithError(err).Error("Error listing containers")
+		return
+	}
+
+	seen := make(map[string]struct{})
+	local := []vxlan.MACIP{}
+	for _, ctr := range ctrs {
+		if ctr.NetworkSettings == nil {
 			continue
 		}
-		// This MUST only delete the route, not call hi.Delete(), because if the race condition triggered
-		// and another container started up, and I just deleted it's route, hi.Delete() will delete the vxlan
-		// interface that is the master of the slave container interface. There will be no way to recover except by
-		// restarting the container.
-		// Store the deleted routes so we can call hi.delete() on them only if es hasn't changed at the end of this function.
-		log.WithField("IP", n.IP.String()).Debug("Deleting orphaned Route")
-		var hi *host.Interface
-		hi, err = c.deleteRoute(n.IP)
+		es, ok := ctr.NetworkSettings.Networks[nr.Name]
+		if !ok || es.NetworkID != nr.ID {
+			continue
+		}
+		mac, err := net.ParseMAC(es.MacAddress) // nolint: vetshadow
 		if err != nil {
-			log.WithError(err).Error("error deleting orphaned route")
 			continue
 		}
-		orphanedInts[hi.Name()] = hi
+		local = append(local, vxlan.MACIP{MAC: mac})
+		for _, ip := range endpointIPs(es) {
+			if _, ok := seen[ip.String()]; ok {
+				continue
+			}
+			seen[ip.String()] = struct{}{}
+			local = append(local, vxlan.MACIP{MAC: mac, IP: ip})
+		}
+	}
+
+	if err = hi.SyncEVPN(nr.Options, local); err != nil {
+		log.WithError(err).Error("Error syncing evpn")
+	}
+}
+
+// deleteOrphanedNetworkRoutes deletes the orphaned routes on the host interface of a network, c.reconcileL must be held
+func (c *Core) deleteOrphanedNetworkRoutes(nr *types.NetworkResource, es map[string]string) {
+	log := log.WithField("func", "deleteOrphanedNetworkRoutes()").WithField("network", nr.Name)
+
+	hi, err := host.GetInterface(nr.Name)
+	if err != nil {
+		// no host interface, so no routes to clean up
+		return
+	}
+	nets, err := hi.Routes()
+	if err != nil {
+		log.WithError(err).Error("Error getting routes")
+		return
 	}
 
-	es2, err := c.getContainerIPsAndSubnets()
+	c.deleteOrphanedRoutes(nets, es, hi.Table())
+}
+
+// reconcileContainer adds missing routes for a running container, or reconciles the networks of a stopped container
+func (c *Core) reconcileContainer(id string) {
+	log := log.WithField("func", "reconcileContainer()").WithField("container", id)
+	log.Debug()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	ctr, err := c.dc.ContainerInspect(ctx, id)
 	if err != nil {
-		log.WithError(err).Error("Error getting final container IPs")
+		log.WithError(err).Debug("failed to inspect container")
+		return
+	}
+	if ctr.NetworkSettings == nil {
 		return
 	}
 
-	if !ipListsEqual(es, es2) {
-		// Container IPs changed while running reconcile, we better run it again
-		c.Reconcile()
+	if ctr.State == nil || !ctr.State.Running {
+		for _, es := range ctr.NetworkSettings.Networks {
+			c.reconcileNetwork(es.NetworkID)
+		}
 		return
 	}
 
-	// nothing changed, we can call hi.delete on all the orphaned routes
+	byNet := make(map[string]map[string]string)
+	for _, es := range ctr.NetworkSettings.Networks {
+		ips := make(map[string]string)
+		for _, ip := range endpointIPs(es) {
+			ips[ip.String()] = es.NetworkID
+		}
+		byNet[es.NetworkID] = ips
+	}
+
+	c.reconcileL.Lock()
+	defer c.reconcileL.Unlock()
+	for _, ips := range byNet {
+		c.addMissingRoutes(ips)
+		// the container is visible now, reconcile no longer needs to protect its addresses
+		// including those claimed just now by adding the missing routes
+		for ip := range ips {
+			c.forgetClaim(net.ParseIP(ip))
+		}
+	}
+	for _, es := range ctr.NetworkSettings.Networks {
+		nr, err := c.getNetworkResourceByID(es.NetworkID) // nolint: vetshadow
+		if err != nil || !isVxrNet(nr) {
+			continue
+		}
+		c.syncEVPN(nr)
+	}
+}
+
+// networkDestroyed removes all routes and the host interface of a deleted network
+func (c *Core) networkDestroyed(netid, name string) {
+	log := log.WithField("func", "networkDestroyed()").WithField("netid", netid).WithField("name", name)
+	log.Debug()
+
+	c.delNrInCache(netid)
+
+	c.reconcileL.Lock()
+	defer c.reconcileL.Unlock()
+
+	hi, err := host.GetInterface(name)
+	if err != nil {
+		return
+	}
+	nets, err := hi.Routes()
+	if err != nil {
+		log.WithError(err).Error("Error getting routes")
+		return
+	}
+	for _, n := range nets {
+		if err = hi.DelRoute(n.IP); err != nil {
+			log.WithError(err).WithField("IP", n.IP.String()).Error("error deleting route")
+			continue
+		}
+		metrics.ReconcileRoutesDeleted.Inc()
+	}
+	if err = hi.Delete(); err != nil {
+		log.WithError(err).Error("error while deleting host interface")
+	}
+}
+
+// addMissingRoutes makes sure all containers are connected, c.reconcileL must be held
+// es maps addresses to network ids, and should only hold the addresses of one address space
+func (c *Core) addMissingRoutes(es map[string]string) {
+	for ip, subnet := range es {
+		connected, err := c.connectIfNotConnected(ip, subnet)
+		if err != nil {
+			log.WithError(err).Error("Error connecting container")
+			continue
+		}
+		if connected {
+			log.WithField("ip", ip).Debug("added missing route")
+			metrics.ReconcileRoutesAdded.Inc()
+		}
+	}
+}
+
+// deleteOrphanedRoutes deletes routes in table which are neither used by a container in es nor recently claimed
+// then attempts to delete the host interfaces they were on, c.reconcileL must be held
+func (c *Core) deleteOrphanedRoutes(nets []*net.IPNet, es map[string]string, table int) {
+	orphanedInts := make(map[string]*host.Interface)
+	for _, n := range nets {
+		if _, ok := es[n.IP.String()]; ok {
+			continue
+		}
+		// A container which is still starting up has it's address claimed, but is not yet listed with that address.
+		// Deleting that route (and then the host interface) would leave the container unreachable,
+		// so recently claimed addresses are left alone until the grace period is over.
+		if c.recentlyClaimed(n.IP) {
+			log.WithField("IP", n.IP.String()).Debug("Not deleting recently claimed route")
+			continue
+		}
+		log.WithField("IP", n.IP.String()).Debug("Deleting orphaned Route")
+		hi, err := c.deleteRoute(n.IP, table)
+		if err != nil {
+			log.WithError(err).Error("error deleting orphaned route")
+			continue
+		}
+		metrics.ReconcileRoutesDeleted.Inc()
+		orphanedInts[hi.Name()] = hi
+	}
+
 	hiDelWg := sync.WaitGroup{}
 	for _, hi := range orphanedInts {
 		hiDelWg.Add(1)
 		go func(hi *host.Interface) {
 			defer hiDelWg.Done()
-			if err = hi.Delete(); err != nil {
+			if err := hi.Delete(); err != nil {
 				log.WithError(err).Error("error while deleting host interface")
 			}
 		}(hi)
@@ -90,45 +333,71 @@ func (c *Core) Reconcile() {
 	hiDelWg.Wait()
 }
 
-func ipListsEqual(m map[string]string, m2 map[string]string) bool {
-	if len(m) != len(m2) {
-		return false
-	}
+func (c *Core) markClaimed(ip net.IP) {
+	c.claimsL.Lock()
+	defer c.claimsL.Unlock()
+	c.claims[ip.String()] = time.Now()
+}
+
+func (c *Core) forgetClaim(ip net.IP) {
+	c.claimsL.Lock()
+	defer c.claimsL.Unlock()
+	delete(c.claims, ip.String())
+}
+
+func (c *Core) recentlyClaimed(ip net.IP) bool {
+	c.claimsL.Lock()
+	defer c.claimsL.Unlock()
 
-	for k := range m {
-		if m[k] != m2[k] {
-			return false
+	for k, t := range c.claims {
+		if time.Since(t) > claimGracePeriod {
+			delete(c.claims, k)
 		}
 	}
+	_, ok := c.claims[ip.String()]
+	return ok
+}
 
-	return true
+// endpointIPs returns the ipv4 and ipv6 addresses of a container endpoint
+func endpointIPs(es *network.EndpointSettings) []net.IP {
+	r := []net.IP{}
+	// This is necessary because docker is stupid, this could be
+	// "10.1.141.01" for example
+	addrs := []string{es.IPAddress, es.GlobalIPv6Address}
+	if es.IPAMConfig != nil {
+		addrs = append(addrs, es.IPAMConfig.IPv4Address, es.IPAMConfig.IPv6Address)
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip != nil {
+			r = append(r, ip)
+		}
+	}
+	return r
 }
 
-func (c *Core) getContainerIPsAndSubnets() (map[string]string, error) {
+// getContainerIPsByNetwork returns the addresses of running containers, grouped by network id
+// each group maps the addresses to the network id, as addMissingRoutes takes them
+func (c *Core) getContainerIPsByNetwork(flts filters.Args) (map[string]map[string]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
 	defer cancel()
 
-	ctrs, err := c.dc.ContainerList(ctx, types.ContainerListOptions{})
+	ctrs, err := c.dc.ContainerList(ctx, types.ContainerListOptions{Filters: flts})
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make(map[string]string)
+	ret := make(map[string]map[string]string)
 	for _, ctr := range ctrs {
+		if ctr.NetworkSettings == nil {
+			continue
+		}
 		for _, es := range ctr.NetworkSettings.Networks {
-			// This is necessary because docker is stupid, this could be
-			// "10.1.141.01" for example
-			ip := net.ParseIP(es.IPAddress)
-			if ip != nil {
-				ret[ip.String()] = es.NetworkID
-			}
-
-			if es.IPAMConfig == nil {
-				continue
+			if ret[es.NetworkID] == nil {
+				ret[es.NetworkID] = make(map[string]string)
 			}
-			ip = net.ParseIP(es.IPAMConfig.IPv4Address)
-			if ip != nil {
-				ret[ip.String()] = es.NetworkID
+			for _, ip := range endpointIPs(es) {
+				ret[es.NetworkID][ip.String()] = es.NetworkID
 			}
 		}
 	}
@@ -0,0 +1,131 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/TrilliumIT/vxrouter/host"
+)
+
+const (
+	// LocalAddressSpace is the default address space of local scoped networks
+	LocalAddressSpace = "local"
+	// GlobalAddressSpace is the default address space of global scoped networks
+	GlobalAddressSpace = "global"
+
+	// addressSpaceOption is the ipam option selecting a named address space
+	addressSpaceOption = "addressspace"
+)
+
+// ParseAddressSpaces parses a list of name=table address spaces
+func ParseAddressSpaces(ss []string) (map[string]int, error) {
+	r := make(map[string]int)
+	for _, s := range ss {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid address space %q, must be name=table", s)
+		}
+		if isDefaultSpace(kv[0]) || strings.Contains(kv[0], "/") {
+			return nil, fmt.Errorf("invalid address space name %q", kv[0])
+		}
+		t, err := strconv.Atoi(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid table for address space %q: %v", kv[0], err)
+		}
+		// 0 is unspec, 253-255 are the default, main and local tables
+		if t <= 0 || (t >= 253 && t <= 255) {
+			return nil, fmt.Errorf("table %v for address space %q is reserved", t, kv[0])
+		}
+		r[kv[0]] = t
+	}
+	return r, nil
+}
+
+// SetAddressSpaces sets the named address spaces and the routing tables their routes are claimed in
+// the local and global address spaces always claim routes in the main table
+func (c *Core) SetAddressSpaces(spaces map[string]int) {
+	c.spacesL.Lock()
+	defer c.spacesL.Unlock()
+	c.spaces = spaces
+}
+
+// ValidAddressSpace returns an error if space is not the local or global space, or a configured named space
+func (c *Core) ValidAddressSpace(space string) error {
+	_, err := c.spaceTable(space)
+	return err
+}
+
+// spaceTable returns the routing table of an address space
+func (c *Core) spaceTable(space string) (int, error) {
+	if isDefaultSpace(space) {
+		return host.MainTable, nil
+	}
+	c.spacesL.RLock()
+	defer c.spacesL.RUnlock()
+	t, ok := c.spaces[space]
+	if !ok {
+		return 0, fmt.Errorf("unknown address space %q", space)
+	}
+	return t, nil
+}
+
+// tableFromNR returns the routing table of the address space of a network resource
+func (c *Core) tableFromNR(nr *types.NetworkResource) (int, error) {
+	return c.spaceTable(spaceFromNR(nr))
+}
+
+func isDefaultSpace(space string) bool {
+	return space == "" || space == LocalAddressSpace || space == GlobalAddressSpace
+}
+
+// spaceFromNR returns the named address space of a network resource, or an empty string for the default spaces
+// docker does not report the address space of a network, so named spaces are selected with an ipam option
+func spaceFromNR(nr *types.NetworkResource) string {
+	return nr.IPAM.Options[addressSpaceOption]
+}
+
+// SpaceFromOptions returns the address space for a pool request, the addressspace ipam option overrides docker's space
+func SpaceFromOptions(space string, opts map[string]string) string {
+	if s := opts[addressSpaceOption]; s != "" {
+		return s
+	}
+	if space == "" {
+		return LocalAddressSpace
+	}
+	return space
+}
+
+// SameAddressSpace returns true if a and b are the same address space, the local and global spaces are considered the same
+func SameAddressSpace(a, b string) bool {
+	if isDefaultSpace(a) {
+		return isDefaultSpace(b)
+	}
+	return a == b
+}
+
+// poolKey returns the key of a pool in an address space, pools in the default spaces are keyed by the pool alone
+// since they share the main table
+func poolKey(space, pool string) string {
+	if isDefaultSpace(space) {
+		return pool
+	}
+	return space + "/" + pool
+}
+
+// PoolID returns the ipam pool id of pool in space
+func PoolID(space, pool string) string {
+	return ipamDriverName + "/" + space + "/" + pool
+}
+
+// SpaceFromID returns the address space of an ipam pool id
+func SpaceFromID(poolid string) string {
+	s := strings.TrimPrefix(poolid, ipamDriverName+"/")
+	// pool ids from before address spaces are just the pool, which has one slash
+	if strings.Count(s, "/") < 2 {
+		return ""
+	}
+	return s[:strings.Index(s, "/")]
+}
@@ -0,0 +1,227 @@
+package core
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"context"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Status is the state of all vxrnet networks on this host
+type Status struct {
+	Networks []*NetworkStatus `json:"networks"`
+	// OrphanRoutes are vxrnet routes which are not via the host interface of any network
+	OrphanRoutes []string `json:"orphan_routes"`
+}
+
+// NetworkStatus is the state of a vxrnet network on this host
+type NetworkStatus struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	VNI         int      `json:"vni"`
+	Vxlan       string   `json:"vxlan,omitempty"`
+	HostMacvlan string   `json:"host_macvlan,omitempty"`
+	VtepDev     string   `json:"vtep_dev,omitempty"`
+	SrcAddr     string   `json:"src_addr,omitempty"`
+	Gateways    []string `json:"gateways"`
+	// Claimed maps addresses claimed by this host to the name of the container using them
+	Claimed map[string]string `json:"claimed"`
+	// OrphanRoutes are claimed addresses without a container
+	OrphanRoutes []string `json:"orphan_routes"`
+	// OrphanMacvlans are container macvlans in the host namespace without an endpoint
+	OrphanMacvlans []string `json:"orphan_macvlans"`
+	// OptionsChanged is true if the vxlan's attributes differ from the network's options
+	// they are applied once the containers using the network on this host are restarted
+	OptionsChanged bool `json:"options_changed,omitempty"`
+}
+
+// Status returns the state of all vxrnet networks on this host
+func (c *Core) Status() (*Status, error) {
+	log := log.WithField("func", "Status()")
+	log.Debug()
+
+	flts := filters.NewArgs()
+	flts.Add("driver", networkDriverName)
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	nl, err := c.dc.NetworkList(ctx, types.NetworkListOptions{Filters: flts})
+	if err != nil {
+		log.WithError(err).Error("failed to list networks")
+		return nil, err
+	}
+
+	st := &Status{Networks: []*NetworkStatus{}, OrphanRoutes: []string{}}
+	seen := make(map[string]struct{})
+	for _, n := range nl {
+		// inspect directly rather than from cache, the containers are needed
+		var nr types.NetworkResource
+		nr, err = c.dc.NetworkInspect(ctx, n.ID)
+		if err != nil {
+			log.WithError(err).WithField("network", n.Name).Error("failed to inspect network")
+			return nil, err
+		}
+		var ns *NetworkStatus
+		ns, err = networkStatus(&nr)
+		if err != nil {
+			log.WithError(err).WithField("network", n.Name).Error("failed to get network status")
+			return nil, err
+		}
+		for ip := range ns.Claimed {
+			seen[ip] = struct{}{}
+		}
+		for _, ip := range ns.OrphanRoutes {
+			seen[ip] = struct{}{}
+		}
+		st.Networks = append(st.Networks, ns)
+	}
+	sort.Slice(st.Networks, func(i, j int) bool { return st.Networks[i].Name < st.Networks[j].Name })
+
+	routes, err := host.AllVxRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if _, ok := seen[r.IP.String()]; !ok {
+			st.OrphanRoutes = append(st.OrphanRoutes, r.IP.String())
+		}
+	}
+
+	return st, nil
+}
+
+func networkStatus(nr *types.NetworkResource) (*NetworkStatus, error) {
+	ns := &NetworkStatus{
+		ID:             nr.ID,
+		Name:           nr.Name,
+		Gateways:       []string{},
+		Claimed:        make(map[string]string),
+		OrphanRoutes:   []string{},
+		OrphanMacvlans: []string{},
+	}
+
+	hi, err := host.GetInterface(nr.Name)
+	if err != nil {
+		// not connected on this host, report what docker knows
+		ns.VNI, _ = vxlan.ParseVxlanID(nr.Options["vxlanid"])
+		return ns, nil
+	}
+
+	ns.Vxlan = hi.Name()
+	ns.HostMacvlan = hi.MacvlanName()
+	if ns.VNI, err = hi.VNI(); err != nil {
+		return nil, err
+	}
+	dev, src, err := hi.Underlay()
+	if err != nil {
+		return nil, err
+	}
+	ns.VtepDev = dev
+	if src != nil {
+		ns.SrcAddr = src.String()
+	}
+	gws, err := hi.Gateways()
+	if err != nil {
+		return nil, err
+	}
+	for _, gw := range gws {
+		ns.Gateways = append(ns.Gateways, gw.String())
+	}
+	if ns.OptionsChanged, err = hi.Drifted(nr.Options); err != nil {
+		log.WithError(err).WithField("network", nr.Name).Warn("failed to compare vxlan to network options")
+	}
+
+	ctrs := make(map[string]string)
+	eps := make(map[string]struct{})
+	for id, er := range nr.Containers {
+		name := er.Name
+		if name == "" {
+			name = id
+		}
+		for _, a := range []string{er.IPv4Address, er.IPv6Address} {
+			if ip, _, err := net.ParseCIDR(a); err == nil {
+				ctrs[ip.String()] = name
+			}
+		}
+		if len(er.EndpointID) >= 7 {
+			eps["cmvl_"+er.EndpointID[:7]] = struct{}{}
+		}
+	}
+
+	routes, err := hi.Routes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		ip := r.IP.String()
+		if name, ok := ctrs[ip]; ok {
+			ns.Claimed[ip] = name
+			continue
+		}
+		ns.OrphanRoutes = append(ns.OrphanRoutes, ip)
+	}
+
+	mvls, err := hi.ContainerMacvlans()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mvls {
+		if !strings.HasPrefix(m, "cmvl_") {
+			continue
+		}
+		if _, ok := eps[m]; !ok {
+			ns.OrphanMacvlans = append(ns.OrphanMacvlans, m)
+		}
+	}
+
+	return ns, nil
+}
+
+// Owners returns the ids of the containers and endpoints on network name using the claimed addresses or container
+// macvlans, so the host package can name the containers keeping a vxlan from being recreated
+func (c *Core) Owners(name string, claimed []net.IP, macvlans []string) ([]string, []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	nr, err := c.dc.NetworkInspect(ctx, name)
+	if err != nil {
+		log.WithError(err).WithField("network", name).Debug("failed to inspect network")
+		return nil, nil
+	}
+
+	used := make(map[string]struct{})
+	for _, ip := range claimed {
+		used[ip.String()] = struct{}{}
+	}
+	for _, m := range macvlans {
+		used[m] = struct{}{}
+	}
+
+	ctrs, eps := []string{}, []string{}
+	for id, er := range nr.Containers {
+		keys := []string{}
+		if len(er.EndpointID) >= 7 {
+			keys = append(keys, "cmvl_"+er.EndpointID[:7])
+		}
+		for _, a := range []string{er.IPv4Address, er.IPv6Address} {
+			if ip, _, err := net.ParseCIDR(a); err == nil {
+				keys = append(keys, ip.String())
+			}
+		}
+		for _, k := range keys {
+			if _, ok := used[k]; ok {
+				ctrs = append(ctrs, id)
+				eps = append(eps, er.EndpointID)
+				break
+			}
+		}
+	}
+	sort.Strings(ctrs)
+	sort.Strings(eps)
+	return ctrs, eps
+}
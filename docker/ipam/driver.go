@@ -1,74 +1,167 @@
 package ipam
 
 import (
-	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	gphipam "github.com/docker/go-plugins-helpers/ipam"
 
+	"github.com/TrilliumIT/iputil"
 	"github.com/TrilliumIT/vxrouter"
 	"github.com/TrilliumIT/vxrouter/docker/core"
+	"github.com/TrilliumIT/vxrouter/metrics"
 )
 
 const (
 	// DriverName is the name of the driver
 	DriverName = vxrouter.IpamDriver
+
+	// docker does not pass the endpoint id or container name to ipam drivers,
+	// the requested mac address is the only thing identifying the endpoint
+	macAddressOption = "com.docker.network.endpoint.macaddress"
 )
 
 // Driver is the driver ipam type
 type Driver struct {
 	core *core.Core
 	log  *log.Entry
+
+	// supernets are the default supernets automatic pools are allocated from
+	supernets []*net.IPNet
+	// autoPools are the pool ids of automatically allocated pools which docker has not released yet
+	// they are held here too, since a pool is not visible in the docker network list until the network is created
+	autoPoolsL sync.Mutex
+	autoPools  map[string]struct{}
 }
 
-// NewDriver creates new ipam driver
-func NewDriver(core *core.Core) (*Driver, error) {
-	return &Driver{core, log.WithField("driver", DriverName)}, nil
+// NewDriver creates new ipam driver, allocating pools from supernets when a request does not specify a pool
+func NewDriver(core *core.Core, supernets []*net.IPNet) (*Driver, error) {
+	d := &Driver{
+		core:      core,
+		log:       log.WithField("driver", DriverName),
+		supernets: supernets,
+		autoPools: make(map[string]struct{}),
+	}
+	return d, nil
 }
 
 // GetCapabilities does nothing
-func (d *Driver) GetCapabilities() (*gphipam.CapabilitiesResponse, error) {
+func (d *Driver) GetCapabilities() (_ *gphipam.CapabilitiesResponse, err error) {
+	defer metrics.DriverCall(DriverName, "GetCapabilities", time.Now(), &err)
 	d.log.Debug("GetCapabilities()")
 	return &gphipam.CapabilitiesResponse{}, nil
 }
 
-// GetDefaultAddressSpaces does nothing
-func (d *Driver) GetDefaultAddressSpaces() (*gphipam.AddressSpacesResponse, error) {
+// GetDefaultAddressSpaces returns the local and global address spaces, which both claim routes in the main table
+func (d *Driver) GetDefaultAddressSpaces() (_ *gphipam.AddressSpacesResponse, err error) {
+	defer metrics.DriverCall(DriverName, "GetDefaultAddressSpaces", time.Now(), &err)
 	d.log.Debug("GetDefaultAddressSpaces()")
-	return &gphipam.AddressSpacesResponse{}, nil
+	return &gphipam.AddressSpacesResponse{
+		LocalDefaultAddressSpace:  core.LocalAddressSpace,
+		GlobalDefaultAddressSpace: core.GlobalAddressSpace,
+	}, nil
 }
 
-// RequestPool reflects the pool back to the caller
-func (d *Driver) RequestPool(r *gphipam.RequestPoolRequest) (*gphipam.RequestPoolResponse, error) {
+// RequestPool reflects the pool back to the caller, or allocates one from the supernets if no pool is requested
+// the addressspace ipam option selects a named address space instead of docker's default space
+func (d *Driver) RequestPool(r *gphipam.RequestPoolRequest) (_ *gphipam.RequestPoolResponse, err error) {
+	defer metrics.DriverCall(DriverName, "RequestPool", time.Now(), &err)
 	d.log.WithField("r", r).Debug("RequestPool()")
 
-	if r.Pool == "" {
-		return nil, fmt.Errorf("this driver does not support automatic address pools")
+	space := core.SpaceFromOptions(r.AddressSpace, r.Options)
+	err = d.core.ValidAddressSpace(space)
+	if err != nil {
+		d.log.WithError(err).Error()
+		return nil, err
+	}
+
+	pool := r.Pool
+	if pool == "" {
+		pool, err = d.allocatePool(r, space)
+		if err != nil {
+			d.log.WithError(err).Error("failed to allocate pool")
+			return nil, err
+		}
+	}
+
+	err = validSubPool(pool, r.SubPool)
+	if err != nil {
+		d.log.WithError(err).Error()
+		return nil, err
 	}
 
 	rpr := &gphipam.RequestPoolResponse{
-		PoolID: DriverName + "/" + r.Pool,
-		Pool:   r.Pool,
+		PoolID: core.PoolID(space, pool),
+		Pool:   pool,
 	}
 
 	return rpr, nil
 }
 
+// allocatePool picks a pool from the supernets which is not used by another network in space, or routed in it's table
+func (d *Driver) allocatePool(r *gphipam.RequestPoolRequest, space string) (string, error) {
+	supernets, pl, err := poolRequest(d.supernets, r.Options, r.V6)
+	if err != nil {
+		return "", err
+	}
+
+	d.autoPoolsL.Lock()
+	defer d.autoPoolsL.Unlock()
+
+	used, err := d.core.UsedSubnets(space, r.V6)
+	if err != nil {
+		return "", err
+	}
+	for id := range d.autoPools {
+		if !core.SameAddressSpace(core.SpaceFromID(id), space) {
+			continue
+		}
+		_, sn, err := net.ParseCIDR(core.PoolFromID(id)) // nolint: vetshadow
+		if err == nil {
+			used = append(used, sn)
+		}
+	}
+
+	sn, err := allocatePool(supernets, pl, used)
+	if err != nil {
+		return "", err
+	}
+	d.autoPools[core.PoolID(space, sn.String())] = struct{}{}
+	d.log.WithField("pool", sn.String()).WithField("space", space).Info("allocated pool")
+	return sn.String(), nil
+}
+
 // ReleasePool clears the network resource cache from core
-func (d *Driver) ReleasePool(r *gphipam.ReleasePoolRequest) error {
+func (d *Driver) ReleasePool(r *gphipam.ReleasePoolRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "ReleasePool", time.Now(), &err)
 	d.log.WithField("r", r).Debug("ReleasePool()")
 	d.core.Uncache(r.PoolID)
+
+	d.autoPoolsL.Lock()
+	delete(d.autoPools, r.PoolID)
+	d.autoPoolsL.Unlock()
 	return nil
 }
 
 // RequestAddress calls the core function to connect and get an available address
-func (d *Driver) RequestAddress(r *gphipam.RequestAddressRequest) (*gphipam.RequestAddressResponse, error) {
+func (d *Driver) RequestAddress(r *gphipam.RequestAddressRequest) (_ *gphipam.RequestAddressResponse, err error) {
+	defer metrics.DriverCall(DriverName, "RequestAddress", time.Now(), &err)
 	d.log.WithField("r", r).Debug("RequestAddress()")
 
-	// Always respond with the gateway address if specified
+	// Always respond with the gateway address if specified, or the first address in the pool if not
 	// This is called on network create, and network create will fail if this returns an error
-	if r.Options["RequestAddressType"] == "com.docker.network.gateway" && r.Address != "" {
-		r, err := core.IPNetFromReqInfo(r.PoolID, r.Address)
+	if r.Options["RequestAddressType"] == "com.docker.network.gateway" {
+		addr := r.Address
+		if addr == "" {
+			_, sn, err := net.ParseCIDR(core.PoolFromID(r.PoolID)) // nolint: vetshadow
+			if err != nil {
+				return nil, err
+			}
+			addr = iputil.IPAdd(iputil.FirstAddr(sn), 1).String()
+		}
+		r, err := core.IPNetFromReqInfo(r.PoolID, addr)
 		if err != nil {
 			return nil, err
 		}
@@ -77,7 +170,19 @@ func (d *Driver) RequestAddress(r *gphipam.RequestAddressRequest) (*gphipam.Requ
 		}, nil
 	}
 
-	addr, err := d.core.ConnectAndGetAddress(r.Address, r.PoolID)
+	addr, err := d.core.ConnectAndGetAddress(r.Address, r.PoolID, r.Options[macAddressOption])
+	if err == core.ErrNetworkNotFound && r.Address != "" {
+		// auxiliary addresses are requested while docker creates the network, before it is listed
+		// they are reserved rather than claimed, so just reflect them back
+		var a *net.IPNet
+		a, err = core.IPNetFromReqInfo(r.PoolID, r.Address)
+		if err != nil {
+			return nil, err
+		}
+		return &gphipam.RequestAddressResponse{
+			Address: a.String(),
+		}, nil
+	}
 	if err != nil {
 		log.WithField("r.Address", r.Address).WithField("r.PoolID", r.PoolID).Error("failed to get address")
 		return nil, err
@@ -91,8 +196,9 @@ func (d *Driver) RequestAddress(r *gphipam.RequestAddressRequest) (*gphipam.Requ
 }
 
 // ReleaseAddress does nothing
-func (d *Driver) ReleaseAddress(r *gphipam.ReleaseAddressRequest) error {
+func (d *Driver) ReleaseAddress(r *gphipam.ReleaseAddressRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "ReleaseAddress", time.Now(), &err)
 	d.log.WithField("r", r).Debug("ReleaseAddress()")
 
-	return d.core.DeleteRoute(r.Address)
+	return d.core.DeleteRoute(r.PoolID, r.Address)
 }
@@ -0,0 +1,145 @@
+package ipam
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/TrilliumIT/vxrouter/host"
+)
+
+const (
+	// default size of automatically allocated pools
+	defaultPrefixLen   = 24
+	defaultPrefixLenV6 = 64
+)
+
+// ParseSupernets parses a list of cidrs to allocate pools from
+func ParseSupernets(ss []string) ([]*net.IPNet, error) {
+	r := []*net.IPNet{}
+	for _, s := range ss {
+		for _, c := range strings.Split(s, ",") {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				continue
+			}
+			_, sn, err := net.ParseCIDR(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid supernet %q: %v", c, err)
+			}
+			r = append(r, sn)
+		}
+	}
+	return r, nil
+}
+
+// poolRequest returns the supernets of the right family and the prefix length for an automatically allocated pool
+// the supernet and prefixlen ipam options override the daemon's supernets and the default prefix length
+func poolRequest(supernets []*net.IPNet, opts map[string]string, v6 bool) ([]*net.IPNet, int, error) {
+	var err error
+	if s, ok := opts["supernet"]; ok {
+		supernets, err = ParseSupernets([]string{s})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	r := []*net.IPNet{}
+	for _, sn := range supernets {
+		if (sn.IP.To4() == nil) == v6 {
+			r = append(r, sn)
+		}
+	}
+	if len(r) == 0 {
+		return nil, 0, fmt.Errorf("no supernet configured to allocate a pool from, set --ipam-opt supernet=<cidr> or --ipam-supernet")
+	}
+
+	pl := defaultPrefixLen
+	if v6 {
+		pl = defaultPrefixLenV6
+	}
+	if s, ok := opts["prefixlen"]; ok {
+		pl, err = strconv.Atoi(strings.TrimPrefix(s, "/"))
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid prefixlen %q: %v", s, err)
+		}
+	}
+	return r, pl, nil
+}
+
+// allocatePool returns the first subnet with prefix length pl in supernets which does not overlap anything in used
+// supernets smaller than pl are skipped
+func allocatePool(supernets []*net.IPNet, pl int, used []*net.IPNet) (*net.IPNet, error) {
+	fits := false
+	for _, sup := range supernets {
+		ones, bits := sup.Mask.Size()
+		if pl < ones || pl > bits {
+			continue
+		}
+		fits = true
+
+		// routes covering the whole supernet, like an aggregate of it, don't make it's subnets unavailable
+		inSup := []*net.IPNet{}
+		for _, u := range used {
+			if uo, _ := u.Mask.Size(); uo <= ones && u.Contains(sup.IP) {
+				continue
+			}
+			if overlaps(u, sup) {
+				inSup = append(inSup, u)
+			}
+		}
+
+		base := host.IPToInt(sup.IP.Mask(sup.Mask))
+		step := new(big.Int).Lsh(big.NewInt(1), uint(bits-pl))
+		count := new(big.Int).Lsh(big.NewInt(1), uint(pl-ones))
+		for i := new(big.Int); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+			off := new(big.Int).Mul(i, step)
+			sn := &net.IPNet{
+				IP:   host.IntToIP(off.Add(off, base), len(sup.IP)),
+				Mask: net.CIDRMask(pl, bits),
+			}
+			free := true
+			for _, u := range inSup {
+				if overlaps(u, sn) {
+					free = false
+					break
+				}
+			}
+			if free {
+				return sn, nil
+			}
+		}
+	}
+	if !fits {
+		return nil, fmt.Errorf("prefixlen %v does not fit in any supernet of %v", pl, supernets)
+	}
+	return nil, fmt.Errorf("no free /%v pool left in %v", pl, supernets)
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// validSubPool returns an error if subPool is set and not inside pool
+// the sub pool is read back from the network's ipam config when allocating addresses
+func validSubPool(pool, subPool string) error {
+	if subPool == "" {
+		return nil
+	}
+	_, psn, err := net.ParseCIDR(pool)
+	if err != nil {
+		return err
+	}
+	_, ssn, err := net.ParseCIDR(subPool)
+	if err != nil {
+		return fmt.Errorf("invalid ip range %q: %v", subPool, err)
+	}
+	pones, _ := psn.Mask.Size()
+	sones, _ := ssn.Mask.Size()
+	if !psn.Contains(ssn.IP) || sones < pones || (psn.IP.To4() == nil) != (ssn.IP.To4() == nil) {
+		return fmt.Errorf("ip range %v is not inside pool %v", ssn, psn)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func cidrs(t *testing.T, ss ...string) []*net.IPNet {
+	r := []*net.IPNet{}
+	for _, s := range ss {
+		_, sn, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, sn)
+	}
+	return r
+}
+
+func TestAllocatePool(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		supernets []string
+		pl        int
+		used      []string
+		want      string
+	}{
+		{"first subnet", []string{"10.64.0.0/16"}, 24, nil, "10.64.0.0/24"},
+		{"skips used subnets", []string{"10.64.0.0/16"}, 24, []string{"10.64.0.0/24", "10.64.1.128/25"}, "10.64.2.0/24"},
+		{"aggregate of the supernet", []string{"10.64.0.0/16"}, 24, []string{"10.0.0.0/8"}, "10.64.0.0/24"},
+		{"full supernet", []string{"10.64.0.0/23", "10.65.0.0/16"}, 24, []string{"10.64.0.0/24", "10.64.1.0/24"}, "10.65.0.0/24"},
+		{"too small supernet", []string{"10.64.0.0/26", "10.65.0.0/16"}, 24, nil, "10.65.0.0/24"},
+		{"ipv6", []string{"2001:db8::/48"}, 64, []string{"2001:db8::/64"}, "2001:db8:0:1::/64"},
+		{"nothing fits", []string{"10.64.0.0/26"}, 24, nil, ""},
+		{"nothing free", []string{"10.64.0.0/24"}, 25, []string{"10.64.0.0/25", "10.64.0.128/26", "10.64.0.192/26"}, ""},
+	} {
+		sn, err := allocatePool(cidrs(t, tc.supernets...), tc.pl, cidrs(t, tc.used...))
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v", tc.name, sn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if sn.String() != tc.want {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.want, sn)
+		}
+	}
+}
+
+func TestPoolRequest(t *testing.T) {
+	daemon := cidrs(t, "10.64.0.0/16", "2001:db8::/48")
+	for _, tc := range []struct {
+		name      string
+		opts      map[string]string
+		v6        bool
+		supernets string
+		pl        int
+		err       bool
+	}{
+		{"daemon supernet", nil, false, "[10.64.0.0/16]", 24, false},
+		{"daemon ipv6 supernet", nil, true, "[2001:db8::/48]", 64, false},
+		{"supernet option", map[string]string{"supernet": "172.20.0.0/14,2001:db8:1::/48"}, false, "[172.20.0.0/14]", 24, false},
+		{"prefixlen option", map[string]string{"prefixlen": "/20"}, false, "[10.64.0.0/16]", 20, false},
+		{"no supernet of the family", map[string]string{"supernet": "172.20.0.0/14"}, true, "", 0, true},
+		{"invalid supernet", map[string]string{"supernet": "172.20.0.0"}, false, "", 0, true},
+		{"invalid prefixlen", map[string]string{"prefixlen": "big"}, false, "", 0, true},
+	} {
+		sns, pl, err := poolRequest(daemon, tc.opts, tc.v6)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected an error, got %v /%v", tc.name, sns, pl)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if got := fmt.Sprint(sns); got != tc.supernets || pl != tc.pl {
+			t.Errorf("%v: expected %v /%v, got %v /%v", tc.name, tc.supernets, tc.pl, got, pl)
+		}
+	}
+}
+
+func TestValidSubPool(t *testing.T) {
+	for _, tc := range []struct {
+		pool, subPool string
+		ok            bool
+	}{
+		{"10.64.0.0/16", "", true},
+		{"10.64.0.0/16", "10.64.8.0/24", true},
+		{"10.64.0.0/16", "10.64.0.0/16", true},
+		{"10.64.0.0/16", "10.0.0.0/8", false},
+		{"10.64.0.0/16", "10.65.0.0/24", false},
+		{"2001:db8::/48", "2001:db8:0:8::/64", true},
+		{"2001:db8::/48", "10.64.8.0/24", false},
+		{"10.64.0.0/16", "10.64.8.0", false},
+	} {
+		if err := validSubPool(tc.pool, tc.subPool); (err == nil) != tc.ok {
+			t.Errorf("%v in %v: expected valid %v, got %v", tc.subPool, tc.pool, tc.ok, err)
+		}
+	}
+}
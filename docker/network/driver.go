@@ -2,18 +2,26 @@ package network
 
 import (
 	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	gphnet "github.com/docker/go-plugins-helpers/network"
 
 	"github.com/TrilliumIT/vxrouter"
 	"github.com/TrilliumIT/vxrouter/docker/core"
+	"github.com/TrilliumIT/vxrouter/metrics"
+	"github.com/TrilliumIT/vxrouter/options"
 	"github.com/TrilliumIT/vxrouter/vxlan"
 )
 
 const (
 	// DriverName is the docker plugin name of the driver
 	DriverName = vxrouter.NetworkDriver
+
+	// internalOption is set by docker on --internal networks
+	internalOption = "com.docker.network.internal"
 )
 
 // Driver is a vxrouter network driver
@@ -21,20 +29,34 @@ type Driver struct {
 	scope string
 	core  *core.Core
 	log   *log.Entry
+
+	// eps holds the addresses and mac of endpoints between CreateEndpoint and DeleteEndpoint
+	// so Join can pick the gateway in the same subnet on networks with several subnets
+	// and create the container macvlan with the mac docker was given
+	// endpoints created before the driver restarted are recovered from the journal by Join
+	epsL sync.Mutex
+	eps  map[string]*endpoint
+}
+
+type endpoint struct {
+	addrs []net.IP
+	mac   net.HardwareAddr
 }
 
 // NewDriver creates a new Driver
 func NewDriver(scope string, core *core.Core) (*Driver, error) {
 	d := &Driver{
-		scope,
-		core,
-		log.WithField("driver", DriverName),
+		scope: scope,
+		core:  core,
+		log:   log.WithField("driver", DriverName),
+		eps:   make(map[string]*endpoint),
 	}
 	return d, nil
 }
 
 // GetCapabilities is called on driver initialization
-func (d *Driver) GetCapabilities() (*gphnet.CapabilitiesResponse, error) {
+func (d *Driver) GetCapabilities() (_ *gphnet.CapabilitiesResponse, err error) {
+	defer metrics.DriverCall(DriverName, "GetCapabilities", time.Now(), &err)
 	d.log.Debug("GetCapabilities()")
 	cap := &gphnet.CapabilitiesResponse{
 		Scope:             d.scope,
@@ -44,133 +66,320 @@ func (d *Driver) GetCapabilities() (*gphnet.CapabilitiesResponse, error) {
 }
 
 // CreateNetwork is called on docker network create
-func (d *Driver) CreateNetwork(r *gphnet.CreateNetworkRequest) error {
+func (d *Driver) CreateNetwork(r *gphnet.CreateNetworkRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "CreateNetwork", time.Now(), &err)
 	d.log.WithField("r", r).Debug("CreateNetwork()")
 
-	hasGW := false
-	for _, v4 := range append(r.IPv4Data, r.IPv6Data...) {
-		if v4.Gateway != "" {
-			hasGW = true
-			break
-		}
+	gopts, ok := r.Options["com.docker.network.generic"].(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("did not retrieve the options array for the network")
+		d.log.WithError(err).Error()
+		return err
+	}
+
+	opts := make(map[string]string)
+	for k, v := range gopts {
+		opts[k] = fmt.Sprintf("%v", v)
 	}
 
-	if !hasGW {
-		err := fmt.Errorf("gateway not found in IPAMData")
+	// fail now on unknown or invalid options, rather than on the first container start
+	err = options.Validate(opts)
+	if err != nil {
 		d.log.WithError(err).Error()
 		return err
 	}
 
-	opts, ok := r.Options["com.docker.network.generic"].(map[string]interface{})
-	if !ok {
-		err := fmt.Errorf("did not retrieve the options array for the network")
+	err = vxlan.ValidEVPN(opts)
+	if err != nil {
 		d.log.WithError(err).Error()
 		return err
 	}
 
-	vxlID, ok := opts["vxlanid"]
-	if !ok {
-		err := fmt.Errorf("cannot create a network without a vxlanid (-o vxlanid=<0-16777215>)")
+	err = vxlan.ValidUnderlay(opts)
+	if err != nil {
+		d.log.WithError(err).Error()
+		return err
+	}
+
+	if _, ok = opts["vxlanid"]; !ok {
+		err = fmt.Errorf("cannot create a network without a vxlanid (-o vxlanid=<0-16777215>)")
 		d.log.WithError(err).Error()
 		return err
 	}
 
-	_, err := vxlan.ParseVxlanID(vxlID.(string))
-	return err
+	// internal networks and networks routed by something else don't need a gateway on the host
+	hostGW := vxrouter.GetEnvBoolWithDefault(vxrouter.EnvPrefix+"hostgateway", opts["hostgateway"], true)
+	if internal, _ := r.Options[internalOption].(bool); hostGW && !internal {
+		hasGW := false
+		for _, v4 := range append(r.IPv4Data, r.IPv6Data...) {
+			if v4.Gateway != "" {
+				hasGW = true
+				break
+			}
+		}
+
+		if !hasGW {
+			err = fmt.Errorf("gateway not found in IPAMData")
+			d.log.WithError(err).Error()
+			return err
+		}
+	}
+
+	return nil
 }
 
 // AllocateNetwork is never called
-func (d *Driver) AllocateNetwork(r *gphnet.AllocateNetworkRequest) (*gphnet.AllocateNetworkResponse, error) {
+func (d *Driver) AllocateNetwork(r *gphnet.AllocateNetworkRequest) (_ *gphnet.AllocateNetworkResponse, err error) {
+	defer metrics.DriverCall(DriverName, "AllocateNetwork", time.Now(), &err)
 	d.log.WithField("r", r).Debug("AllocateNetwork()")
 	return &gphnet.AllocateNetworkResponse{}, nil
 }
 
 // DeleteNetwork is called on docker network rm
-func (d *Driver) DeleteNetwork(r *gphnet.DeleteNetworkRequest) error {
+func (d *Driver) DeleteNetwork(r *gphnet.DeleteNetworkRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "DeleteNetwork", time.Now(), &err)
 	d.log.WithField("r", r).Debug("DeleteNetwork()")
 
 	return nil
 }
 
 // FreeNetwork is never called
-func (d *Driver) FreeNetwork(r *gphnet.FreeNetworkRequest) error {
+func (d *Driver) FreeNetwork(r *gphnet.FreeNetworkRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "FreeNetwork", time.Now(), &err)
 	d.log.WithField("r", r).Debug("FreeNetwork()")
 	return nil
 }
 
 // CreateEndpoint is called after IPAM has assigned an address, before Join is called
-func (d *Driver) CreateEndpoint(r *gphnet.CreateEndpointRequest) (*gphnet.CreateEndpointResponse, error) {
+func (d *Driver) CreateEndpoint(r *gphnet.CreateEndpointRequest) (_ *gphnet.CreateEndpointResponse, err error) {
+	defer metrics.DriverCall(DriverName, "CreateEndpoint", time.Now(), &err)
 	d.log.WithField("r", r).Debug("CreateEndpoint()")
 
-	return &gphnet.CreateEndpointResponse{}, nil
+	cer := &gphnet.CreateEndpointResponse{}
+	if r.Interface == nil {
+		return cer, nil
+	}
+
+	ep := &endpoint{}
+	for _, a := range []string{r.Interface.Address, r.Interface.AddressIPv6} {
+		err = d.core.ConfirmAddress(r.NetworkID, a, r.EndpointID)
+		if err != nil {
+			d.log.WithError(err).WithField("address", a).Error("failed to confirm address in journal")
+			return nil, err
+		}
+		if ip, _, perr := net.ParseCIDR(a); perr == nil {
+			ep.addrs = append(ep.addrs, ip)
+		}
+	}
+
+	ownMAC, err := d.core.HasOwnMACByNetID(r.NetworkID)
+	if err != nil {
+		return nil, err
+	}
+
+	// ipvlans share the mac of the vxlan, so there is nothing to pick
+	if ownMAC {
+		if r.Interface.MacAddress != "" {
+			ep.mac, err = net.ParseMAC(r.Interface.MacAddress)
+			if err != nil {
+				d.log.WithError(err).WithField("mac", r.Interface.MacAddress).Error("failed to parse mac address")
+				return nil, err
+			}
+		} else {
+			// docker refuses a mac in the response if it requested one, so only return generated macs
+			ep.mac = macFromAddrs(ep.addrs)
+			if ep.mac != nil {
+				cer.Interface = &gphnet.EndpointInterface{MacAddress: ep.mac.String()}
+			}
+		}
+	}
+
+	d.epsL.Lock()
+	d.eps[r.EndpointID] = ep
+	d.epsL.Unlock()
+
+	return cer, nil
+}
+
+// macFromAddrs derives a locally administered mac address from the ipv4 address in addrs
+// the same way docker's bridge driver does, or from the last four bytes of the ipv6 address if there is no ipv4 address
+func macFromAddrs(addrs []net.IP) net.HardwareAddr {
+	var ip net.IP
+	for _, a := range addrs {
+		if a4 := a.To4(); a4 != nil {
+			ip = a4
+			break
+		}
+		if ip == nil {
+			ip = a[len(a)-4:]
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+
+	mac := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+	copy(mac[2:], ip)
+	return mac
 }
 
 // DeleteEndpoint is called after Leave
-func (d *Driver) DeleteEndpoint(r *gphnet.DeleteEndpointRequest) error {
+func (d *Driver) DeleteEndpoint(r *gphnet.DeleteEndpointRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "DeleteEndpoint", time.Now(), &err)
 	d.log.WithField("r", r).Debug("DeleteEndpoint()")
 
+	d.epsL.Lock()
+	delete(d.eps, r.EndpointID)
+	d.epsL.Unlock()
+
 	return d.core.DeleteContainerInterface(r.NetworkID, r.EndpointID)
 }
 
 // EndpointInfo is called on inspect... maybe?
-func (d *Driver) EndpointInfo(r *gphnet.InfoRequest) (*gphnet.InfoResponse, error) {
+func (d *Driver) EndpointInfo(r *gphnet.InfoRequest) (_ *gphnet.InfoResponse, err error) {
+	defer metrics.DriverCall(DriverName, "EndpointInfo", time.Now(), &err)
 	d.log.WithField("r", r).Debug("EndpointInfo()")
 	return &gphnet.InfoResponse{}, nil
 }
 
 // Join is the last thing called before the nic is put into the container namespace
-func (d *Driver) Join(r *gphnet.JoinRequest) (*gphnet.JoinResponse, error) {
+func (d *Driver) Join(r *gphnet.JoinRequest) (_ *gphnet.JoinResponse, err error) {
+	defer metrics.DriverCall(DriverName, "Join", time.Now(), &err)
 	d.log.WithField("r", r).Debug("Join()")
 
-	mvlName, err := d.core.CreateContainerInterface(r.NetworkID, r.EndpointID)
+	d.epsL.Lock()
+	ep := d.eps[r.EndpointID]
+	d.epsL.Unlock()
+	if ep == nil {
+		ep, err = d.recoverEndpoint(r.NetworkID, r.EndpointID)
+		if err != nil {
+			d.log.WithError(err).Error("failed to recover endpoint")
+			return nil, err
+		}
+	}
+
+	mvlName, err := d.core.CreateContainerInterface(r.NetworkID, r.EndpointID, ep.mac)
 	if err != nil {
 		d.log.WithError(err).Error("failed to create macvlan for container")
 		return nil, err
 	}
 
-	gw, err := d.core.GetGatewayByNetID(r.NetworkID)
+	gws, err := d.core.GetGatewaysByNetID(r.NetworkID)
+	if err != nil {
+		d.log.WithError(err).Error("failed to get gateways")
+		return nil, err
+	}
+
+	internal, err := d.core.IsInternalByNetID(r.NetworkID)
 	if err != nil {
-		d.log.WithError(err).Error("failed to get gateway")
 		return nil, err
 	}
+	if internal {
+		gws = nil
+	}
 
 	jr := &gphnet.JoinResponse{
 		InterfaceName: gphnet.InterfaceName{
 			SrcName:   mvlName,
 			DstPrefix: "eth",
 		},
-		Gateway: gw.IP.String(),
+	}
+
+	// a container only has one default gateway per address family, use the one in the subnet of it's address
+	// or the first subnet's if the address is not known
+	for _, gw := range gws {
+		if !gwForAddrs(gw, ep.addrs) {
+			continue
+		}
+		if gw.IP.To4() != nil {
+			if jr.Gateway == "" {
+				jr.Gateway = gw.IP.String()
+			}
+			continue
+		}
+		if jr.GatewayIPv6 == "" {
+			jr.GatewayIPv6 = gw.IP.String()
+		}
 	}
 
 	return jr, nil
 }
 
+// recoverEndpoint rebuilds an endpoint created before the driver restarted from the addresses claimed for it in the journal
+func (d *Driver) recoverEndpoint(netid, endpointid string) (*endpoint, error) {
+	log := d.log.WithField("netid", netid).WithField("endpointid", endpointid)
+
+	addrs, mac, err := d.core.EndpointAddresses(netid, endpointid)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		log.Warn("endpoint not found in the journal, using a random mac and the first subnet's gateway")
+		return &endpoint{}, nil
+	}
+
+	ep := &endpoint{addrs: addrs}
+	ownMAC, err := d.core.HasOwnMACByNetID(netid)
+	if err != nil {
+		return nil, err
+	}
+	if ownMAC {
+		ep.mac = mac
+		if ep.mac == nil {
+			ep.mac = macFromAddrs(addrs)
+		}
+	}
+	log.WithField("addrs", addrs).WithField("mac", ep.mac).Info("recovered endpoint from the journal")
+
+	d.epsL.Lock()
+	d.eps[endpointid] = ep
+	d.epsL.Unlock()
+	return ep, nil
+}
+
+// gwForAddrs returns true if gw is in the subnet of the address in addrs of the same family
+// or if there is no address of that family in addrs
+func gwForAddrs(gw *net.IPNet, addrs []net.IP) bool {
+	for _, a := range addrs {
+		if (a.To4() == nil) != (gw.IP.To4() == nil) {
+			continue
+		}
+		return gw.Contains(a)
+	}
+	return true
+}
+
 // Leave is the first thing called on container stop
-func (d *Driver) Leave(r *gphnet.LeaveRequest) error {
+func (d *Driver) Leave(r *gphnet.LeaveRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "Leave", time.Now(), &err)
 	d.log.WithField("r", r).Debug("Leave()")
 	return nil
 }
 
 // DiscoverNew is not implemented by this driver
-func (d *Driver) DiscoverNew(r *gphnet.DiscoveryNotification) error {
+func (d *Driver) DiscoverNew(r *gphnet.DiscoveryNotification) (err error) {
+	defer metrics.DriverCall(DriverName, "DiscoverNew", time.Now(), &err)
 	d.log.WithField("r", r).Debug("DiscoverNew()")
 	return nil
 }
 
 // DiscoverDelete is not implemented by this driver
-func (d *Driver) DiscoverDelete(r *gphnet.DiscoveryNotification) error {
+func (d *Driver) DiscoverDelete(r *gphnet.DiscoveryNotification) (err error) {
+	defer metrics.DriverCall(DriverName, "DiscoverDelete", time.Now(), &err)
 	d.log.WithField("r", r).Debug("DiscoverDelete()")
 	return nil
 }
 
 // ProgramExternalConnectivity is not implemented by this driver
-func (d *Driver) ProgramExternalConnectivity(r *gphnet.ProgramExternalConnectivityRequest) error {
+func (d *Driver) ProgramExternalConnectivity(r *gphnet.ProgramExternalConnectivityRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "ProgramExternalConnectivity", time.Now(), &err)
 	d.log.WithField("r", r).Debug("ProgramExternalConnectivity()")
 	return nil
 }
 
 // RevokeExternalConnectivity is not implemented by this driver
-func (d *Driver) RevokeExternalConnectivity(r *gphnet.RevokeExternalConnectivityRequest) error {
+func (d *Driver) RevokeExternalConnectivity(r *gphnet.RevokeExternalConnectivityRequest) (err error) {
+	defer metrics.DriverCall(DriverName, "RevokeExternalConnectivity", time.Now(), &err)
 	d.log.WithField("r", r).Debug("RevokeExternalConnectivity()")
 
 	return nil
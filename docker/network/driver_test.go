@@ -0,0 +1,216 @@
+package network
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	dnetwork "github.com/docker/docker/api/types/network"
+	gphnet "github.com/docker/go-plugins-helpers/network"
+	"golang.org/x/net/context"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/docker/core"
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/kernel/kerneltest"
+)
+
+// fakeDocker is a DockerClient serving a fixed set of networks without any containers
+type fakeDocker struct {
+	networks []types.NetworkResource
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return nil, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	return types.ContainerJSON{}, fmt.Errorf("no such container %v", container)
+}
+
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error) {
+	for _, nr := range f.networks {
+		if nr.ID == networkID {
+			return nr, nil
+		}
+	}
+	return types.NetworkResource{}, fmt.Errorf("no such network %v", networkID)
+}
+
+func (f *fakeDocker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	return f.networks, nil
+}
+
+func TestJoinAfterRestart(t *testing.T) {
+	old := kernel.Set(kerneltest.New())
+	defer kernel.Set(old)
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	defer host.SetJournal(nil)
+
+	// the container's address is in the second subnet
+	nr := types.NetworkResource{
+		ID:      "netjr",
+		Name:    "jr",
+		Driver:  vxrouter.NetworkDriver,
+		Options: map[string]string{"vxlanid": "300", "allocstrategy": "sequential"},
+		IPAM: dnetwork.IPAM{
+			Driver: vxrouter.IpamDriver,
+			Config: []dnetwork.IPAMConfig{
+				{Subnet: "10.30.0.0/24", Gateway: "10.30.0.1"},
+				{Subnet: "10.31.0.0/24", Gateway: "10.31.0.1"},
+			},
+		},
+	}
+	c := core.NewWithClient(&fakeDocker{networks: []types.NetworkResource{nr}}, 0, time.Second)
+	if err = c.OpenJournal(filepath.Join(dir, "journal.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		endpoint, key, mac string
+	}{
+		// without --mac-address the mac is derived from the address
+		{"0123456789ab", "", "02:42:0a:1f:00:02"},
+		{"ba9876543210", "02:42:00:00:00:99", "02:42:00:00:00:99"},
+	} {
+		a, err := c.ConnectAndGetAddress("", core.PoolID(core.LocalAddressSpace, "10.31.0.0/24"), tc.key) // nolint: vetshadow
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, _ := NewDriver("local", c) // nolint: errcheck
+		cer := &gphnet.CreateEndpointRequest{NetworkID: "netjr", EndpointID: tc.endpoint, Interface: &gphnet.EndpointInterface{Address: a.String(), MacAddress: tc.key}}
+		if _, err = d.CreateEndpoint(cer); err != nil {
+			t.Fatal(err)
+		}
+
+		// the restarted driver only has the journal to go by
+		d, _ = NewDriver("local", c) // nolint: errcheck
+		jr, err := d.Join(&gphnet.JoinRequest{NetworkID: "netjr", EndpointID: tc.endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jr.Gateway != "10.31.0.1" {
+			t.Errorf("%v: expected the gateway of the second subnet, got %v", tc.endpoint, jr.Gateway)
+		}
+		cmvl, err := kernel.Get().LinkByName(jr.InterfaceName.SrcName)
+		if err != nil {
+			t.Fatalf("%v: container macvlan not created: %v", tc.endpoint, err)
+		}
+		if m := cmvl.Attrs().HardwareAddr.String(); m != tc.mac {
+			t.Errorf("%v: expected mac %v, got %v", tc.endpoint, tc.mac, m)
+		}
+	}
+}
+
+func TestCreateNetworkHostGateway(t *testing.T) {
+	create := func(opts map[string]interface{}) error {
+		d, _ := NewDriver("local", core.NewWithClient(&fakeDocker{}, 0, time.Second)) // nolint: errcheck
+		opts["vxlanid"] = "301"
+		return d.CreateNetwork(&gphnet.CreateNetworkRequest{
+			NetworkID: "nethg",
+			Options:   map[string]interface{}{"com.docker.network.generic": opts},
+			IPv4Data:  []*gphnet.IPAMData{{Pool: "10.32.0.0/24"}},
+		})
+	}
+
+	if err := create(map[string]interface{}{}); err == nil {
+		t.Errorf("expected a network without a gateway to be refused")
+	}
+	if err := create(map[string]interface{}{"hostgateway": "false"}); err != nil {
+		t.Errorf("expected a network without a host gateway to need no gateway, got %v", err)
+	}
+
+	// the environment default applies like it does to the other options
+	if err := os.Setenv(vxrouter.EnvPrefix+"hostgateway", "false"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv(vxrouter.EnvPrefix + "hostgateway") // nolint: errcheck
+	if err := create(map[string]interface{}{}); err != nil {
+		t.Errorf("expected %vhostgateway to disable the host gateway, got %v", vxrouter.EnvPrefix, err)
+	}
+}
+
+func TestMacFromAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		addrs []string
+		mac   string
+	}{
+		{[]string{"10.33.1.2"}, "02:42:0a:21:01:02"},
+		// the ipv4 address is preferred, wherever it is
+		{[]string{"2001:db8::a:b0c", "10.33.1.2"}, "02:42:0a:21:01:02"},
+		{[]string{"2001:db8::a:b0c"}, "02:42:00:0a:0b:0c"},
+		{nil, ""},
+	} {
+		addrs := []net.IP{}
+		for _, a := range tc.addrs {
+			addrs = append(addrs, net.ParseIP(a))
+		}
+		if m := macFromAddrs(addrs); m.String() != tc.mac {
+			t.Errorf("%v: expected mac %q, got %q", tc.addrs, tc.mac, m.String())
+		}
+	}
+}
+
+func TestCreateEndpointMAC(t *testing.T) {
+	nr := types.NetworkResource{
+		ID:      "netmc",
+		Name:    "mc",
+		Driver:  vxrouter.NetworkDriver,
+		Options: map[string]string{"vxlanid": "302"},
+		IPAM: dnetwork.IPAM{
+			Driver: vxrouter.IpamDriver,
+			Config: []dnetwork.IPAMConfig{{Subnet: "10.33.0.0/24", Gateway: "10.33.0.1"}},
+		},
+	}
+	d, _ := NewDriver("local", core.NewWithClient(&fakeDocker{networks: []types.NetworkResource{nr}}, 0, time.Second)) // nolint: errcheck
+
+	for _, tc := range []struct {
+		endpoint string
+		iface    gphnet.EndpointInterface
+		resp     string
+		mac      string
+	}{
+		{"ep4", gphnet.EndpointInterface{Address: "10.33.0.5/24"}, "02:42:0a:21:00:05", "02:42:0a:21:00:05"},
+		{"ep6", gphnet.EndpointInterface{AddressIPv6: "2001:db8::a:b0c/64"}, "02:42:00:0a:0b:0c", "02:42:00:0a:0b:0c"},
+		// docker refuses a response echoing the mac it requested
+		{"epmac", gphnet.EndpointInterface{Address: "10.33.0.6/24", MacAddress: "02:42:00:00:00:99"}, "", "02:42:00:00:00:99"},
+	} {
+		iface := tc.iface
+		cer, err := d.CreateEndpoint(&gphnet.CreateEndpointRequest{NetworkID: "netmc", EndpointID: tc.endpoint, Interface: &iface})
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case tc.resp == "" && cer.Interface != nil:
+			t.Errorf("%v: expected no interface in the response, got %+v", tc.endpoint, cer.Interface)
+		case tc.resp != "" && (cer.Interface == nil || cer.Interface.MacAddress != tc.resp):
+			t.Errorf("%v: expected mac %v in the response, got %+v", tc.endpoint, tc.resp, cer.Interface)
+		}
+		d.epsL.Lock()
+		ep := d.eps[tc.endpoint]
+		d.epsL.Unlock()
+		if ep == nil || ep.mac.String() != tc.mac {
+			t.Errorf("%v: expected the endpoint to use mac %v, got %+v", tc.endpoint, tc.mac, ep)
+		}
+	}
+
+	if _, err := d.CreateEndpoint(&gphnet.CreateEndpointRequest{NetworkID: "netmc", EndpointID: "epbad", Interface: &gphnet.EndpointInterface{MacAddress: "not a mac"}}); err == nil {
+		t.Errorf("expected an invalid mac to be refused")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,9 +17,12 @@ import (
 	"github.com/urfave/cli"
 
 	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/bgp"
 	"github.com/TrilliumIT/vxrouter/docker/core"
 	"github.com/TrilliumIT/vxrouter/docker/ipam"
 	"github.com/TrilliumIT/vxrouter/docker/network"
+	"github.com/TrilliumIT/vxrouter/host"
+	"github.com/TrilliumIT/vxrouter/metrics"
 )
 
 const (
@@ -59,12 +63,73 @@ func main() {
 		},
 		cli.DurationFlag{
 			Name:   "reconcile-interval, ri",
-			Value:  30 * time.Second,
-			Usage:  "Interval for running periodic reconcile of routes and containers. 0 to disable",
+			Value:  5 * time.Minute,
+			Usage:  "Interval for running a full reconcile of routes and containers, as a safety net for missed docker events. 0 to disable",
 			EnvVar: envPrefix + "RECONCILE_INTERVAL",
 		},
+		cli.StringFlag{
+			Name:   "conflict-policy",
+			Value:  "none",
+			Usage:  "What to do when another host claims an address held by this host. none only logs and counts it, address releases the claim on the host with the higher underlay address",
+			EnvVar: envPrefix + "CONFLICT_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "vxlan-drift",
+			Value:  "recreate",
+			Usage:  "What to do when a vxlan's attributes no longer match its network's options. recreate recreates it once no containers on the host use it, error refuses to use it. Attributes which can be changed in place always are",
+			EnvVar: envPrefix + "VXLAN_DRIFT",
+		},
+		cli.StringSliceFlag{
+			Name:   "ipam-supernet",
+			Usage:  "Supernet to allocate pools from when a network is created without a subnet. May be repeated",
+			EnvVar: envPrefix + "IPAM_SUPERNETS",
+		},
+		cli.StringSliceFlag{
+			Name:   "address-space",
+			Usage:  "Named address space and the routing table it's routes are claimed in, as name=table. May be repeated",
+			EnvVar: envPrefix + "ADDRESS_SPACES",
+		},
+		cli.StringFlag{
+			Name:   "journal",
+			Value:  "/var/lib/vxrouter/journal.json",
+			Usage:  "File to record address claims in, so claims interrupted by a crash are rolled back on startup. Empty to disable",
+			EnvVar: envPrefix + "JOURNAL",
+		},
+		cli.StringFlag{
+			Name:   "metrics-listen",
+			Usage:  "Address to serve prometheus metrics on, at /metrics. Empty to disable",
+			EnvVar: envPrefix + "METRICS_LISTEN",
+		},
+		cli.UintFlag{
+			Name:   "bgp-asn",
+			Usage:  "AS number of the embedded BGP speaker. 0 to disable and rely on an external routing daemon",
+			EnvVar: envPrefix + "BGP_ASN",
+		},
+		cli.StringFlag{
+			Name:   "bgp-router-id",
+			Usage:  "Router ID (an ipv4 address) of the embedded BGP speaker",
+			EnvVar: envPrefix + "BGP_ROUTER_ID",
+		},
+		cli.StringSliceFlag{
+			Name:   "bgp-peer",
+			Usage:  "BGP peer in the form asn@address[:port]. May be repeated",
+			EnvVar: envPrefix + "BGP_PEERS",
+		},
+		cli.StringFlag{
+			Name:   "bgp-listen",
+			Value:  ":179",
+			Usage:  "Address to accept BGP connections on. Empty to only connect to peers",
+			EnvVar: envPrefix + "BGP_LISTEN",
+		},
+		cli.DurationFlag{
+			Name:   "bgp-hold-time",
+			Value:  90 * time.Second,
+			Usage:  "BGP hold time to propose to peers",
+			EnvVar: envPrefix + "BGP_HOLD_TIME",
+		},
 	}
 	app.Action = Run
+	app.Commands = []cli.Command{statusCommand, optionsCommand}
 	err := app.Run(os.Args)
 	if err != nil {
 		log.WithError(err).Fatal("error running app")
@@ -87,10 +152,65 @@ func Run(ctx *cli.Context) {
 	pt := ctx.Duration("prop-timeout")
 	rt := ctx.Duration("resp-timeout")
 
+	cp := ctx.String("conflict-policy")
+	if err := core.ValidConflictPolicy(cp); err != nil {
+		log.WithError(err).Fatal("invalid conflict policy")
+	}
+
+	dp := ctx.String("vxlan-drift")
+	if err := host.ValidDriftPolicy(dp); err != nil {
+		log.WithError(err).Fatal("invalid vxlan drift policy")
+	}
+	host.SetDriftPolicy(dp)
+
+	spaces, err := core.ParseAddressSpaces(ctx.StringSlice("address-space"))
+	if err != nil {
+		log.WithError(err).Fatal("invalid address space")
+	}
+
 	core, err := core.New(pt, rt)
 	if err != nil {
 		log.WithError(err).Fatal("failed to create docker core")
 	}
+	core.SetAddressSpaces(spaces)
+	host.SetOwnerLookup(core.Owners)
+
+	if jp := ctx.String("journal"); jp != "" {
+		if err = core.OpenJournal(jp); err != nil {
+			log.WithError(err).Fatal("failed to open journal")
+		}
+		if err = core.Recover(); err != nil {
+			log.WithError(err).Error("failed to recover claims from journal")
+		}
+	}
+
+	if ml := ctx.String("metrics-listen"); ml != "" {
+		var ms *http.Server
+		ms, err = metrics.Listen(ml, host.ClaimedAddresses)
+		if err != nil {
+			log.WithError(err).Fatal("failed to start metrics listener")
+		}
+		defer func() {
+			msCtx, msCtxCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer msCtxCancel()
+			if err := ms.Shutdown(msCtx); err != nil {
+				log.WithError(err).Error("error shutting down metrics listener")
+			}
+		}()
+	}
+
+	speaker, err := startBGP(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("failed to start bgp speaker")
+	}
+	if speaker != nil {
+		defer speaker.Stop()
+	}
+
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	defer watchCancel()
+	go core.Watch(watchCtx)
+	go core.WatchConflicts(watchCtx, cp)
 
 	go func(ri time.Duration) {
 		core.Reconcile()
@@ -110,7 +230,11 @@ func Run(ctx *cli.Context) {
 	}
 	ncerr := make(chan error)
 
-	id, err := ipam.NewDriver(core)
+	supernets, err := ipam.ParseSupernets(ctx.StringSlice("ipam-supernet"))
+	if err != nil {
+		log.WithError(err).Fatal("invalid ipam supernet")
+	}
+	id, err := ipam.NewDriver(core, supernets)
 	if err != nil {
 		log.WithField("driver", ipam.DriverName).WithError(err).Fatal("failed to create driver")
 	}
@@ -177,3 +301,46 @@ func Run(ctx *cli.Context) {
 	fmt.Println()
 	fmt.Println("tetelestai")
 }
+
+// startBGP starts the embedded bgp speaker if an asn is configured, and originates any routes already claimed
+func startBGP(ctx *cli.Context) (*bgp.Speaker, error) {
+	asn := ctx.Uint("bgp-asn")
+	if asn == 0 {
+		return nil, nil
+	}
+
+	cfg := bgp.Config{
+		ASN:      uint32(asn),
+		RouterID: net.ParseIP(ctx.String("bgp-router-id")),
+		Listen:   ctx.String("bgp-listen"),
+		HoldTime: ctx.Duration("bgp-hold-time"),
+	}
+	for _, ps := range ctx.StringSlice("bgp-peer") {
+		pc, err := bgp.ParsePeer(ps)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Peers = append(cfg.Peers, pc)
+	}
+
+	speaker, err := bgp.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err = speaker.Start(); err != nil {
+		return nil, err
+	}
+
+	host.SetAnnouncer(speaker)
+	host.SetEVPNAnnouncer(speaker)
+	routes, err := host.AllVxRoutes()
+	if err != nil {
+		speaker.Stop()
+		return nil, err
+	}
+	for _, r := range routes {
+		speaker.Announce(r)
+	}
+
+	return speaker, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli"
+
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+var optionsCommand = cli.Command{
+	Name:  "options",
+	Usage: "List the network options (docker network create -o) vxrnet supports",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the options as json",
+		},
+	},
+	Action: Options,
+}
+
+// Options prints the supported network options
+func Options(ctx *cli.Context) error {
+	opts := options.All()
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(opts)
+	}
+	return printOptions(os.Stdout, opts)
+}
+
+func printOptions(out io.Writer, opts []options.Option) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "OPTION\tTYPE\tALLOWED\tENV\tUSAGE\n") // nolint: errcheck
+	for _, o := range opts {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", o.Name, o.Kind, allowed(o), o.Env(), o.Usage) // nolint: errcheck
+	}
+	return w.Flush()
+}
+
+func allowed(o options.Option) string {
+	if len(o.Values) > 0 {
+		return list(o.Values)
+	}
+	if o.Min != 0 || o.Max != 0 {
+		return fmt.Sprintf("%v-%v", o.Min, o.Max)
+	}
+	return "-"
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/TrilliumIT/vxrouter/docker/core"
+)
+
+var statusCommand = cli.Command{
+	Name:  "status",
+	Usage: "Show the host interfaces, claimed routes and containers of each network on this host",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as json",
+		},
+	},
+	Action: Status,
+}
+
+// Status prints the state of all vxrnet networks on this host
+func Status(ctx *cli.Context) error {
+	if ctx.GlobalBool("debug") {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	c, err := core.New(ctx.GlobalDuration("prop-timeout"), ctx.GlobalDuration("resp-timeout"))
+	if err != nil {
+		return err
+	}
+
+	st, err := c.Status()
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	return printStatus(os.Stdout, st)
+}
+
+func printStatus(out io.Writer, st *core.Status) error {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, ns := range st.Networks {
+		fmt.Fprintf(w, "NETWORK\tVNI\tVXLAN\tHOST MACVLAN\tVTEP DEV\tSRC ADDR\tGATEWAYS\n")                       // nolint: errcheck
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", ns.Name, ns.VNI, orNone(ns.Vxlan), orNone(ns.HostMacvlan), // nolint: errcheck
+			orNone(ns.VtepDev), orNone(ns.SrcAddr), list(ns.Gateways))
+		if ns.OptionsChanged {
+			fmt.Fprintf(w, "(options changed, restart the containers on this network to apply them)\n") // nolint: errcheck
+		}
+
+		ips := make([]string, 0, len(ns.Claimed))
+		for ip := range ns.Claimed {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		fmt.Fprintf(w, "\n\tCLAIMED\tCONTAINER\n") // nolint: errcheck
+		for _, ip := range ips {
+			fmt.Fprintf(w, "\t%v\t%v\n", ip, ns.Claimed[ip]) // nolint: errcheck
+		}
+		for _, ip := range ns.OrphanRoutes {
+			fmt.Fprintf(w, "\t%v\t(orphan route)\n", ip) // nolint: errcheck
+		}
+		for _, m := range ns.OrphanMacvlans {
+			fmt.Fprintf(w, "\t%v\t(orphan macvlan)\n", m) // nolint: errcheck
+		}
+		fmt.Fprintln(w) // nolint: errcheck
+	}
+
+	if len(st.OrphanRoutes) > 0 {
+		fmt.Fprintf(w, "ROUTES NOT ON ANY NETWORK\n%v\n", strings.Join(st.OrphanRoutes, "\n")) // nolint: errcheck
+	}
+	return w.Flush()
+}
+
+func list(s []string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Join(s, ",")
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -43,3 +43,26 @@ func GetEnvDurWithDefault(val, opt string, def time.Duration) time.Duration { //
 	}
 	return ei
 }
+
+// GetEnvStringWithDefault gets value, prioritizing first opt, if it is not empty, then the environment variable specified by val, and lastly the default.
+func GetEnvStringWithDefault(val, opt, def string) string { //nolint: unparam
+	e := getEnvOpt(val, opt)
+	if e == "" {
+		return def
+	}
+	return e
+}
+
+// GetEnvBoolWithDefault gets value, prioritizing first opt, if it is not empty, then the environment variable specified by val, and lastly the default.
+func GetEnvBoolWithDefault(val, opt string, def bool) bool { //nolint: unparam
+	e := getEnvOpt(val, opt)
+	if e == "" {
+		return def
+	}
+	eb, err := strconv.ParseBool(e)
+	if err != nil {
+		log.WithField("string", e).WithError(err).Warnf("failed to convert string to bool, using default")
+		return def
+	}
+	return eb
+}
@@ -0,0 +1,252 @@
+package host
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+// Address allocation strategies
+const (
+	// AllocRandom picks random addresses
+	AllocRandom = "random"
+	// AllocSequential picks the lowest address without a route
+	AllocSequential = "sequential"
+	// AllocHash picks an address derived from Allocation.Key, probing linearly from there
+	AllocHash = "hash"
+)
+
+var _ = options.Register(
+	options.Option{Name: "allocstrategy", Kind: options.String, Usage: "how addresses are picked, hash derives them from the mac address requested with --mac-address and refuses endpoints without one", Values: []string{AllocRandom, AllocSequential, AllocHash}},
+	options.Option{Name: "excludefirst", Kind: options.Int, Usage: "number of addresses at the start of the subnet never handed out", Min: 0, Max: math.MaxInt32},
+	options.Option{Name: "excludelast", Kind: options.Int, Usage: "number of addresses at the end of the subnet never handed out", Min: 0, Max: math.MaxInt32},
+	options.Option{Name: "exclude", Kind: options.String, Usage: "comma separated addresses and start-end ranges never handed out", Check: checkExclude},
+)
+
+func checkExclude(v string) error {
+	_, err := ParseExclude(v)
+	return err
+}
+
+// Allocation describes how SelectAddress picks addresses
+type Allocation struct {
+	Strategy string
+	// Key is the mac address requested for the endpoint, the hash strategy needs it unless an address is requested
+	Key string
+	// ExcludeFirst and ExcludeLast are the number of addresses at the start and end of the subnet never handed out
+	ExcludeFirst int
+	ExcludeLast  int
+	// Exclude are reserved ranges never handed out, and refused when requested
+	Exclude []AddrRange
+	// Range limits automatic allocation to part of the subnet, requested addresses may still be anywhere in the subnet
+	Range *net.IPNet
+}
+
+// AddrRange is an inclusive range of addresses
+type AddrRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+// Contains returns true if ip is in the range
+func (r AddrRange) Contains(ip net.IP) bool {
+	return bytes.Compare(ip.To16(), r.Start.To16()) >= 0 && bytes.Compare(ip.To16(), r.End.To16()) <= 0
+}
+
+func (r AddrRange) String() string {
+	if r.Start.Equal(r.End) {
+		return r.Start.String()
+	}
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// ParseExclude parses a comma separated list of addresses and start-end address ranges
+func ParseExclude(s string) ([]AddrRange, error) {
+	var ret []AddrRange
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		se := strings.SplitN(e, "-", 2)
+		r := AddrRange{Start: net.ParseIP(strings.TrimSpace(se[0]))}
+		r.End = r.Start
+		if len(se) == 2 {
+			r.End = net.ParseIP(strings.TrimSpace(se[1]))
+		}
+		if r.Start == nil || r.End == nil {
+			return nil, fmt.Errorf("invalid excluded address or range %q", e)
+		}
+		if (r.Start.To4() == nil) != (r.End.To4() == nil) {
+			return nil, fmt.Errorf("excluded range %q mixes address families", e)
+		}
+		if bytes.Compare(r.Start.To16(), r.End.To16()) > 0 {
+			return nil, fmt.Errorf("excluded range %q ends before it starts", e)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// excluded returns the reserved range ip is in, or nil
+func (a *Allocation) excluded(ip net.IP) *AddrRange {
+	for i := range a.Exclude {
+		if a.Exclude[i].Contains(ip) {
+			return &a.Exclude[i]
+		}
+	}
+	return nil
+}
+
+// ValidAllocStrategy returns an error if s is not a known allocation strategy
+func ValidAllocStrategy(s string) error {
+	switch s {
+	case AllocRandom, AllocSequential, AllocHash:
+		return nil
+	}
+	return fmt.Errorf("unknown allocation strategy %q, must be one of %v, %v or %v", s, AllocRandom, AllocSequential, AllocHash)
+}
+
+var (
+	errNoFreeAddress = fmt.Errorf("no free addresses")
+	errNoHashKey     = fmt.Errorf("no key for the hash allocation strategy")
+)
+
+// candidate returns the next address to try claiming in sn, skipping addresses in tried and addresses routed in table
+// it may return nil if the strategy could not come up with an address this time
+func (a *Allocation) candidate(sn *net.IPNet, table int, tried map[string]struct{}) (net.IP, error) {
+	// the first and last addresses are excluded from the subnet, not the range
+	lo, hi := subnetBounds(sn)
+	lo.Add(lo, big.NewInt(int64(a.ExcludeFirst)))
+	hi.Sub(hi, big.NewInt(int64(a.ExcludeLast)))
+	if a.Range != nil {
+		rlo, rhi := subnetBounds(a.Range)
+		if rlo.Cmp(lo) > 0 {
+			lo = rlo
+		}
+		if rhi.Cmp(hi) < 0 {
+			hi = rhi
+		}
+	}
+	size := new(big.Int).Sub(hi, lo)
+	size.Add(size, big.NewInt(1))
+	if size.Sign() <= 0 {
+		return nil, errNoFreeAddress
+	}
+	l := net.IPv6len
+	if sn.IP.To4() != nil {
+		l = net.IPv4len
+	}
+
+	if a.Strategy == AllocRandom {
+		off, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return nil, err
+		}
+		ip := IntToIP(off.Add(off, lo), l)
+		if _, ok := tried[ip.String()]; ok {
+			return nil, nil
+		}
+		if a.excluded(ip) != nil {
+			return nil, nil
+		}
+		return ip, nil
+	}
+
+	taken, err := routedAddresses(sn, table)
+	if err != nil {
+		return nil, err
+	}
+
+	start := new(big.Int)
+	if a.Strategy == AllocHash {
+		h := fnv.New64a()
+		h.Write([]byte(a.Key)) // nolint: errcheck
+		start.SetUint64(h.Sum64())
+		start.Mod(start, size)
+	}
+
+	// probe linearly from start, wrapping around to the beginning of the subnet
+	off := new(big.Int).Set(start)
+	one := big.NewInt(1)
+	for {
+		ip := IntToIP(new(big.Int).Add(lo, off), l)
+		k := ip.String()
+		_, isTaken := taken[k]
+		_, isTried := tried[k]
+		if !isTaken && !isTried && a.excluded(ip) == nil {
+			return ip, nil
+		}
+
+		off.Add(off, one)
+		if off.Cmp(size) >= 0 {
+			off.SetInt64(0)
+		}
+		if off.Cmp(start) == 0 {
+			return nil, errNoFreeAddress
+		}
+	}
+}
+
+// routedAddresses returns the addresses in sn which there is a host route to in table
+func routedAddresses(sn *net.IPNet, table int) (map[string]struct{}, error) {
+	fam := netlink.FAMILY_V4
+	if sn.IP.To4() == nil {
+		fam = netlink.FAMILY_V6
+	}
+	routes, err := kernel.Get().RouteListFiltered(fam, &netlink.Route{Table: routeTable(table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]struct{})
+	for _, r := range routes {
+		if r.Dst == nil || !sn.Contains(r.Dst.IP) {
+			continue
+		}
+		if ones, bits := r.Dst.Mask.Size(); ones != bits {
+			continue
+		}
+		ret[r.Dst.IP.String()] = struct{}{}
+	}
+	return ret, nil
+}
+
+// subnetBounds returns the first and last address of sn as integers
+func subnetBounds(sn *net.IPNet) (*big.Int, *big.Int) {
+	lo := IPToInt(sn.IP.Mask(sn.Mask))
+	ones, bits := sn.Mask.Size()
+	hi := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	hi.Add(hi, lo)
+	hi.Sub(hi, big.NewInt(1))
+	return lo, hi
+}
+
+// IPToInt returns ip as an integer, ipv4 addresses are 4 bytes long
+func IPToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+// IntToIP returns i as an address of length l, which is 16 unless it is 4
+func IntToIP(i *big.Int, l int) net.IP {
+	if l != net.IPv4len {
+		l = net.IPv6len
+	}
+	b := i.Bytes()
+	ip := make(net.IP, l)
+	copy(ip[l-len(b):], b)
+	return ip
+}
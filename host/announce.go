@@ -0,0 +1,55 @@
+package host
+
+import (
+	"net"
+	"sync"
+)
+
+// Announcer is notified when this host claims or releases a route, so it can be advertised to other hosts
+type Announcer interface {
+	Announce(dst *net.IPNet)
+	Withdraw(dst *net.IPNet)
+}
+
+var (
+	announcer  Announcer
+	announcerL sync.RWMutex
+)
+
+// SetAnnouncer sets the announcer notified of claimed routes, nil to disable
+func SetAnnouncer(a Announcer) {
+	announcerL.Lock()
+	defer announcerL.Unlock()
+	announcer = a
+}
+
+// announce and withdraw only pass on routes in the main table, other address spaces are not advertised
+func (hi *Interface) announce(dst *net.IPNet) {
+	if hi.table != MainTable {
+		return
+	}
+	announce(dst)
+}
+
+func (hi *Interface) withdraw(dst *net.IPNet) {
+	if hi.table != MainTable {
+		return
+	}
+	withdraw(dst)
+}
+
+func announce(dst *net.IPNet) {
+	announcerL.RLock()
+	defer announcerL.RUnlock()
+	if announcer != nil {
+		announcer.Announce(dst)
+	}
+}
+
+func withdraw(dst *net.IPNet) {
+	announcerL.RLock()
+	defer announcerL.RUnlock()
+	if announcer != nil {
+		announcer.Withdraw(dst)
+	}
+}
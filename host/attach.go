@@ -0,0 +1,176 @@
+package host
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/ipvlan"
+	"github.com/TrilliumIT/vxrouter/macvlan"
+	"github.com/TrilliumIT/vxrouter/options"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+// Container attachment modes
+const (
+	// AttachMacvlan attaches the host and containers with bridge mode macvlans
+	AttachMacvlan = "macvlan"
+	// AttachIpvlanL2 attaches the host and containers with l2 mode ipvlans, which share the mac address of the vxlan
+	AttachIpvlanL2 = "ipvlan-l2"
+	// AttachIpvlanL3 attaches the host and containers with l3 mode ipvlans, which share the mac address of the vxlan
+	AttachIpvlanL3 = "ipvlan-l3"
+)
+
+var _ = options.Register(
+	options.Option{Name: "attach", Kind: options.String, Usage: "how containers are attached to the vxlan", Values: []string{AttachMacvlan, AttachIpvlanL2, AttachIpvlanL3}},
+	options.Option{Name: "macvlanmode", Kind: options.String, Usage: "mode of the host and container macvlans", Values: []string{"bridge", "private", "vepa"}},
+)
+
+// macvlanModes are the macvlan modes, by the name of the macvlanmode network option
+// passthru allows only one macvlan on the vxlan, and source macvlans receive nothing without a list of source macs,
+// so neither can carry both the host macvlan and containers
+var macvlanModes = map[string]netlink.MacvlanMode{
+	"bridge":  netlink.MACVLAN_MODE_BRIDGE,
+	"private": netlink.MACVLAN_MODE_PRIVATE,
+	"vepa":    netlink.MACVLAN_MODE_VEPA,
+}
+
+// ValidMacvlanMode returns an error if s is not a known macvlan mode
+func ValidMacvlanMode(s string) error {
+	if _, ok := macvlanModes[s]; ok {
+		return nil
+	}
+	return fmt.Errorf("unknown macvlan mode %q, must be one of bridge, private or vepa", s)
+}
+
+// macvlanModeFromOpts returns the macvlan mode of a network
+func macvlanModeFromOpts(opts map[string]string) (netlink.MacvlanMode, error) {
+	s := vxrouter.GetEnvStringWithDefault(vxrouter.EnvPrefix+"macvlanmode", opts["macvlanmode"], "bridge")
+	if err := ValidMacvlanMode(s); err != nil {
+		return 0, err
+	}
+	return macvlanModes[s], nil
+}
+
+func macvlanModeName(mode netlink.MacvlanMode) string {
+	for n, m := range macvlanModes {
+		if m == mode {
+			return n
+		}
+	}
+	return fmt.Sprintf("%v", mode)
+}
+
+// ValidAttach returns an error if s is not a known attachment mode
+func ValidAttach(s string) error {
+	switch s {
+	case AttachMacvlan, AttachIpvlanL2, AttachIpvlanL3:
+		return nil
+	}
+	return fmt.Errorf("unknown attachment mode %q, must be one of %v, %v or %v", s, AttachMacvlan, AttachIpvlanL2, AttachIpvlanL3)
+}
+
+// attachFromOpts returns the attachment mode of a network
+func attachFromOpts(opts map[string]string) string {
+	return vxrouter.GetEnvStringWithDefault(vxrouter.EnvPrefix+"attach", opts["attach"], AttachMacvlan)
+}
+
+// HasOwnMAC returns true if containers attached with the attachment mode in opts have their own mac address
+// ipvlans share the mac address of the vxlan
+func HasOwnMAC(opts map[string]string) bool {
+	return attachFromOpts(opts) == AttachMacvlan
+}
+
+// slave is a macvlan or ipvlan on the vxlan, used for the host gateway and containers
+type slave interface {
+	Name() string
+	GetIndex() int
+	GetParentIndex() int
+	AddAddress(addr *net.IPNet) error
+	GetAddresses() ([]*net.IPNet, error)
+	HasAddress(addr *net.IPNet) bool
+}
+
+// slaveFromName and slaveFromLinkIndex never return a nil *Macvlan or *Ipvlan in a non-nil slave
+func slaveFromName(name string) (slave, error) {
+	if m, err := macvlan.FromName(name); err == nil {
+		return m, nil
+	}
+	i, err := ipvlan.FromName(name)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func slaveFromLinkIndex(li int) (slave, error) {
+	if m, err := macvlan.FromLinkIndex(li); err == nil {
+		return m, nil
+	}
+	i, err := ipvlan.FromLinkIndex(li)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// slaveAttach returns the attachment mode of an existing slave
+func slaveAttach(s slave) (string, error) {
+	i, ok := s.(*ipvlan.Ipvlan)
+	if !ok {
+		return AttachMacvlan, nil
+	}
+	mode, err := i.Mode()
+	if err != nil {
+		return "", err
+	}
+	if mode == netlink.IPVLAN_MODE_L3 {
+		return AttachIpvlanL3, nil
+	}
+	return AttachIpvlanL2, nil
+}
+
+// slaveMacvlanMode returns the macvlan mode of an existing slave, ipvlans are reported as bridge mode
+func slaveMacvlanMode(s slave) (netlink.MacvlanMode, error) {
+	m, ok := s.(*macvlan.Macvlan)
+	if !ok {
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	}
+	return m.Mode()
+}
+
+// createSlave creates a slave of vxl for the attachment mode
+// mvlMode and mac are only used by macvlans, a nil mac gets a random address
+func createSlave(vxl *vxlan.Vxlan, name, attach string, mvlMode netlink.MacvlanMode, mac net.HardwareAddr) (slave, error) {
+	var mode netlink.IPVlanMode
+	switch attach {
+	case AttachMacvlan:
+		m, err := vxl.CreateMacvlan(name, mvlMode, mac)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case AttachIpvlanL2:
+		mode = netlink.IPVLAN_MODE_L2
+	case AttachIpvlanL3:
+		mode = netlink.IPVLAN_MODE_L3
+	default:
+		return nil, ValidAttach(attach)
+	}
+
+	i, err := vxl.CreateIpvlan(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// deleteSlave deletes the slave of vxl called name, of the same kind as the host slave hs
+func deleteSlave(vxl *vxlan.Vxlan, hs slave, name string) error {
+	if _, ok := hs.(*ipvlan.Ipvlan); ok {
+		return vxl.DeleteIpvlan(name)
+	}
+	return vxl.DeleteMacvlan(name)
+}
@@ -0,0 +1,132 @@
+package host
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+)
+
+// Conflict is a route to an address claimed by this host, which was installed by someone else
+type Conflict struct {
+	IP      net.IP
+	Network string
+	Route   netlink.Route
+}
+
+// WatchConflicts subscribes to route changes and sends a Conflict to conflicts whenever a second route shows up
+// to an address claimed by this host. Conflicts which already exist are sent first. It returns when done is closed.
+func WatchConflicts(done <-chan struct{}, conflicts chan<- *Conflict) error {
+	log := log.WithField("Func", "WatchConflicts()")
+	log.Debug()
+
+	updates := make(chan netlink.RouteUpdate)
+	err := kernel.Get().RouteSubscribe(updates, done)
+	if err != nil {
+		log.WithError(err).Error("failed to subscribe to routes")
+		return err
+	}
+
+	claimed, err := AllVxRoutes()
+	if err != nil {
+		return err
+	}
+	for _, a := range claimed {
+		var routes []netlink.Route
+		routes, err = kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: a}, netlink.RT_FILTER_DST)
+		if err != nil {
+			log.WithError(err).Error("failed to get routes")
+			return err
+		}
+		for _, r := range routes {
+			if c := conflictFor(r); c != nil {
+				conflicts <- c
+			}
+		}
+	}
+
+	for {
+		select {
+		case u, ok := <-updates:
+			if !ok {
+				return fmt.Errorf("route subscription closed")
+			}
+			if u.Type != syscall.RTM_NEWROUTE {
+				continue
+			}
+			if c := conflictFor(u.Route); c != nil {
+				conflicts <- c
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// conflictFor returns a Conflict if r is a foreign host route to an address claimed by this host
+func conflictFor(r netlink.Route) *Conflict {
+	if r.Dst == nil || r.Protocol == routeProto {
+		return nil
+	}
+	if r.Table != 0 && r.Table != syscall.RT_TABLE_MAIN {
+		return nil
+	}
+	if ones, bits := r.Dst.Mask.Size(); ones != bits {
+		return nil
+	}
+
+	local, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: r.Dst, Protocol: routeProto}, netlink.RT_FILTER_DST|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		log.WithError(err).Error("failed to get routes")
+		return nil
+	}
+	if len(local) == 0 {
+		return nil
+	}
+
+	c := &Conflict{IP: r.Dst.IP, Route: r}
+	if m, err := slaveFromLinkIndex(local[0].LinkIndex); err == nil {
+		c.Network = strings.TrimPrefix(m.Name(), "hmvl_")
+	}
+	return c
+}
+
+// Exists returns true if both the local claim and the conflicting route are still in the routing table
+func (c *Conflict) Exists() (bool, error) {
+	n, err := VxroutesTo(c.IP, MainTable)
+	if err != nil || n == 0 {
+		return false, err
+	}
+	routes, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: c.Route.Dst}, netlink.RT_FILTER_DST)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range routes {
+		if r.Protocol == c.Route.Protocol && r.LinkIndex == c.Route.LinkIndex && r.Gw.Equal(c.Route.Gw) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LocalAddress returns the address this host uses to reach the gateway of the conflicting route
+func (c *Conflict) LocalAddress() (net.IP, error) {
+	if c.Route.Gw == nil {
+		return nil, fmt.Errorf("conflicting route has no gateway")
+	}
+	routes, err := kernel.Get().RouteGet(c.Route.Gw)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r.Src != nil {
+			return r.Src, nil
+		}
+	}
+	return nil, fmt.Errorf("no source address found towards %v", c.Route.Gw)
+}
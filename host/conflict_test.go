@@ -0,0 +1,99 @@
+package host
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestWatchConflicts(t *testing.T) {
+	k, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "cnfl", nil)
+	sn := mustCIDR(t, "10.1.0.0/24")
+	alloc := &Allocation{Strategy: AllocSequential}
+	claim := func(ip string) {
+		if _, err := hi.SelectAddress(sn, net.ParseIP(ip), 0, time.Second, alloc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	foreign := func(r *netlink.Route) {
+		if err := k.RouteAdd(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the other host's gateway is reached from 192.0.2.10
+	foreign(&netlink.Route{Dst: mustCIDR(t, "192.0.2.0/24"), Src: net.ParseIP("192.0.2.10")})
+	route := func(ip string) *netlink.Route {
+		return &netlink.Route{Dst: netlink.NewIPNet(net.ParseIP(ip)), Gw: net.ParseIP("192.0.2.20"), Protocol: 186, Priority: 32}
+	}
+
+	// a conflict which exists before watching is sent first
+	claim("10.1.0.5")
+	foreign(route("10.1.0.5"))
+
+	conflicts := make(chan *Conflict)
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() { errc <- WatchConflicts(done, conflicts) }()
+	next := func() *Conflict {
+		select {
+		case c := <-conflicts:
+			return c
+		case <-time.After(time.Second):
+			t.Fatal("no conflict sent")
+		}
+		return nil
+	}
+
+	c := next()
+	if !c.IP.Equal(net.ParseIP("10.1.0.5")) || c.Network != "cnfl" || !c.Route.Gw.Equal(net.ParseIP("192.0.2.20")) {
+		t.Errorf("expected a conflict on 10.1.0.5 in cnfl via 192.0.2.20, got %v in %v via %v", c.IP, c.Network, c.Route.Gw)
+	}
+	if ok, err := c.Exists(); !ok || err != nil {
+		t.Errorf("expected the conflict to exist, got %v %v", ok, err)
+	}
+	if local, err := c.LocalAddress(); err != nil || !local.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("expected local address 192.0.2.10, got %v %v", local, err)
+	}
+
+	// the claim itself, unclaimed addresses, other tables and routes which are not host routes are not conflicts
+	// notifications are handled in order, so the next conflict must be the last one
+	claim("10.1.0.6")
+	foreign(route("10.1.0.7"))
+	r := route("10.1.0.6")
+	r.Table = 200
+	foreign(r)
+	foreign(&netlink.Route{Dst: mustCIDR(t, "10.1.0.0/30"), Gw: net.ParseIP("192.0.2.20"), Protocol: 186})
+	foreign(route("10.1.0.6"))
+	c = next()
+	if !c.IP.Equal(net.ParseIP("10.1.0.6")) || c.Route.Table == 200 {
+		t.Errorf("expected a conflict on 10.1.0.6 in the main table, got %v in %v", c.IP, c.Route.Table)
+	}
+
+	// once the other host withdraws it's route the conflict is gone
+	if err := k.RouteDel(route("10.1.0.6")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Exists(); ok || err != nil {
+		t.Errorf("expected the conflict to be gone, got %v %v", ok, err)
+	}
+
+	c.Route.Gw = nil
+	if _, err := c.LocalAddress(); err == nil {
+		t.Errorf("expected an error tie-breaking a route without a gateway")
+	}
+
+	close(done)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected WatchConflicts to return nil once done, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("WatchConflicts did not return once done")
+	}
+}
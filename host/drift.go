@@ -0,0 +1,228 @@
+package host
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/TrilliumIT/vxrouter/metrics"
+)
+
+// Drift policies, for vxlans whose attributes no longer match their network's options
+// attributes which can be changed on a live vxlan are always changed in place
+const (
+	// DriftRecreate recreates the vxlan once no containers on the host use it, until then the old vxlan is kept
+	DriftRecreate = "recreate"
+	// DriftError refuses to use the vxlan until it is deleted
+	DriftError = "error"
+)
+
+var driftPolicy = DriftRecreate
+
+// driftRecheck is how long a vxlan is trusted to match the options it was compared to, before comparing it again
+// the options don't change without a new hash, but the selected underlay may
+const driftRecheck = time.Minute
+
+// driftVerdict is the result of comparing a vxlan to the options with hash opts
+// the vxlan is identified by the index of it's host macvlan, which is recreated along with it
+type driftVerdict struct {
+	index   int
+	opts    uint64
+	checked time.Time
+	drifted bool
+	// warned is set once the containers blocking the vxlan from being recreated are logged
+	warned bool
+}
+
+var (
+	driftCache  = make(map[string]*driftVerdict)
+	driftCacheL sync.Mutex
+)
+
+// OwnerLookup returns the ids of the containers and endpoints on network name using the claimed addresses or container
+// macvlans, so warnings can name them
+type OwnerLookup func(name string, claimed []net.IP, macvlans []string) (containers, endpoints []string)
+
+var (
+	ownerLookup  OwnerLookup
+	ownerLookupL sync.RWMutex
+)
+
+// SetOwnerLookup sets the lookup naming the containers on a network, nil to only log addresses and interfaces
+func SetOwnerLookup(f OwnerLookup) {
+	ownerLookupL.Lock()
+	defer ownerLookupL.Unlock()
+	ownerLookup = f
+}
+
+func lookupOwners(name string, claimed []net.IP, macvlans []string) ([]string, []string) {
+	ownerLookupL.RLock()
+	defer ownerLookupL.RUnlock()
+	if ownerLookup == nil {
+		return nil, nil
+	}
+	return ownerLookup(name, claimed, macvlans)
+}
+
+// optsHash returns a hash of the options, independent of their order
+func optsHash(opts map[string]string) uint64 {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	for _, k := range keys {
+		h.Write([]byte(k + "=" + opts[k] + "\x00")) // nolint: errcheck
+	}
+	return h.Sum64()
+}
+
+// cachedVerdict returns whether the vxlan of hi had drifted from the options with hash opts
+// ok is false if there is no verdict for them, or it's older than driftRecheck
+func (hi *Interface) cachedVerdict(opts uint64) (drifted, ok bool) {
+	if hi.mvl == nil {
+		return false, false
+	}
+	driftCacheL.Lock()
+	defer driftCacheL.Unlock()
+	v, found := driftCache[hi.name]
+	if !found || v.index != hi.mvl.GetIndex() || v.opts != opts || time.Since(v.checked) >= driftRecheck {
+		return false, false
+	}
+	return v.drifted, true
+}
+
+// cacheVerdict records whether the vxlan of hi has drifted from the options with hash opts
+// whether the blocking containers were logged is kept as long as the vxlan and options are the same
+func (hi *Interface) cacheVerdict(opts uint64, drifted bool) {
+	if hi.mvl == nil {
+		return
+	}
+	driftCacheL.Lock()
+	defer driftCacheL.Unlock()
+	v, ok := driftCache[hi.name]
+	if !ok || v.index != hi.mvl.GetIndex() || v.opts != opts {
+		v = &driftVerdict{index: hi.mvl.GetIndex(), opts: opts}
+		driftCache[hi.name] = v
+	}
+	v.drifted = drifted
+	v.checked = time.Now()
+}
+
+// firstWarning returns true the first time it's called for the vxlan of hi and the options with hash opts
+func (hi *Interface) firstWarning(opts uint64) bool {
+	driftCacheL.Lock()
+	defer driftCacheL.Unlock()
+	v, ok := driftCache[hi.name]
+	if !ok || v.index != hi.mvl.GetIndex() || v.opts != opts {
+		return true
+	}
+	first := !v.warned
+	v.warned = true
+	return first
+}
+
+func forgetVerdict(name string) {
+	driftCacheL.Lock()
+	defer driftCacheL.Unlock()
+	delete(driftCache, name)
+}
+
+// ValidDriftPolicy returns an error if s is not a known drift policy
+func ValidDriftPolicy(s string) error {
+	switch s {
+	case DriftRecreate, DriftError:
+		return nil
+	}
+	return fmt.Errorf("unknown drift policy %q, must be one of %v or %v", s, DriftRecreate, DriftError)
+}
+
+// SetDriftPolicy sets how vxlans with attributes which can't be changed in place are handled
+func SetDriftPolicy(p string) {
+	driftPolicy = p
+}
+
+// Drifted returns true if the vxlan's attributes differ from opts
+// the verdict is cached for the vxlan and options, and only compared to the vxlan again after driftRecheck
+func (hi *Interface) Drifted(opts map[string]string) (bool, error) {
+	h := optsHash(opts)
+	if drifted, ok := hi.cachedVerdict(h); ok {
+		return drifted, nil
+	}
+	drifted, err := hi.vxl.Drift(opts)
+	if err != nil {
+		return false, err
+	}
+	hi.cacheVerdict(h, drifted)
+	return drifted, nil
+}
+
+// reconfigure changes the vxlan's attributes in place, and deletes it if it must be recreated to apply the rest
+// it returns true if the vxlan was deleted. Caller must hold the interface lock
+func (hi *Interface) reconfigure(opts map[string]string) (bool, error) {
+	log := hi.log.WithField("Func", "reconfigure()")
+	log.Debug()
+
+	h := optsHash(opts)
+	recreate, err := hi.vxl.Reconfigure(opts)
+	if err != nil {
+		return false, err
+	}
+	// anything else was changed in place
+	hi.cacheVerdict(h, recreate)
+	if !recreate {
+		return false, nil
+	}
+
+	if driftPolicy == DriftError {
+		err = fmt.Errorf("vxlan interface already exists with wrong attributes")
+		log.WithError(err).Error()
+		return false, err
+	}
+
+	// container macvlans can't be moved to another vxlan, they are deleted with it
+	if hi.mvl != nil {
+		var claimed []net.IP
+		routes, err := hi.Routes() // nolint: vetshadow
+		if err != nil {
+			return false, err
+		}
+		for _, r := range routes {
+			claimed = append(claimed, r.IP)
+		}
+		slaves, err := hi.ContainerMacvlans()
+		if err != nil {
+			return false, err
+		}
+		if len(claimed) > 0 || len(slaves) > 0 {
+			if !hi.firstWarning(h) {
+				log.Debug("vxlan options changed, waiting for the containers on this network to be restarted")
+				return false, nil
+			}
+			ctrs, eps := lookupOwners(hi.name, claimed, slaves)
+			if len(ctrs) == 0 && len(eps) == 0 {
+				log = log.WithField("claimed", claimed).WithField("macvlans", slaves)
+			} else {
+				log = log.WithField("containers", ctrs).WithField("endpoints", eps)
+			}
+			log.Warn("vxlan options changed, restart the containers on this network to apply them")
+			return false, nil
+		}
+	}
+
+	log.Info("recreating vxlan to apply changed options")
+	hi.WithdrawEVPN()
+	err = hi.vxl.Delete()
+	if err != nil {
+		log.WithError(err).Error("failed to delete vxlan")
+		return false, err
+	}
+	metrics.InterfacesRecreated.WithLabelValues(hi.name).Inc()
+	forgetVerdict(hi.name)
+	hi.vxl, hi.mvl = nil, nil
+	return true, nil
+}
@@ -0,0 +1,122 @@
+package host
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+)
+
+func TestDriftedCached(t *testing.T) {
+	k, restore := useFakeKernel(t)
+	defer restore()
+
+	opts := map[string]string{"vxlanid": "100"}
+	hi := testInterface(t, "drfc", opts)
+	if drifted, err := hi.Drifted(opts); err != nil || drifted {
+		t.Fatalf("expected a new vxlan to match it's options, got %v %v", drifted, err)
+	}
+
+	vxl, err := k.LinkByName("drfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k.LinkSetMTU(vxl, 1400); err != nil {
+		t.Fatal(err)
+	}
+	// the verdict for the same options is not compared to the vxlan again
+	if drifted, _ := hi.Drifted(opts); drifted {
+		t.Errorf("expected the cached verdict")
+	}
+	// other options are
+	if drifted, _ := hi.Drifted(map[string]string{"vxlanid": "100", "vxlanmtu": "1450"}); !drifted {
+		t.Errorf("expected the changed mtu to be noticed with other options")
+	}
+}
+
+func TestDriftWarnOnce(t *testing.T) {
+	_, restore := useFakeKernel(t)
+	defer restore()
+
+	var lookups int
+	SetOwnerLookup(func(name string, claimed []net.IP, macvlans []string) ([]string, []string) {
+		lookups++
+		if name != "drfw" || len(claimed) != 1 || !claimed[0].Equal(net.ParseIP("10.1.0.9")) {
+			t.Errorf("unexpected lookup of %v %v %v", name, claimed, macvlans)
+		}
+		return []string{"ctr1"}, []string{"ep1"}
+	})
+	defer SetOwnerLookup(nil)
+
+	hi := testInterface(t, "drfw", nil)
+	a, err := hi.SelectAddress(mustCIDR(t, "10.1.0.0/24"), net.ParseIP("10.1.0.9"), 0, time.Second, &Allocation{Strategy: AllocRandom})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the vxlan is kept while the address is claimed, and the containers using it are only named once
+	for i := 0; i < 3; i++ {
+		testInterface(t, "drfw", map[string]string{"vxlanid": "101"})
+	}
+	if lookups != 1 {
+		t.Errorf("expected the containers to be looked up once, got %v", lookups)
+	}
+	vxl, err := kernel.Get().LinkByName("drfw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vxl.(*netlink.Vxlan).VxlanId != 100 {
+		t.Errorf("vxlan recreated while an address is claimed through it")
+	}
+
+	if err = hi.DelRoute(a.IP); err != nil {
+		t.Fatal(err)
+	}
+	testInterface(t, "drfw", map[string]string{"vxlanid": "101"})
+	vxl, err = kernel.Get().LinkByName("drfw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vxl.(*netlink.Vxlan).VxlanId != 101 {
+		t.Errorf("vxlan not recreated once unused, got id %v", vxl.(*netlink.Vxlan).VxlanId)
+	}
+}
+
+func TestUnderlayNotCached(t *testing.T) {
+	k, restore := useFakeKernel(t)
+	defer restore()
+
+	addUnderlay := func(name, addr string) netlink.Link {
+		l := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: 1500}}
+		if err := k.LinkAdd(l); err != nil {
+			t.Fatal(err)
+		}
+		if err := k.AddrAdd(l, &netlink.Addr{IPNet: mustCIDR(t, addr)}); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	eth1 := addUnderlay("eth1", "198.51.100.5/24")
+
+	opts := map[string]string{"vxlanid": "100", "underlay": "198.51.100.0/24"}
+	hi := testInterface(t, "drfu", opts)
+	if len(opts) != 2 {
+		t.Errorf("the network's options were changed to %v", opts)
+	}
+	dev, src, err := hi.Underlay()
+	if err != nil || dev != "eth1" || !src.Equal(net.ParseIP("198.51.100.5")) {
+		t.Fatalf("expected the vxlan on eth1 198.51.100.5, got %v %v %v", dev, src, err)
+	}
+
+	// the underlay is selected again when comparing the vxlan to the options
+	addUnderlay("eth2", "198.51.100.6/24")
+	if err = k.LinkDel(eth1); err != nil {
+		t.Fatal(err)
+	}
+	if drifted, err := hi.vxl.Drift(opts); err != nil || !drifted {
+		t.Errorf("expected the vxlan to have drifted from the new underlay, got %v %v", drifted, err)
+	}
+}
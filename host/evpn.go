@@ -0,0 +1,101 @@
+package host
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/vxlan"
+)
+
+// EVPNAnnouncer advertises the mac addresses behind a vxlan to other hosts, and programs the vxlan with the ones they advertise
+type EVPNAnnouncer interface {
+	SyncVNI(vxl *vxlan.Vxlan, local []vxlan.MACIP) error
+	WithdrawVNI(vni int)
+}
+
+var (
+	evpnAnnouncer  EVPNAnnouncer
+	evpnAnnouncerL sync.RWMutex
+)
+
+// SetEVPNAnnouncer sets the announcer of the mac addresses on evpn networks, nil to disable
+func SetEVPNAnnouncer(a EVPNAnnouncer) {
+	evpnAnnouncerL.Lock()
+	defer evpnAnnouncerL.Unlock()
+	evpnAnnouncer = a
+}
+
+// SyncEVPN advertises the host macvlan and the containers on an evpn network, it does nothing on other networks
+// containers attached with ipvlans share the mac address of the host interface, so theirs is replaced
+func (hi *Interface) SyncEVPN(opts map[string]string, containers []vxlan.MACIP) error {
+	if !vxlan.EVPN(opts) {
+		return nil
+	}
+	log := hi.log.WithField("Func", "SyncEVPN()")
+	log.Debug()
+
+	evpnAnnouncerL.RLock()
+	defer evpnAnnouncerL.RUnlock()
+	if evpnAnnouncer == nil {
+		return fmt.Errorf("evpn networks require the bgp speaker")
+	}
+
+	hi.l.rlock()
+	defer hi.l.runlock()
+
+	link, err := kernel.Get().LinkByIndex(hi.mvl.GetIndex())
+	if err != nil {
+		log.WithError(err).Debug("failed to get host macvlan")
+		return err
+	}
+	mac := link.Attrs().HardwareAddr
+	addrs, err := hi.mvl.GetAddresses()
+	if err != nil {
+		log.WithError(err).Debug("failed to get host macvlan addresses")
+		return err
+	}
+
+	local := []vxlan.MACIP{{MAC: mac}}
+	for _, a := range addrs {
+		local = append(local, vxlan.MACIP{MAC: mac, IP: a.IP})
+	}
+	ownMAC := HasOwnMAC(opts)
+	for _, c := range containers {
+		if !ownMAC {
+			c.MAC = mac
+		}
+		local = append(local, c)
+	}
+	return evpnAnnouncer.SyncVNI(hi.vxl, local)
+}
+
+// WithdrawEVPN stops advertising the mac addresses behind the vxlan, before it is deleted
+func (hi *Interface) WithdrawEVPN() {
+	vni, err := hi.vxl.VNI()
+	if err != nil {
+		hi.log.WithError(err).Debug("failed to get vni")
+		return
+	}
+	withdrawVNI(vni)
+}
+
+// WithdrawNetworkEVPN stops advertising the mac addresses of an evpn network which has no host interface
+func WithdrawNetworkEVPN(opts map[string]string) {
+	if !vxlan.EVPN(opts) {
+		return
+	}
+	vni, err := vxlan.ParseVxlanID(opts["vxlanid"])
+	if err != nil {
+		return
+	}
+	withdrawVNI(vni)
+}
+
+func withdrawVNI(vni int) {
+	evpnAnnouncerL.RLock()
+	defer evpnAnnouncerL.RUnlock()
+	if evpnAnnouncer != nil {
+		evpnAnnouncer.WithdrawVNI(vni)
+	}
+}
@@ -2,9 +2,12 @@ package host
 
 import (
 	"net"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
 )
 
 func getIPNets(address net.IP, subnet *net.IPNet) (*net.IPNet, *net.IPNet) {
@@ -31,8 +34,8 @@ func getIPNets(address net.IP, subnet *net.IPNet) (*net.IPNet, *net.IPNet) {
 	return sna, a
 }
 
-func numRoutesTo(ipnet *net.IPNet) (int, error) {
-	routes, err := netlink.RouteListFiltered(0, &netlink.Route{Dst: ipnet}, netlink.RT_FILTER_DST)
+func numRoutesTo(ipnet *net.IPNet, table int) (int, error) {
+	routes, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: ipnet, Table: routeTable(table)}, netlink.RT_FILTER_DST|netlink.RT_FILTER_TABLE)
 	if err != nil {
 		log.WithError(err).Error("failed to get routes")
 		return -1, err
@@ -40,10 +43,10 @@ func numRoutesTo(ipnet *net.IPNet) (int, error) {
 	return len(routes), nil
 }
 
-// VxroutesTo return sthe number of vxrouter routes to a specific IP
-func VxroutesTo(ip net.IP) (int, error) {
+// VxroutesTo return sthe number of vxrouter routes to a specific IP in table
+func VxroutesTo(ip net.IP, table int) (int, error) {
 	_, a := getIPNets(ip, nil)
-	routes, err := netlink.RouteListFiltered(0, &netlink.Route{Dst: a, Protocol: routeProto}, netlink.RT_FILTER_DST|netlink.RT_FILTER_PROTOCOL)
+	routes, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: a, Protocol: routeProto, Table: routeTable(table)}, netlink.RT_FILTER_DST|netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
 	if err != nil {
 		log.WithError(err).Error("failed to get routes")
 		return -1, err
@@ -51,10 +54,16 @@ func VxroutesTo(ip net.IP) (int, error) {
 	return len(routes), nil
 }
 
-// AllVxRoutes returns a list of IPNets which there are vxrouer routes to
+// RoutesTo returns the number of routes of any protocol to a specific IP in table
+func RoutesTo(ip net.IP, table int) (int, error) {
+	_, a := getIPNets(ip, nil)
+	return numRoutesTo(a, table)
+}
+
+// AllVxRoutes returns a list of IPNets which there are vxrouer routes to in the main table
 func AllVxRoutes() ([]*net.IPNet, error) {
 	ret := []*net.IPNet{}
-	routes, err := netlink.RouteListFiltered(0, &netlink.Route{Protocol: routeProto}, netlink.RT_FILTER_PROTOCOL)
+	routes, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Protocol: routeProto}, netlink.RT_FILTER_PROTOCOL)
 	if err != nil {
 		log.WithError(err).Error("failed to get routes")
 		return ret, err
@@ -65,3 +74,56 @@ func AllVxRoutes() ([]*net.IPNet, error) {
 	}
 	return ret, nil
 }
+
+// RouteDestinations returns the destinations of all ipv4 or ipv6 routes in table, except default routes
+func RouteDestinations(v6 bool, table int) ([]*net.IPNet, error) {
+	fam := netlink.FAMILY_V4
+	if v6 {
+		fam = netlink.FAMILY_V6
+	}
+	routes, err := kernel.Get().RouteListFiltered(fam, &netlink.Route{Table: routeTable(table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.WithError(err).Error("failed to get routes")
+		return nil, err
+	}
+
+	ret := []*net.IPNet{}
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		ret = append(ret, r.Dst)
+	}
+	return ret, nil
+}
+
+// ClaimedAddresses returns the number of vxrouter routes via each host interface in any table, keyed by network name
+func ClaimedAddresses() (map[string]int, error) {
+	ret := make(map[string]int)
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: routeProto}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		log.WithError(err).Error("failed to get routes")
+		return nil, err
+	}
+
+	names := make(map[int]string)
+	for _, r := range routes {
+		name, ok := names[r.LinkIndex]
+		if !ok {
+			var m slave
+			m, err = slaveFromLinkIndex(r.LinkIndex)
+			if err == nil {
+				name = strings.TrimPrefix(m.Name(), "hmvl_")
+			}
+			names[r.LinkIndex] = name
+		}
+		if name == "" {
+			continue
+		}
+		ret[name]++
+	}
+	return ret, nil
+}
@@ -0,0 +1,59 @@
+package host
+
+import (
+	"net"
+	"strings"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+)
+
+// gatewayMarker prefixes the alias of host macvlans of networks without a host gateway
+// the alias records the network's gateways, since they are not addresses on the macvlan
+const gatewayMarker = "vxrouter-gateways:"
+
+// markedGateways returns the gateways recorded in the alias of s
+func markedGateways(s slave) ([]*net.IPNet, error) {
+	link, err := kernel.Get().LinkByIndex(s.GetIndex())
+	if err != nil {
+		return nil, err
+	}
+
+	r := []*net.IPNet{}
+	alias := link.Attrs().Alias
+	if !strings.HasPrefix(alias, gatewayMarker) {
+		return r, nil
+	}
+	for _, g := range strings.Split(strings.TrimPrefix(alias, gatewayMarker), ",") {
+		ip, sn, err := net.ParseCIDR(g)
+		if err != nil {
+			continue
+		}
+		sn.IP = ip
+		r = append(r, sn)
+	}
+	return r, nil
+}
+
+// markGateways adds gateways to the ones recorded in the alias of s
+func markGateways(s slave, gateways []*net.IPNet) error {
+	cur, err := markedGateways(s)
+	if err != nil {
+		return err
+	}
+
+	gs := []string{}
+	seen := make(map[string]struct{})
+	for _, g := range append(cur, gateways...) {
+		if _, ok := seen[g.String()]; ok {
+			continue
+		}
+		seen[g.String()] = struct{}{}
+		gs = append(gs, g.String())
+	}
+
+	link, err := kernel.Get().LinkByIndex(s.GetIndex())
+	if err != nil {
+		return err
+	}
+	return kernel.Get().LinkSetAlias(link, gatewayMarker+strings.Join(gs, ","))
+}
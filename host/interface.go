@@ -10,7 +10,8 @@ import (
 
 	"github.com/TrilliumIT/iputil"
 	"github.com/TrilliumIT/vxrouter"
-	"github.com/TrilliumIT/vxrouter/macvlan"
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/metrics"
 	"github.com/TrilliumIT/vxrouter/vxlan"
 )
 
@@ -19,13 +20,15 @@ var (
 	reqAddrSleepTime = vxrouter.GetEnvDurWithDefault(vxrouter.EnvPrefix+"REQ_ADDR_SLEEP", "", vxrouter.DefaultReqAddrSleepTime)
 )
 
-// Interface holds a vxlan and a host macvlan interface used for the gateway interface on a container network
+// Interface holds a vxlan and a host macvlan (or ipvlan) interface used for the gateway interface on a container network
 type Interface struct {
 	name string
 	vxl  *vxlan.Vxlan
-	mvl  *macvlan.Macvlan
-	log  *log.Entry
-	l    *hiLock
+	mvl  slave
+	// table is the routing table routes are claimed in, the host macvlan is enslaved to it's vrf unless it is MainTable
+	table int
+	log   *log.Entry
+	l     *hiLock
 }
 
 // Name returns the name of the host interface
@@ -33,15 +36,94 @@ func (hi *Interface) Name() string {
 	return hi.name
 }
 
+// VNI returns the vxlan id of the host interface
+func (hi *Interface) VNI() (int, error) {
+	return hi.vxl.VNI()
+}
+
+// Underlay returns the vtep device and source address of the vxlan, empty and nil if the kernel picks them
+func (hi *Interface) Underlay() (string, net.IP, error) {
+	return hi.vxl.Underlay()
+}
+
+// Table returns the routing table routes are claimed in
+func (hi *Interface) Table() int {
+	return hi.table
+}
+
+// MacvlanName returns the name of the host macvlan
+func (hi *Interface) MacvlanName() string {
+	return hi.mvl.Name()
+}
+
+// Gateways returns the gateway addresses on the host macvlan, or recorded on it for networks without a host gateway
+func (hi *Interface) Gateways() ([]*net.IPNet, error) {
+	return hi.gateways()
+}
+
+// SyncPeers makes the vxlan's flood entries match the peers option in opts
+func (hi *Interface) SyncPeers(opts map[string]string) error {
+	hi.l.rlock()
+	defer hi.l.runlock()
+	return hi.vxl.SyncPeers(opts)
+}
+
+// ContainerMacvlans returns the names of the macvlans and ipvlans on the vxlan which are still in the host namespace, other than the host macvlan
+func (hi *Interface) ContainerMacvlans() ([]string, error) {
+	mvls, err := hi.vxl.GetMacVlans()
+	if err != nil {
+		return nil, err
+	}
+	ivls, err := hi.vxl.GetIpvlans()
+	if err != nil {
+		return nil, err
+	}
+	slaves := []slave{}
+	for _, m := range mvls {
+		slaves = append(slaves, m)
+	}
+	for _, i := range ivls {
+		slaves = append(slaves, i)
+	}
+
+	r := []string{}
+	for _, m := range slaves {
+		if hi.mvl != nil && m.GetIndex() == hi.mvl.GetIndex() {
+			continue
+		}
+		r = append(r, m.Name())
+	}
+	return r, nil
+}
+
 // GetOrCreateInterface creates required host interfaces if they don't exist, or gets them if they already do
-func GetOrCreateInterface(name string, gateway *net.IPNet, opts map[string]string) (*Interface, error) {
+// every gateway is added to the host macvlan, so a dual stack network passes both an ipv4 and an ipv6 gateway
+// the host macvlan is an ipvlan instead if the attach option selects one
+// routes are claimed in table, which is MainTable unless the network is in an address space with it's own table
+// without a hostGateway the gateways are only recorded on the host macvlan, for networks routed by something else
+func GetOrCreateInterface(name string, gateways []*net.IPNet, opts map[string]string, table int, hostGateway bool) (*Interface, error) {
 	hi, _ := getInterface(name)
 	hi.log = log.WithField("Interface", name)
 	log := hi.log.WithField("Func", "GetOrCreateInterface()")
 	log.Debug()
 
-	if hi.vxl != nil && hi.mvl != nil && hi.mvl.HasAddress(gateway) {
-		return hi, nil
+	attach := attachFromOpts(opts)
+	err := ValidAttach(attach)
+	if err != nil {
+		return nil, err
+	}
+	mvlMode, err := macvlanModeFromOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if hi.vxl != nil && hi.mvl != nil && hi.hasGateways(gateways) {
+		if err = hi.checkAttach(attach, mvlMode, table); err != nil {
+			return nil, err
+		}
+		if drifted, derr := hi.Drifted(opts); derr == nil && !drifted {
+			return hi, nil
+		}
 	}
 
 	hi.l.lock()
@@ -49,18 +131,47 @@ func GetOrCreateInterface(name string, gateway *net.IPNet, opts map[string]strin
 	hi, _ = getInterface(name)
 	hi.log = log.WithField("Interface", name)
 
-	var err error
+	if hi.mvl != nil {
+		if err = hi.checkAttach(attach, mvlMode, table); err != nil {
+			return nil, err
+		}
+	}
+
+	if hi.vxl != nil {
+		if _, err = hi.reconfigure(opts); err != nil {
+			return nil, err
+		}
+	}
+
 	if hi.vxl == nil {
 		hi.vxl, err = vxlan.New(name, opts)
 		if err != nil {
 			log.WithError(err).Debug("failed to create vxlan")
 			return nil, err
 		}
+		metrics.InterfacesCreated.WithLabelValues(name).Inc()
+	}
+
+	if err = hi.vxl.SyncPeers(opts); err != nil {
+		log.WithError(err).Error("failed to sync vxlan peers")
+		return nil, err
 	}
 
 	if hi.mvl == nil {
-		hi.mvl, err = hi.vxl.CreateMacvlan("hmvl_" + name)
+		hi.mvl, err = createSlave(hi.vxl, "hmvl_"+name, attach, mvlMode, nil)
+		if err != nil {
+			err2 := hi.UnsafeDelete()
+			if err2 != nil {
+				log.WithError(err).WithError(err2).Debug("failed to delete vxlan")
+				return nil, err2
+			}
+			return nil, err
+		}
+
+		// enslave to the vrf before adding gateways, so the connected routes land in the vrf's table
+		err = setSlaveTable(hi.mvl, table)
 		if err != nil {
+			log.WithError(err).WithField("table", table).Debug("failed to enslave macvlan to vrf")
 			err2 := hi.UnsafeDelete()
 			if err2 != nil {
 				log.WithError(err).WithError(err2).Debug("failed to delete vxlan")
@@ -68,27 +179,98 @@ func GetOrCreateInterface(name string, gateway *net.IPNet, opts map[string]strin
 			}
 			return nil, err
 		}
+		hi.table = table
 	}
 
-	if hi.mvl.HasAddress(gateway) {
-		return hi, nil
+	if !hostGateway && !hi.hasGateways(gateways) {
+		err = markGateways(hi.mvl, gateways)
+		if err != nil {
+			log.WithError(err).Debug("failed to record gateways on macvlan")
+			err2 := hi.UnsafeDelete()
+			if err2 != nil {
+				log.WithError(err).WithError(err2).Debug("failed to delete vxlan")
+				return nil, err2
+			}
+			return nil, err
+		}
 	}
 
-	err = hi.mvl.AddAddress(gateway)
-	if err != nil {
-		log.WithError(err).Debug("failed to add address to macvlan")
-		//implicitly deletes macvlan
-		err2 := hi.UnsafeDelete()
-		if err2 != nil {
-			log.WithError(err).WithError(err2).Debug("failed to delete vxlan")
-			return nil, err2
+	for _, gateway := range gateways {
+		if !hostGateway || hi.mvl.HasAddress(gateway) {
+			continue
+		}
+
+		err = hi.mvl.AddAddress(gateway)
+		if err != nil {
+			log.WithError(err).WithField("gateway", gateway.String()).Debug("failed to add address to macvlan")
+			//implicitly deletes macvlan
+			err2 := hi.UnsafeDelete()
+			if err2 != nil {
+				log.WithError(err).WithError(err2).Debug("failed to delete vxlan")
+				return nil, err2
+			}
+			return nil, err
 		}
-		return nil, err
 	}
 
 	return hi, nil
 }
 
+// checkAttach returns an error if the host macvlan is not of the attachment mode attach and macvlan mode mvlMode, or not in table
+func (hi *Interface) checkAttach(attach string, mvlMode netlink.MacvlanMode, table int) error {
+	cur, err := slaveAttach(hi.mvl)
+	if err != nil {
+		return err
+	}
+	if cur != attach {
+		return fmt.Errorf("host interface already exists with attachment mode %v, not %v", cur, attach)
+	}
+	if attach == AttachMacvlan {
+		curMode, err := slaveMacvlanMode(hi.mvl) // nolint: vetshadow
+		if err != nil {
+			return err
+		}
+		if curMode != mvlMode {
+			return fmt.Errorf("host interface already exists with macvlan mode %v, not %v", macvlanModeName(curMode), macvlanModeName(mvlMode))
+		}
+	}
+	if hi.table != table {
+		return fmt.Errorf("host interface already exists in routing table %v, not %v", hi.table, table)
+	}
+	return nil
+}
+
+// hasGateways returns true if all of gws are addresses on the host macvlan, or recorded on it
+func (hi *Interface) hasGateways(gws []*net.IPNet) bool {
+	cur, err := hi.gateways()
+	if err != nil {
+		return false
+	}
+	have := make(map[string]struct{})
+	for _, g := range cur {
+		have[g.String()] = struct{}{}
+	}
+	for _, g := range gws {
+		if _, ok := have[g.String()]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// gateways returns the gateway addresses on the host macvlan, and the gateways recorded on it for networks without a host gateway
+func (hi *Interface) gateways() ([]*net.IPNet, error) {
+	gws, err := hi.mvl.GetAddresses()
+	if err != nil {
+		return nil, err
+	}
+	mgws, err := markedGateways(hi.mvl)
+	if err != nil {
+		return nil, err
+	}
+	return append(gws, mgws...), nil
+}
+
 // GetInterface gets host interfaces by name
 func GetInterface(name string) (*Interface, error) {
 	log := log.WithField("Interface", name).WithField("Func", "GetInterface()")
@@ -117,33 +299,47 @@ func getInterface(name string) (*Interface, error) {
 		return hi, err
 	}
 
-	hi.mvl, err = macvlan.FromName("hmvl_" + name)
+	hi.mvl, err = slaveFromName("hmvl_" + name)
 	if err != nil {
 		log.WithError(err).Debug("failed to get macvlan interface")
+		return hi, err
+	}
+
+	hi.table, err = slaveTable(hi.mvl)
+	if err != nil {
+		log.WithError(err).Debug("failed to get routing table of macvlan")
 	}
 
 	return hi, err
 }
 
-// CreateMacvlan creates container macvlan interfaces
-func (hi *Interface) CreateMacvlan(name string) error {
+// CreateMacvlan creates container macvlan interfaces in the same mode as the host macvlan, or ipvlans in the same mode as the host ipvlan
+func (hi *Interface) CreateMacvlan(name string, mac net.HardwareAddr) error {
 	log := hi.log.WithField("Func", "CreateMacvlan()")
 	log.Debug()
 	hi.l.rlock()
 	defer hi.l.runlock()
 
-	_, err := hi.vxl.CreateMacvlan(name)
+	attach, err := slaveAttach(hi.mvl)
+	if err != nil {
+		return err
+	}
+	mvlMode, err := slaveMacvlanMode(hi.mvl)
+	if err != nil {
+		return err
+	}
+	_, err = createSlave(hi.vxl, name, attach, mvlMode, mac)
 	return err
 }
 
-// DeleteMacvlan deletes a container macvlan interface
+// DeleteMacvlan deletes a container macvlan (or ipvlan) interface
 func (hi *Interface) DeleteMacvlan(name string) error {
 	log := hi.log.WithField("Func", "DeleteMacvlan()")
 	log.Debug()
 	hi.l.rlock()
 	defer hi.l.runlock()
 
-	return hi.vxl.DeleteMacvlan(name)
+	return deleteSlave(hi.vxl, hi.mvl, name)
 }
 
 // Delete deletes the host interface, only if there are no additional slave devices attached to the vxlan, and no other vxrnet routes via the hostmacvlan
@@ -185,38 +381,61 @@ func (hi *Interface) UnsafeDelete() error {
 	}
 
 	// if there are any other routes, don't delete
-	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{LinkIndex: hi.mvl.GetIndex(), Protocol: routeProto}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+	routes, err := hi.Routes()
 	if err != nil {
 		hi.log.WithError(err).Error("failed to get routes")
 		return err
 	}
 	for _, r := range routes {
-		hi.log.WithField("r.Dst", r.Dst.String()).Debug("other routes found on this device, not deleting")
+		hi.log.WithField("r.Dst", r.String()).Debug("other routes found on this device, not deleting")
 		return nil
 	}
 
 	delHl(hi.name)
 
-	return hi.vxl.Delete()
+	hi.WithdrawEVPN()
+	err = hi.vxl.Delete()
+	if err != nil {
+		return err
+	}
+	metrics.InterfacesDeleted.WithLabelValues(hi.name).Inc()
+	return nil
+}
+
+// Routes returns the destinations of all vxrnet routes via the host macvlan
+func (hi *Interface) Routes() ([]*net.IPNet, error) {
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{LinkIndex: hi.mvl.GetIndex(), Protocol: routeProto, Table: routeTable(hi.table)}, netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, err
+	}
+	r := []*net.IPNet{}
+	for _, rt := range routes {
+		r = append(r, rt.Dst)
+	}
+	return r, nil
 }
 
-func (hi *Interface) getSubnet() (*net.IPNet, error) {
+// getSubnet returns the subnet of the gateway on the host macvlan which is in sn
+func (hi *Interface) getSubnet(sn *net.IPNet) (*net.IPNet, error) {
 	log := hi.log.WithField("Func", "getSubnet()")
 	log.Debug()
 
-	gws, err := hi.mvl.GetAddresses()
+	gws, err := hi.gateways()
 	if err != nil {
 		return nil, err
 	}
 	for _, gw := range gws {
-		return &net.IPNet{IP: iputil.FirstAddr(gw), Mask: gw.Mask}, nil
+		gsn := &net.IPNet{IP: iputil.FirstAddr(gw), Mask: gw.Mask}
+		if iputil.SubnetEqualSubnet(gsn, sn) {
+			return gsn, nil
+		}
 	}
 
-	return nil, fmt.Errorf("did not find any addresses on the macvlan")
+	return nil, fmt.Errorf("did not find an address in %v on the macvlan", sn)
 }
 
-// SelectAddress returns an available IP or the requested IP (if available) or an error on timeout
-func (hi *Interface) SelectAddress(reqAddress net.IP, propTime, respTime time.Duration, xf, xl int) (*net.IPNet, error) {
+// SelectAddress returns an available IP in subnet sn or the requested IP (if available) or an error on timeout
+func (hi *Interface) SelectAddress(sn *net.IPNet, reqAddress net.IP, propTime, respTime time.Duration, alloc *Allocation) (*net.IPNet, error) {
 	log := hi.log.WithField("Func", "SelectAddress()")
 	log.Debug()
 
@@ -229,16 +448,33 @@ func (hi *Interface) SelectAddress(reqAddress net.IP, propTime, respTime time.Du
 	defer hi.l.runlock()
 
 	var ip *net.IPNet
-	var err error
 
 	var sleepTime time.Duration
 	if reqAddress != nil {
 		sleepTime = reqAddrSleepTime
 	}
 
-	stop := time.Now().Add(respTime)
+	// addresses which were unavailable, so sequential and hash move on to the next one
+	// the gateway addresses are never available
+	tried := make(map[string]struct{})
+	gws, err := hi.gateways()
+	if err != nil {
+		log.WithError(err).Error("failed to get gateway addresses")
+		return nil, err
+	}
+	for _, gw := range gws {
+		tried[gw.IP.String()] = struct{}{}
+	}
+
+	if reqAddress == nil && alloc.Strategy == AllocHash && alloc.Key == "" {
+		log.WithError(errNoHashKey).Error("failed to select address")
+		return nil, errNoHashKey
+	}
+
+	start := time.Now()
+	stop := start.Add(respTime)
 	for time.Now().Before(stop) {
-		ip, err = hi.selectAddress(reqAddress, propTime, xf, xl)
+		ip, err = hi.selectAddress(sn, reqAddress, propTime, alloc, tried)
 		if err != nil {
 			log.WithError(err).Error("failed to select address")
 			return nil, err
@@ -246,15 +482,18 @@ func (hi *Interface) SelectAddress(reqAddress net.IP, propTime, respTime time.Du
 		if ip != nil {
 			break
 		}
+		metrics.AllocationRetries.WithLabelValues(hi.name).Inc()
 		time.Sleep(sleepTime)
 	}
 
 	if ip == nil {
+		metrics.AllocationTimeouts.WithLabelValues(hi.name).Inc()
 		err = fmt.Errorf("timeout expired while waiting for address")
 		log.WithError(err).Error()
 		return nil, err
 	}
 
+	metrics.SelectAddressDuration.WithLabelValues(hi.name).Observe(time.Since(start).Seconds())
 	return ip, nil
 }
 
@@ -262,11 +501,11 @@ func (hi *Interface) SelectAddress(reqAddress net.IP, propTime, respTime time.Du
 // if it's available. This function may return (nil, nil) if it selects an unavailable address
 // the intention is for the caller to continue calling in a loop until an address is returned
 // this way the caller can implement their own timeout logic
-func (hi *Interface) selectAddress(reqAddress net.IP, propTime time.Duration, xf, xl int) (*net.IPNet, error) {
+func (hi *Interface) selectAddress(pool *net.IPNet, reqAddress net.IP, propTime time.Duration, alloc *Allocation, tried map[string]struct{}) (*net.IPNet, error) {
 	log := hi.log.WithField("Func", "selectAddress()")
 	log.Debug()
 
-	sn, err := hi.getSubnet()
+	sn, err := hi.getSubnet(pool)
 	if err != nil {
 		return nil, err
 	}
@@ -277,39 +516,63 @@ func (hi *Interface) selectAddress(reqAddress net.IP, propTime time.Duration, xf
 		return nil, fmt.Errorf("requested address was not in this host interface's subnet")
 	}
 
-	// keep looking for a random address until one is found
+	if reqAddress != nil {
+		if r := alloc.excluded(reqAddress); r != nil {
+			return nil, fmt.Errorf("requested address %v is in the reserved range %v", reqAddress, r)
+		}
+	}
+
+	// keep looking for an address until one is found
 	if reqAddress == nil {
-		addrOnly.IP = iputil.RandAddrWithExclude(sn, xf, xl)
+		addrOnly.IP, err = alloc.candidate(sn, hi.table, tried)
+		if err != nil {
+			log.WithError(err).WithField("strategy", alloc.Strategy).Error("failed to pick an address")
+			return nil, err
+		}
 		addrInSubnet.IP = addrOnly.IP
+		if addrOnly.IP == nil {
+			return nil, nil
+		}
 	}
-	numRoutes, err := numRoutesTo(addrOnly)
+	numRoutes, err := numRoutesTo(addrOnly, hi.table)
 	if err != nil {
 		log.WithError(err).Errorf("failed to count routes")
 		return nil, err
 	}
 	if numRoutes > 0 {
+		tried[addrOnly.IP.String()] = struct{}{}
 		return nil, nil
 	}
 
 	log = log.WithField("ip", addrOnly.String())
 
+	// record the claim before making it, so it can be rolled back if we crash before handing it out
+	err = journalPending(addrOnly.IP, hi.table, sn, alloc.Key)
+	if err != nil {
+		log.WithError(err).Error("failed to journal pending claim")
+		return nil, err
+	}
+
 	// add host route to routing table
 	log.Debug("adding route to")
-	err = netlink.RouteAdd(&netlink.Route{
+	err = kernel.Get().RouteAdd(&netlink.Route{
 		LinkIndex: hi.mvl.GetIndex(),
 		Dst:       addrOnly,
 		Protocol:  routeProto,
+		Table:     routeTable(hi.table),
 	})
 	if err != nil {
 		log.WithError(err).Error("failed to add route")
+		journalForget(addrOnly.IP, hi.table)
 		return nil, err
 	}
+	hi.announce(addrOnly)
 
 	//wait for at least estimated route propagation time
 	time.Sleep(propTime)
 
 	//check that we are still the only route
-	numRoutes, err = numRoutesTo(addrOnly)
+	numRoutes, err = numRoutesTo(addrOnly, hi.table)
 	if err != nil {
 		log.WithError(err).Error("failed to count routes")
 		return nil, err
@@ -320,6 +583,7 @@ func (hi *Interface) selectAddress(reqAddress net.IP, propTime time.Duration, xf
 		// possibly because of a race with reconcile()
 		// let the outer loop try again
 		log.Debug("route doesn't exist after it was added")
+		journalForget(addrOnly.IP, hi.table)
 		return nil, nil
 	}
 
@@ -328,6 +592,8 @@ func (hi *Interface) selectAddress(reqAddress net.IP, propTime time.Duration, xf
 	}
 
 	log.Info("someone else grabbed ip first")
+	tried[addrOnly.IP.String()] = struct{}{}
+	metrics.AllocationCollisions.WithLabelValues(hi.name).Inc()
 
 	err = hi.DelRoute(addrOnly.IP)
 	if err != nil {
@@ -345,23 +611,27 @@ func (hi *Interface) DelRoute(ip net.IP) error {
 
 	hi.l.rlock()
 	defer hi.l.runlock()
-	sn, err := hi.getSubnet()
-	if err != nil {
-		return err
-	}
 
-	_, addrOnly := getIPNets(ip, sn)
+	_, addrOnly := getIPNets(ip, nil)
 
-	return netlink.RouteDel(&netlink.Route{
+	err := kernel.Get().RouteDel(&netlink.Route{
 		LinkIndex: hi.mvl.GetIndex(),
 		Dst:       addrOnly,
 		Protocol:  routeProto,
+		Table:     routeTable(hi.table),
 	})
+	if err != nil {
+		return err
+	}
+	hi.withdraw(addrOnly)
+	journalForget(ip, hi.table)
+	return nil
 }
 
-// GetInterfaceFromDestinationAddress gets an interface from a host route destination
-func GetInterfaceFromDestinationAddress(address net.IP) (*Interface, error) {
-	routes, err := netlink.RouteGet(address)
+// GetInterfaceFromDestinationAddress gets an interface from a vxrouter route destination in table
+func GetInterfaceFromDestinationAddress(address net.IP, table int) (*Interface, error) {
+	_, addrOnly := getIPNets(address, nil)
+	routes, err := kernel.Get().RouteListFiltered(0, &netlink.Route{Dst: addrOnly, Protocol: routeProto, Table: routeTable(table)}, netlink.RT_FILTER_DST|netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
 	if err != nil {
 		return nil, err
 	}
@@ -371,8 +641,8 @@ func GetInterfaceFromDestinationAddress(address net.IP) (*Interface, error) {
 			continue
 		}
 
-		var m *macvlan.Macvlan
-		m, err = macvlan.FromLinkIndex(r.LinkIndex)
+		var m slave
+		m, err = slaveFromLinkIndex(r.LinkIndex)
 		if err != nil {
 			continue
 		}
@@ -383,18 +653,19 @@ func GetInterfaceFromDestinationAddress(address net.IP) (*Interface, error) {
 			continue
 		}
 
-		return getInterfaceFromDevices(v, m), nil
+		return getInterfaceFromDevices(v, m, table), nil
 	}
 
 	return nil, fmt.Errorf("interface not found")
 }
 
-func getInterfaceFromDevices(vxl *vxlan.Vxlan, mvl *macvlan.Macvlan) *Interface {
+func getInterfaceFromDevices(vxl *vxlan.Vxlan, mvl slave, table int) *Interface {
 	return &Interface{
-		name: vxl.Name(),
-		vxl:  vxl,
-		mvl:  mvl,
-		log:  log.WithField("Interface", vxl.Name()),
-		l:    getHl(vxl.Name()),
+		name:  vxl.Name(),
+		vxl:   vxl,
+		mvl:   mvl,
+		table: table,
+		log:   log.WithField("Interface", vxl.Name()),
+		l:     getHl(vxl.Name()),
 	}
 }
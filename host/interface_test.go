@@ -0,0 +1,363 @@
+package host
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/kernel/kerneltest"
+)
+
+// useFakeKernel swaps in an empty in-memory kernel, returning a func restoring the previous one
+func useFakeKernel(t *testing.T) (*kerneltest.Netlink, func()) {
+	k := kerneltest.New()
+	old := kernel.Set(k)
+	return k, func() { kernel.Set(old) }
+}
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	ip, sn, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn.IP = ip
+	return sn
+}
+
+// vxRoutes returns the vxrouter routes in the main table, keyed by destination address
+func vxRoutes(t *testing.T) map[string]netlink.Route {
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Protocol: routeProto}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := make(map[string]netlink.Route)
+	for _, rt := range routes {
+		r[rt.Dst.IP.String()] = rt
+	}
+	return r
+}
+
+func testInterface(t *testing.T, name string, opts map[string]string) *Interface {
+	if opts == nil {
+		opts = map[string]string{}
+	}
+	if _, ok := opts["vxlanid"]; !ok {
+		opts["vxlanid"] = "100"
+	}
+	hi, err := GetOrCreateInterface(name, []*net.IPNet{mustCIDR(t, "10.1.0.1/24")}, opts, MainTable, true)
+	if err != nil {
+		t.Fatalf("GetOrCreateInterface: %v", err)
+	}
+	return hi
+}
+
+func TestGetOrCreateInterface(t *testing.T) {
+	_, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "goci", nil)
+
+	vxl, err := kernel.Get().LinkByName("goci")
+	if err != nil {
+		t.Fatalf("vxlan not created: %v", err)
+	}
+	if v, ok := vxl.(*netlink.Vxlan); !ok || v.VxlanId != 100 {
+		t.Fatalf("expected vxlan with id 100, got %#v", vxl)
+	}
+	mvl, err := kernel.Get().LinkByName("hmvl_goci")
+	if err != nil {
+		t.Fatalf("host macvlan not created: %v", err)
+	}
+	if _, ok := mvl.(*netlink.Macvlan); !ok {
+		t.Fatalf("expected a macvlan, got %v", mvl.Type())
+	}
+	if mvl.Attrs().ParentIndex != vxl.Attrs().Index {
+		t.Errorf("host macvlan parent is %v, not the vxlan %v", mvl.Attrs().ParentIndex, vxl.Attrs().Index)
+	}
+	if mvl.Attrs().Flags&net.FlagUp == 0 || vxl.Attrs().Flags&net.FlagUp == 0 {
+		t.Errorf("interfaces are not up")
+	}
+
+	addrs, err := kernel.Get().AddrList(mvl, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "10.1.0.1/24" {
+		t.Errorf("expected the gateway on the host macvlan, got %v", addrs)
+	}
+	rts, err := kernel.Get().RouteGet(net.ParseIP("10.1.0.20"))
+	if err != nil || rts[0].LinkIndex != mvl.Attrs().Index {
+		t.Errorf("expected a connected route through the host macvlan, got %v %v", rts, err)
+	}
+
+	// getting it again reuses the same interfaces
+	hi2 := testInterface(t, "goci", nil)
+	if hi2.mvl.GetIndex() != hi.mvl.GetIndex() {
+		t.Errorf("host macvlan was recreated")
+	}
+	links, err := kernel.Get().LinkList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 3 {
+		t.Errorf("expected lo, a vxlan and a macvlan, got %v links", len(links))
+	}
+}
+
+func TestGetOrCreateInterfacePeers(t *testing.T) {
+	k, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "gocip", map[string]string{"peers": "192.0.2.10,192.0.2.11", "group": "192.0.2.20"})
+	vxl, err := k.LinkByName("gocip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kernel adds an all zero entry for a unicast group
+	err = k.NeighAppend(&netlink.Neigh{LinkIndex: vxl.Attrs().Index, Family: syscall.AF_BRIDGE, IP: net.ParseIP("192.0.2.20"), HardwareAddr: net.HardwareAddr{0, 0, 0, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers := func() map[string]bool {
+		fdb, err := k.NeighList(vxl.Attrs().Index, syscall.AF_BRIDGE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := make(map[string]bool)
+		for _, n := range fdb {
+			if n.HardwareAddr.String() != "00:00:00:00:00:00" {
+				t.Errorf("unexpected fdb entry %v", n.HardwareAddr)
+			}
+			r[n.IP.String()] = true
+		}
+		return r
+	}
+	if p := peers(); len(p) != 3 || !p["192.0.2.10"] || !p["192.0.2.11"] {
+		t.Fatalf("expected flood entries for both peers and the group, got %v", p)
+	}
+
+	// reconcile keeps the flood entries in line with the option
+	if err = hi.SyncPeers(map[string]string{"vxlanid": "100", "peers": "192.0.2.11", "group": "192.0.2.20"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := peers(); len(p) != 2 || !p["192.0.2.11"] || !p["192.0.2.20"] {
+		t.Fatalf("expected the removed peer's flood entry to be deleted, got %v", p)
+	}
+
+	// without the option every peer is removed, but not the group
+	if err = hi.SyncPeers(map[string]string{"vxlanid": "100", "group": "192.0.2.20"}); err != nil {
+		t.Fatal(err)
+	}
+	if p := peers(); len(p) != 1 || !p["192.0.2.20"] {
+		t.Fatalf("expected only the group's flood entry, got %v", p)
+	}
+}
+
+func TestSelectAddress(t *testing.T) {
+	_, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "sela", nil)
+	sn := mustCIDR(t, "10.1.0.0/24")
+	alloc := &Allocation{Strategy: AllocSequential, ExcludeFirst: 1, ExcludeLast: 1}
+
+	a, err := hi.SelectAddress(sn, nil, 0, time.Second, alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// .1 is the gateway
+	if a.String() != "10.1.0.2/24" {
+		t.Errorf("expected 10.1.0.2/24, got %v", a)
+	}
+
+	r, ok := vxRoutes(t)["10.1.0.2"]
+	if !ok {
+		t.Fatalf("no route claiming 10.1.0.2")
+	}
+	if ones, _ := r.Dst.Mask.Size(); ones != 32 || r.LinkIndex != hi.mvl.GetIndex() || r.Table != syscall.RT_TABLE_MAIN {
+		t.Errorf("expected a /32 through the host macvlan in the main table, got %v", r)
+	}
+
+	a, err = hi.SelectAddress(sn, net.ParseIP("10.1.0.50"), 0, time.Second, alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "10.1.0.50/24" {
+		t.Errorf("expected the requested address, got %v", a)
+	}
+
+	// a claimed address can't be requested again
+	if _, err = hi.SelectAddress(sn, net.ParseIP("10.1.0.50"), 0, 50*time.Millisecond, alloc); err == nil {
+		t.Errorf("expected requesting a claimed address to time out")
+	}
+	if _, err = hi.SelectAddress(sn, net.ParseIP("10.2.0.5"), 0, time.Second, alloc); err == nil {
+		t.Errorf("expected requesting an address outside the subnet to fail")
+	}
+	if _, err = hi.SelectAddress(sn, nil, 0, time.Second, &Allocation{Strategy: AllocHash}); err != errNoHashKey {
+		t.Errorf("expected hash allocation without a key to fail, got %v", err)
+	}
+	if n := len(vxRoutes(t)); n != 2 {
+		t.Errorf("expected 2 claimed routes, got %v", n)
+	}
+}
+
+func TestSelectAddressDuplicateClaim(t *testing.T) {
+	k, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "seld", nil)
+	sn := mustCIDR(t, "10.1.0.0/24")
+	alloc := &Allocation{Strategy: AllocSequential, ExcludeFirst: 1, ExcludeLast: 1}
+
+	// another host claims 10.1.0.2 while this host waits for propagation, as a route learned from a routing daemon would
+	updates := make(chan netlink.RouteUpdate)
+	done := make(chan struct{})
+	defer close(done)
+	if err := k.RouteSubscribe(updates, done); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for u := range updates {
+			if u.Type != syscall.RTM_NEWROUTE || u.Protocol != routeProto || !u.Dst.IP.Equal(net.ParseIP("10.1.0.2")) {
+				continue
+			}
+			err := k.RouteAdd(&netlink.Route{Dst: u.Dst, Gw: net.ParseIP("10.1.0.254"), Protocol: 186, Priority: 32})
+			if err != nil {
+				t.Errorf("failed to add conflicting route: %v", err)
+			}
+			return
+		}
+	}()
+
+	a, err := hi.SelectAddress(sn, nil, 100*time.Millisecond, 2*time.Second, alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if a.IP.Equal(net.ParseIP("10.1.0.2")) {
+		t.Fatalf("got the address claimed by another host")
+	}
+	if a.String() != "10.1.0.3/24" {
+		t.Errorf("expected the next address, got %v", a)
+	}
+
+	// DelRoute removed this host's claim on the duplicate, and left the other host's route
+	vr := vxRoutes(t)
+	if _, ok := vr["10.1.0.2"]; ok {
+		t.Errorf("duplicate claim was not deleted")
+	}
+	if _, ok := vr["10.1.0.3"]; !ok {
+		t.Errorf("no route claiming 10.1.0.3")
+	}
+	if n, err := RoutesTo(net.ParseIP("10.1.0.2"), MainTable); err != nil || n != 1 {
+		t.Errorf("expected only the other host's route to 10.1.0.2, got %v %v", n, err)
+	}
+}
+
+func TestDelRouteAndDelete(t *testing.T) {
+	_, restore := useFakeKernel(t)
+	defer restore()
+
+	hi := testInterface(t, "delr", nil)
+	sn := mustCIDR(t, "10.1.0.0/24")
+	a, err := hi.SelectAddress(sn, net.ParseIP("10.1.0.9"), 0, time.Second, &Allocation{Strategy: AllocRandom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = hi.CreateMacvlan("cmvl_delr", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the interface is kept while a route or a container macvlan uses it
+	if err = hi.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kernel.Get().LinkByName("delr"); err != nil {
+		t.Fatalf("vxlan deleted while in use")
+	}
+
+	if err = hi.DelRoute(a.IP); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vxRoutes(t)["10.1.0.9"]; ok {
+		t.Errorf("route to 10.1.0.9 not deleted")
+	}
+	if err = hi.DelRoute(a.IP); err == nil {
+		t.Errorf("expected deleting a missing route to fail")
+	}
+
+	if err = hi.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kernel.Get().LinkByName("delr"); err != nil {
+		t.Fatalf("vxlan deleted while a container macvlan uses it")
+	}
+
+	if err = hi.DeleteMacvlan("cmvl_delr"); err != nil {
+		t.Fatal(err)
+	}
+	if err = hi.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"delr", "hmvl_delr"} {
+		if _, err = kernel.Get().LinkByName(n); err == nil {
+			t.Errorf("%v not deleted", n)
+		}
+	}
+}
+
+func TestValidMacvlanMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		ok   bool
+	}{
+		{"bridge", true},
+		{"private", true},
+		{"vepa", true},
+		{"passthru", false},
+		{"source", false},
+		{"", false},
+	} {
+		if err := ValidMacvlanMode(tc.mode); (err == nil) != tc.ok {
+			t.Errorf("mode %q: expected valid %v, got %v", tc.mode, tc.ok, err)
+		}
+	}
+}
+
+func TestRandomCandidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		alloc *Allocation
+		want  []string
+	}{
+		{"subnet", &Allocation{Strategy: AllocRandom, ExcludeFirst: 1, ExcludeLast: 1}, []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5", "10.1.0.6"}},
+		{"range", &Allocation{Strategy: AllocRandom, ExcludeFirst: 1, ExcludeLast: 1, Range: mustCIDR(t, "10.1.0.4/30")}, []string{"10.1.0.4", "10.1.0.5", "10.1.0.6"}},
+	} {
+		got := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			ip, err := tc.alloc.candidate(mustCIDR(t, "10.1.0.0/29"), 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[ip.String()] = true
+		}
+		// every address is picked eventually, including the last one
+		if len(got) != len(tc.want) {
+			t.Errorf("%v: expected %v, got %v", tc.name, tc.want, got)
+		}
+		for _, ip := range tc.want {
+			if !got[ip] {
+				t.Errorf("%v: %v never picked, got %v", tc.name, ip, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package host
+
+import (
+	"net"
+	"sync"
+)
+
+// Journal records claims before their route is added, so a claim interrupted by a crash can be finished or rolled back
+type Journal interface {
+	// Pending is called before the route to ip in pool is added to table, the route is not added if it returns an error
+	Pending(ip net.IP, table int, pool *net.IPNet, key string) error
+	// Forget is called when the route to ip in table is deleted, or was never successfully claimed
+	Forget(ip net.IP, table int)
+}
+
+var (
+	journal  Journal
+	journalL sync.RWMutex
+)
+
+// SetJournal sets the journal claims are recorded in, nil to disable
+func SetJournal(j Journal) {
+	journalL.Lock()
+	defer journalL.Unlock()
+	journal = j
+}
+
+func journalPending(ip net.IP, table int, pool *net.IPNet, key string) error {
+	journalL.RLock()
+	defer journalL.RUnlock()
+	if journal != nil {
+		return journal.Pending(ip, table, pool, key)
+	}
+	return nil
+}
+
+func journalForget(ip net.IP, table int) {
+	journalL.RLock()
+	defer journalL.RUnlock()
+	if journal != nil {
+		journal.Forget(ip, table)
+	}
+}
@@ -0,0 +1,93 @@
+package host
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+)
+
+// MainTable is the table routes are claimed in for networks which are not in an address space with it's own table
+const MainTable = 0
+
+// routeTable returns the kernel table number for table, which is the main table for MainTable
+func routeTable(table int) int {
+	if table == MainTable {
+		return syscall.RT_TABLE_MAIN
+	}
+	return table
+}
+
+func vrfName(table int) string {
+	return "vrf_" + strconv.Itoa(table)
+}
+
+// getOrCreateVrf returns the index of the vrf device for table, creating it if it doesn't exist
+func getOrCreateVrf(table int) (int, error) {
+	name := vrfName(table)
+	link, err := kernel.Get().LinkByName(name)
+	if err != nil {
+		err = kernel.Get().LinkAdd(&netlink.Vrf{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			Table:     uint32(table),
+		})
+		// get it again even if add failed, in case another thread created it first
+		var err2 error
+		link, err2 = kernel.Get().LinkByName(name)
+		if err2 != nil {
+			if err != nil {
+				return 0, err
+			}
+			return 0, err2
+		}
+	}
+
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok || int(vrf.Table) != table {
+		return 0, fmt.Errorf("%v exists and is not a vrf for table %v", name, table)
+	}
+	if err = kernel.Get().LinkSetUp(vrf); err != nil {
+		return 0, err
+	}
+	return vrf.Attrs().Index, nil
+}
+
+// slaveTable returns the table of the vrf s is enslaved to, or MainTable
+func slaveTable(s slave) (int, error) {
+	link, err := kernel.Get().LinkByIndex(s.GetIndex())
+	if err != nil {
+		return MainTable, err
+	}
+	mi := link.Attrs().MasterIndex
+	if mi == 0 {
+		return MainTable, nil
+	}
+	master, err := kernel.Get().LinkByIndex(mi)
+	if err != nil {
+		return MainTable, err
+	}
+	if vrf, ok := master.(*netlink.Vrf); ok {
+		return int(vrf.Table), nil
+	}
+	return MainTable, nil
+}
+
+// setSlaveTable enslaves s to the vrf for table, so it's connected routes and the routes of packets
+// from containers are looked up in that table
+func setSlaveTable(s slave, table int) error {
+	if table == MainTable {
+		return nil
+	}
+	vi, err := getOrCreateVrf(table)
+	if err != nil {
+		return err
+	}
+	link, err := kernel.Get().LinkByIndex(s.GetIndex())
+	if err != nil {
+		return err
+	}
+	return kernel.Get().LinkSetMasterByIndex(link, vi)
+}
@@ -0,0 +1,106 @@
+package ipvlan
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/slave"
+)
+
+const linkType = "ipvlan"
+
+// Ipvlan is an ipvlan interface, for either a host or a container
+type Ipvlan struct {
+	*slave.Slave
+}
+
+func (i *Ipvlan) nl() (*netlink.IPVlan, error) {
+	link, err := i.Link()
+	if err != nil {
+		return nil, err
+	}
+	return link.(*netlink.IPVlan), nil
+}
+
+// New creates an ipvlan interface in mode, under the parent interface index
+func New(name string, parent int, mode netlink.IPVlanMode) (*Ipvlan, error) {
+	i := &Ipvlan{slave.New(name, linkType)}
+	log := log.WithField(linkType, name).WithField("Func", "New()")
+	log.Debug()
+
+	// Create an ipvlan link
+	nl := &netlink.IPVlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        name,
+			ParentIndex: parent,
+		},
+		Mode: mode,
+	}
+	if err := kernel.Get().LinkAdd(nl); err != nil {
+		log.WithError(err).Debug("error adding link")
+
+		// Just in case add failed due to add succeeding from another thread
+		var err2 error
+		nl, err2 = i.nl()
+		if err2 != nil { // add and get failed, return first error
+			return nil, err
+		}
+		if nl.ParentIndex != parent {
+			err = fmt.Errorf("ipvlan already exists with wrong parent")
+			log.WithError(err).Debug()
+			return nil, err
+		}
+		if nl.Mode != mode {
+			err = fmt.Errorf("ipvlan already exists with wrong mode")
+			log.WithError(err).Debug()
+			return nil, err
+		}
+	}
+
+	if err := kernel.Get().LinkSetUp(nl); err != nil {
+		log.WithError(err).Debug("failed to bring up ipvlan")
+		return nil, err
+	}
+	log.Debug("Brought up ipvlan")
+
+	return i, nil
+}
+
+// FromName returns an Ipvlan from an interface name
+func FromName(name string) (*Ipvlan, error) {
+	s, err := slave.FromName(name, linkType)
+	if err != nil {
+		return nil, err
+	}
+	return &Ipvlan{s}, nil
+}
+
+// FromLinkIndex returns an Ipvlan from an interface index
+func FromLinkIndex(li int) (*Ipvlan, error) {
+	s, err := slave.FromLinkIndex(li, linkType)
+	if err != nil {
+		return nil, err
+	}
+	return &Ipvlan{s}, nil
+}
+
+// FromLink returns an Ipvlan from an interface link
+func FromLink(link netlink.Link) (*Ipvlan, error) {
+	s, err := slave.FromLink(link, linkType)
+	if err != nil {
+		return nil, err
+	}
+	return &Ipvlan{s}, nil
+}
+
+// Mode returns the ipvlan mode
+func (i *Ipvlan) Mode() (netlink.IPVlanMode, error) {
+	nl, err := i.nl()
+	if err != nil {
+		return 0, err
+	}
+	return nl.Mode, nil
+}
@@ -0,0 +1,66 @@
+// Package kernel is the single point through which vxrouter talks to the kernel.
+// By default calls go straight to netlink, but a different implementation
+// (such as the in-memory one in kernel/kerneltest) can be swapped in with Set.
+package kernel
+
+import (
+	"net"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Netlink is the subset of netlink operations used by vxrouter
+type Netlink interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetTxQLen(link netlink.Link, qlen int) error
+	LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error
+	LinkSetMasterByIndex(link netlink.Link, masterIndex int) error
+	LinkSetAlias(link netlink.Link, name string) error
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	NeighAppend(neigh *netlink.Neigh) error
+	NeighDel(neigh *netlink.Neigh) error
+	NeighList(linkIndex, family int) ([]netlink.Neigh, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteGet(destination net.IP) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+}
+
+// handle adds the package level subscribe functions to netlink.Handle
+type handle struct {
+	*netlink.Handle
+}
+
+func (h *handle) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribe(ch, done)
+}
+
+var (
+	nlh Netlink = &handle{&netlink.Handle{}}
+	nlm sync.RWMutex
+)
+
+// Get returns the netlink implementation currently in use
+func Get() Netlink {
+	nlm.RLock()
+	defer nlm.RUnlock()
+	return nlh
+}
+
+// Set replaces the netlink implementation, returning the previous one
+func Set(h Netlink) Netlink {
+	nlm.Lock()
+	defer nlm.Unlock()
+	o := nlh
+	nlh = h
+	return o
+}
@@ -0,0 +1,687 @@
+// Package kerneltest provides an in-memory implementation of kernel.Netlink
+// it models links, lower/master relationships, addresses and routes closely enough
+// to exercise vxrouter without root or a real network namespace
+package kerneltest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	rtnUnicast    = 1
+	rtnLocal      = 2
+	rtProtoKernel = 2
+	rtTableMain   = 254
+	rtTableLocal  = 255
+)
+
+// Netlink is an in-memory kernel
+type Netlink struct {
+	l         sync.Mutex
+	nextIndex int
+	links     map[int]netlink.Link
+	addrs     map[int][]netlink.Addr
+	neighs    map[int][]netlink.Neigh
+	routes    []netlink.Route
+	subs      map[*subscription]struct{}
+}
+
+// New returns an empty kernel with only a loopback interface
+func New() *Netlink {
+	n := &Netlink{
+		nextIndex: 1,
+		links:     make(map[int]netlink.Link),
+		addrs:     make(map[int][]netlink.Addr),
+		neighs:    make(map[int][]netlink.Neigh),
+		subs:      make(map[*subscription]struct{}),
+	}
+	lo := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", MTU: 65536}}
+	_ = n.LinkAdd(lo)   // nolint: errcheck
+	_ = n.LinkSetUp(lo) // nolint: errcheck
+	return n
+}
+
+func copyLink(link netlink.Link) netlink.Link {
+	v := reflect.New(reflect.TypeOf(link).Elem())
+	v.Elem().Set(reflect.ValueOf(link).Elem())
+	r := v.Interface().(netlink.Link)
+	a := r.Attrs()
+	a.HardwareAddr = append(net.HardwareAddr(nil), a.HardwareAddr...)
+	return r
+}
+
+func randomMac() net.HardwareAddr {
+	hw := make(net.HardwareAddr, 6)
+	_, _ = rand.Read(hw) // nolint: errcheck
+	hw[0] = (hw[0] | 0x02) & 0xfe
+	return hw
+}
+
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+func ipNetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+func normalizeRoute(r netlink.Route) netlink.Route {
+	if r.Table == 0 {
+		r.Table = rtTableMain
+	}
+	if r.Type == 0 {
+		r.Type = rtnUnicast
+	}
+	if r.Dst != nil {
+		r.Dst = &net.IPNet{IP: r.Dst.IP.Mask(r.Dst.Mask), Mask: r.Dst.Mask}
+	}
+	return r
+}
+
+// lookup must be called with n.l held
+func (n *Netlink) lookup(link netlink.Link) (netlink.Link, error) {
+	a := link.Attrs()
+	if a.Index != 0 {
+		if l, ok := n.links[a.Index]; ok {
+			return l, nil
+		}
+		return nil, syscall.ENODEV
+	}
+	for _, l := range n.links {
+		if l.Attrs().Name == a.Name {
+			return l, nil
+		}
+	}
+	return nil, syscall.ENODEV
+}
+
+// LinkAdd adds a link, and sets the index on the passed link as netlink does
+func (n *Netlink) LinkAdd(link netlink.Link) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	a := link.Attrs()
+	if a.Name == "" {
+		return syscall.EINVAL
+	}
+	for _, l := range n.links {
+		if l.Attrs().Name == a.Name {
+			return syscall.EEXIST
+		}
+	}
+
+	var parent netlink.Link
+	if a.ParentIndex != 0 {
+		var ok bool
+		if parent, ok = n.links[a.ParentIndex]; !ok {
+			return syscall.ENODEV
+		}
+	}
+
+	switch nl := link.(type) {
+	case *netlink.Macvlan, *netlink.IPVlan:
+		if parent == nil {
+			return syscall.EINVAL
+		}
+	case *netlink.Vxlan:
+		if nl.VtepDevIndex != 0 {
+			if _, ok := n.links[nl.VtepDevIndex]; !ok {
+				return syscall.ENODEV
+			}
+		}
+		for _, l := range n.links {
+			if v, ok := l.(*netlink.Vxlan); ok && v.VxlanId == nl.VxlanId && v.Port == nl.Port {
+				return syscall.EEXIST
+			}
+		}
+	}
+
+	c := copyLink(link)
+	ca := c.Attrs()
+	ca.Index = n.nextIndex
+	n.nextIndex++
+	ca.Flags &^= net.FlagUp
+	ca.OperState = netlink.OperDown
+	if ca.MTU == 0 {
+		ca.MTU = 1500
+		if parent != nil {
+			ca.MTU = parent.Attrs().MTU
+		}
+		if _, ok := c.(*netlink.Vxlan); ok {
+			ca.MTU = 1450
+		}
+	}
+	if len(ca.HardwareAddr) == 0 {
+		switch {
+		case c.Type() == "ipvlan" && parent != nil:
+			ca.HardwareAddr = append(net.HardwareAddr(nil), parent.Attrs().HardwareAddr...)
+		case ca.Name != "lo":
+			ca.HardwareAddr = randomMac()
+		}
+	}
+	n.links[ca.Index] = c
+
+	a.Index = ca.Index
+	return nil
+}
+
+// LinkDel deletes a link, the links stacked on top of it, and its addresses and routes
+func (n *Netlink) LinkDel(link netlink.Link) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	n.del(l.Attrs().Index)
+	return nil
+}
+
+// del must be called with n.l held
+func (n *Netlink) del(idx int) {
+	delete(n.links, idx)
+	delete(n.addrs, idx)
+	delete(n.neighs, idx)
+
+	routes := n.routes[:0]
+	for _, r := range n.routes {
+		if r.LinkIndex != idx {
+			routes = append(routes, r)
+		}
+	}
+	n.routes = routes
+
+	for i, l := range n.links {
+		a := l.Attrs()
+		if a.MasterIndex == idx {
+			a.MasterIndex = 0
+		}
+		if a.ParentIndex == idx {
+			n.del(i)
+		}
+	}
+}
+
+// LinkByName returns a copy of the named link
+func (n *Netlink) LinkByName(name string) (netlink.Link, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	for _, l := range n.links {
+		if l.Attrs().Name == name {
+			return copyLink(l), nil
+		}
+	}
+	return nil, fmt.Errorf("Link %s not found", name)
+}
+
+// LinkByIndex returns a copy of the link with index
+func (n *Netlink) LinkByIndex(index int) (netlink.Link, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	if l, ok := n.links[index]; ok {
+		return copyLink(l), nil
+	}
+	return nil, fmt.Errorf("Link not found")
+}
+
+// LinkList returns copies of all links, ordered by index
+func (n *Netlink) LinkList() ([]netlink.Link, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	r := []netlink.Link{}
+	for _, l := range n.links {
+		r = append(r, copyLink(l))
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Attrs().Index < r[j].Attrs().Index })
+	return r, nil
+}
+
+// LinkSetUp sets a link administratively and operationally up
+func (n *Netlink) LinkSetUp(link netlink.Link) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().Flags |= net.FlagUp
+	l.Attrs().OperState = netlink.OperUp
+	return nil
+}
+
+// LinkSetMTU sets the mtu of a link
+func (n *Netlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	if mtu < 68 {
+		return syscall.EINVAL
+	}
+	l.Attrs().MTU = mtu
+	return nil
+}
+
+// LinkSetTxQLen sets the transmit queue length of a link
+func (n *Netlink) LinkSetTxQLen(link netlink.Link, qlen int) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	if qlen < 0 {
+		return syscall.EINVAL
+	}
+	l.Attrs().TxQLen = qlen
+	return nil
+}
+
+// LinkSetHardwareAddr sets the hardware address of a link
+func (n *Netlink) LinkSetHardwareAddr(link netlink.Link, hwaddr net.HardwareAddr) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	l.Attrs().HardwareAddr = append(net.HardwareAddr(nil), hwaddr...)
+	return nil
+}
+
+// LinkSetAlias sets the alias of a link
+func (n *Netlink) LinkSetAlias(link netlink.Link, name string) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	if len(name) >= 256 {
+		return syscall.EINVAL
+	}
+	l.Attrs().Alias = name
+	return nil
+}
+
+// LinkSetMasterByIndex enslaves a link to the master with masterIndex, or releases it if masterIndex is 0
+// the routes of a link enslaved to a vrf move to the vrf's table, as they would in the kernel
+func (n *Netlink) LinkSetMasterByIndex(link netlink.Link, masterIndex int) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	if masterIndex != 0 {
+		if _, ok := n.links[masterIndex]; !ok {
+			return syscall.ENODEV
+		}
+	}
+	idx := l.Attrs().Index
+	oldMain, oldLocal := n.tables(idx)
+	l.Attrs().MasterIndex = masterIndex
+	newMain, newLocal := n.tables(idx)
+
+	for i, r := range n.routes {
+		if r.LinkIndex != idx || r.Protocol != rtProtoKernel {
+			continue
+		}
+		switch r.Table {
+		case oldMain:
+			n.routes[i].Table = newMain
+		case oldLocal:
+			n.routes[i].Table = newLocal
+		}
+	}
+	return nil
+}
+
+// tables returns the tables the connected and local routes of link idx go in, n.l must be held
+func (n *Netlink) tables(idx int) (int, int) {
+	l, ok := n.links[idx]
+	if !ok {
+		return rtTableMain, rtTableLocal
+	}
+	if vrf, ok := n.links[l.Attrs().MasterIndex].(*netlink.Vrf); ok {
+		return int(vrf.Table), int(vrf.Table)
+	}
+	return rtTableMain, rtTableLocal
+}
+
+// AddrAdd adds an address to a link, along with the connected and local routes the kernel would add
+func (n *Netlink) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	l, err := n.lookup(link)
+	if err != nil {
+		return err
+	}
+	idx := l.Attrs().Index
+	for _, a := range n.addrs[idx] {
+		if ipNetEqual(a.IPNet, addr.IPNet) {
+			return syscall.EEXIST
+		}
+	}
+
+	a := *addr
+	a.IPNet = &net.IPNet{IP: append(net.IP(nil), addr.IP...), Mask: append(net.IPMask(nil), addr.Mask...)}
+	n.addrs[idx] = append(n.addrs[idx], a)
+	mainTable, localTable := n.tables(idx)
+
+	local := normalizeRoute(netlink.Route{
+		LinkIndex: idx,
+		Dst:       netlink.NewIPNet(a.IP),
+		Src:       a.IP,
+		Protocol:  rtProtoKernel,
+		Scope:     netlink.SCOPE_HOST,
+		Table:     localTable,
+		Type:      rtnLocal,
+	})
+	n.routes = append(n.routes, local)
+
+	connected := normalizeRoute(netlink.Route{
+		LinkIndex: idx,
+		Dst:       a.IPNet,
+		Src:       a.IP,
+		Protocol:  rtProtoKernel,
+		Scope:     netlink.SCOPE_LINK,
+		Table:     mainTable,
+	})
+	for _, r := range n.routes {
+		if r.LinkIndex == idx && r.Table == connected.Table && ipNetEqual(r.Dst, connected.Dst) {
+			return nil
+		}
+	}
+	n.routes = append(n.routes, connected)
+	return nil
+}
+
+func neighEqual(a, b *netlink.Neigh) bool {
+	return a.Family == b.Family && a.IP.Equal(b.IP) && a.HardwareAddr.String() == b.HardwareAddr.String()
+}
+
+// NeighAppend adds a neighbor or fdb entry, alongside any other entries for the same mac address
+func (n *Netlink) NeighAppend(neigh *netlink.Neigh) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	if _, ok := n.links[neigh.LinkIndex]; !ok {
+		return syscall.ENODEV
+	}
+	for i := range n.neighs[neigh.LinkIndex] {
+		if neighEqual(&n.neighs[neigh.LinkIndex][i], neigh) {
+			return syscall.EEXIST
+		}
+	}
+	nn := *neigh
+	nn.IP = append(net.IP(nil), neigh.IP...)
+	nn.HardwareAddr = append(net.HardwareAddr(nil), neigh.HardwareAddr...)
+	n.neighs[neigh.LinkIndex] = append(n.neighs[neigh.LinkIndex], nn)
+	return nil
+}
+
+// NeighDel deletes a neighbor or fdb entry
+func (n *Netlink) NeighDel(neigh *netlink.Neigh) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	ns := n.neighs[neigh.LinkIndex]
+	for i := range ns {
+		if neighEqual(&ns[i], neigh) {
+			n.neighs[neigh.LinkIndex] = append(ns[:i], ns[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+// NeighList lists the neighbor or fdb entries of family on a link, or on all links if linkIndex is 0
+func (n *Netlink) NeighList(linkIndex, family int) ([]netlink.Neigh, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	r := []netlink.Neigh{}
+	for idx, ns := range n.neighs {
+		if linkIndex != 0 && idx != linkIndex {
+			continue
+		}
+		for _, nn := range ns {
+			if family == 0 || nn.Family == family {
+				r = append(r, nn)
+			}
+		}
+	}
+	return r, nil
+}
+
+// AddrList lists addresses on link, or on all links if link is nil
+func (n *Netlink) AddrList(link netlink.Link, fam int) ([]netlink.Addr, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	idxs := []int{}
+	if link != nil {
+		l, err := n.lookup(link)
+		if err != nil {
+			return nil, err
+		}
+		idxs = append(idxs, l.Attrs().Index)
+	} else {
+		for i := range n.addrs {
+			idxs = append(idxs, i)
+		}
+		sort.Ints(idxs)
+	}
+
+	r := []netlink.Addr{}
+	for _, i := range idxs {
+		for _, a := range n.addrs[i] {
+			if fam != netlink.FAMILY_ALL && family(a.IP) != fam {
+				continue
+			}
+			r = append(r, a)
+		}
+	}
+	return r, nil
+}
+
+// RouteAdd adds a route, failing if one already exists with the same destination, table, tos and priority
+func (n *Netlink) RouteAdd(route *netlink.Route) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	r := normalizeRoute(*route)
+	if r.Dst == nil {
+		return syscall.EINVAL
+	}
+	if r.LinkIndex != 0 {
+		if _, ok := n.links[r.LinkIndex]; !ok {
+			return syscall.ENODEV
+		}
+	}
+	for _, e := range n.routes {
+		if e.Table == r.Table && e.Tos == r.Tos && e.Priority == r.Priority && ipNetEqual(e.Dst, r.Dst) {
+			return syscall.EEXIST
+		}
+	}
+	n.routes = append(n.routes, r)
+	n.publish(netlink.RouteUpdate{Type: syscall.RTM_NEWROUTE, Route: r})
+	return nil
+}
+
+// RouteDel deletes the first route matching all of the fields set in route
+func (n *Netlink) RouteDel(route *netlink.Route) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	d := normalizeRoute(*route)
+	for i, r := range n.routes {
+		switch {
+		case r.Table != d.Table:
+		case !ipNetEqual(r.Dst, d.Dst):
+		case d.LinkIndex != 0 && r.LinkIndex != d.LinkIndex:
+		case d.Protocol != 0 && r.Protocol != d.Protocol:
+		case d.Gw != nil && !r.Gw.Equal(d.Gw):
+		case d.Priority != 0 && r.Priority != d.Priority:
+		default:
+			n.routes = append(n.routes[:i], n.routes[i+1:]...)
+			n.publish(netlink.RouteUpdate{Type: syscall.RTM_DELROUTE, Route: r})
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+// RouteGet returns the route the main table would use to reach destination
+func (n *Netlink) RouteGet(destination net.IP) ([]netlink.Route, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	var best *netlink.Route
+	bestLen := -1
+	for i, r := range n.routes {
+		if r.Table != rtTableMain || r.Dst == nil || family(r.Dst.IP) != family(destination) || !r.Dst.Contains(destination) {
+			continue
+		}
+		if l, _ := r.Dst.Mask.Size(); l > bestLen {
+			best, bestLen = &n.routes[i], l
+		}
+	}
+	if best == nil {
+		return nil, syscall.ENETUNREACH
+	}
+
+	r := *best
+	r.Dst = netlink.NewIPNet(destination)
+	return []netlink.Route{r}, nil
+}
+
+// RouteListFiltered lists routes as netlink.RouteListFiltered would
+func (n *Netlink) RouteListFiltered(fam int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	n.l.Lock()
+	defer n.l.Unlock()
+
+	res := []netlink.Route{}
+	for _, r := range n.routes {
+		if fam != netlink.FAMILY_ALL && (r.Dst == nil || family(r.Dst.IP) != fam) {
+			continue
+		}
+		if r.Table != rtTableMain && (filter == nil || filterMask&netlink.RT_FILTER_TABLE == 0) {
+			continue
+		}
+		if filter != nil && !routeMatches(r, filter, filterMask) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+func routeMatches(r netlink.Route, f *netlink.Route, m uint64) bool {
+	switch {
+	case m&netlink.RT_FILTER_TABLE != 0 && f.Table != 0 && r.Table != f.Table:
+	case m&netlink.RT_FILTER_PROTOCOL != 0 && r.Protocol != f.Protocol:
+	case m&netlink.RT_FILTER_SCOPE != 0 && r.Scope != f.Scope:
+	case m&netlink.RT_FILTER_TYPE != 0 && r.Type != f.Type:
+	case m&netlink.RT_FILTER_TOS != 0 && r.Tos != f.Tos:
+	case m&netlink.RT_FILTER_OIF != 0 && r.LinkIndex != f.LinkIndex:
+	case m&netlink.RT_FILTER_IIF != 0 && r.ILinkIndex != f.ILinkIndex:
+	case m&netlink.RT_FILTER_GW != 0 && !r.Gw.Equal(f.Gw):
+	case m&netlink.RT_FILTER_SRC != 0 && !r.Src.Equal(f.Src):
+	case m&netlink.RT_FILTER_DST != 0 && !ipNetEqual(r.Dst, f.Dst):
+	case m&netlink.RT_FILTER_HOPLIMIT != 0 && r.Hoplimit != f.Hoplimit:
+	default:
+		return true
+	}
+	return false
+}
+
+type subscription struct {
+	ch   chan<- netlink.RouteUpdate
+	done <-chan struct{}
+
+	l      sync.Mutex
+	queue  []netlink.RouteUpdate
+	notify chan struct{}
+}
+
+// RouteSubscribe sends route changes to ch until done is closed, then closes ch
+// updates are queued, so a slow reader never blocks changes to the kernel
+func (n *Netlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	s := &subscription{ch: ch, done: done, notify: make(chan struct{}, 1)}
+
+	n.l.Lock()
+	n.subs[s] = struct{}{}
+	n.l.Unlock()
+
+	go func() {
+		defer close(ch)
+		defer func() {
+			n.l.Lock()
+			delete(n.subs, s)
+			n.l.Unlock()
+		}()
+		for {
+			s.l.Lock()
+			q := s.queue
+			s.queue = nil
+			s.l.Unlock()
+
+			for _, u := range q {
+				select {
+				case ch <- u:
+				case <-done:
+					return
+				}
+			}
+
+			select {
+			case <-s.notify:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// publish queues a route update for all subscribers, n.l must be held
+func (n *Netlink) publish(u netlink.RouteUpdate) {
+	for s := range n.subs {
+		s.l.Lock()
+		s.queue = append(s.queue, u)
+		s.l.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package metrics holds the prometheus metrics exported by vxrnet
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "vxrouter"
+
+var (
+	// DriverCalls counts calls to the docker plugin drivers
+	DriverCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "driver_calls_total",
+		Help:      "Calls to the ipam and network drivers.",
+	}, []string{"driver", "method", "result"})
+
+	// DriverCallDuration is the duration of calls to the docker plugin drivers
+	DriverCallDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "driver_call_duration_seconds",
+		Help:      "Duration of calls to the ipam and network drivers.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"driver", "method"})
+
+	// SelectAddressDuration is the time taken to select and claim an address
+	SelectAddressDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "select_address_duration_seconds",
+		Help:      "Time taken to select and claim an address, including propagation waits.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"network"})
+
+	// AllocationRetries counts address selection attempts that did not yield an address
+	AllocationRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocation_retries_total",
+		Help:      "Address selection attempts which had to be retried.",
+	}, []string{"network"})
+
+	// AllocationCollisions counts addresses claimed by another host during propagation
+	AllocationCollisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocation_collisions_total",
+		Help:      "Addresses which another host claimed during the propagation wait.",
+	}, []string{"network"})
+
+	// AllocationTimeouts counts address selections which hit the response timeout
+	AllocationTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "allocation_timeouts_total",
+		Help:      "Address selections which expired the response timeout.",
+	}, []string{"network"})
+
+	// DuplicateClaims counts addresses claimed by this host which another host also claimed
+	DuplicateClaims = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_claims_total",
+		Help:      "Addresses claimed by this host which another host also claimed.",
+	}, []string{"network"})
+
+	// DuplicateClaimsReleased counts claims released by the duplicate claim tie-break
+	DuplicateClaimsReleased = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "duplicate_claims_released_total",
+		Help:      "Duplicate claims released by this host to resolve the conflict.",
+	}, []string{"network"})
+
+	// ReconcileDuration is the duration of reconcile runs
+	ReconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of reconcile runs.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// ReconcileRoutesAdded counts missing routes added by reconcile
+	ReconcileRoutesAdded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_routes_added_total",
+		Help:      "Missing container routes added by reconcile.",
+	})
+
+	// ReconcileRoutesDeleted counts orphaned routes deleted by reconcile
+	ReconcileRoutesDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_routes_deleted_total",
+		Help:      "Orphaned routes deleted by reconcile.",
+	})
+
+	// JournalRollbacks counts pending claims rolled back when replaying the journal
+	JournalRollbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "journal_rollbacks_total",
+		Help:      "Pending claims rolled back on startup because they were never handed to a container.",
+	})
+
+	// InterfacesCreated counts host interfaces created
+	InterfacesCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_interfaces_created_total",
+		Help:      "Host vxlan interfaces created.",
+	}, []string{"network"})
+
+	// InterfacesRecreated counts host vxlans recreated to apply changed network options
+	InterfacesRecreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_interfaces_recreated_total",
+		Help:      "Host vxlan interfaces recreated to apply changed network options.",
+	}, []string{"network"})
+
+	// InterfacesDeleted counts host interfaces deleted
+	InterfacesDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "host_interfaces_deleted_total",
+		Help:      "Host vxlan interfaces deleted.",
+	}, []string{"network"})
+)
+
+// DriverCall records a driver call which started at start, intended to be deferred with a pointer to the named error result
+func DriverCall(driver, method string, start time.Time, err *error) {
+	result := "success"
+	if err != nil && *err != nil {
+		result = "error"
+	}
+	DriverCalls.WithLabelValues(driver, method, result).Inc()
+	DriverCallDuration.WithLabelValues(driver, method).Observe(time.Since(start).Seconds())
+}
+
+// claimedCollector reports claimed addresses per network at scrape time, from the kernel routing table
+type claimedCollector struct {
+	desc    *prometheus.Desc
+	claimed func() (map[string]int, error)
+}
+
+func (c *claimedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *claimedCollector) Collect(ch chan<- prometheus.Metric) {
+	claimed, err := c.claimed()
+	if err != nil {
+		log.WithError(err).Error("failed to get claimed addresses")
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for n, v := range claimed {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(v), n)
+	}
+}
+
+// Listen registers the claimed addresses gauge and serves /metrics on addr
+// claimed returns the number of addresses claimed by this host for each network
+func Listen(addr string, claimed func() (map[string]int, error)) (*http.Server, error) {
+	err := prometheus.Register(&claimedCollector{
+		desc:    prometheus.NewDesc(namespace+"_claimed_addresses", "Addresses claimed by this host.", []string{"network"}, nil),
+		claimed: claimed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("metrics server failed")
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,165 @@
+// Package options is the schema of the network options (docker network create -o) understood by vxrnet
+// each package registers the options it reads, so they can be validated when the network is created
+package options
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/TrilliumIT/vxrouter"
+)
+
+// Kind is the type of value an option takes
+type Kind string
+
+// Option kinds
+const (
+	String    Kind = "string"
+	Int       Kind = "int"
+	Bool      Kind = "bool"
+	IP        Kind = "ip"
+	MAC       Kind = "mac"
+	Interface Kind = "interface"
+)
+
+// Option describes a network option
+type Option struct {
+	Name  string `json:"name"`
+	Kind  Kind   `json:"kind"`
+	Usage string `json:"usage"`
+	// Int options must be between Min and Max, unless both are 0
+	Min int `json:"min,omitempty"`
+	Max int `json:"max,omitempty"`
+	// Values are the allowed values of a String option, any value is allowed if there are none
+	Values []string `json:"values,omitempty"`
+	// Check replaces the validation of the kind, for values with their own parser
+	Check func(string) error `json:"-"`
+}
+
+// ifNameSize is the size of an interface name including the terminating null byte
+const ifNameSize = 16
+
+var (
+	registryL sync.RWMutex
+	registry  = make(map[string]Option)
+)
+
+// Register adds options to the schema, it returns true so packages can register from a var declaration
+func Register(opts ...Option) bool {
+	registryL.Lock()
+	defer registryL.Unlock()
+	for _, o := range opts {
+		registry[strings.ToLower(o.Name)] = o
+	}
+	return true
+}
+
+// Lookup returns the option called name
+func Lookup(name string) (Option, bool) {
+	registryL.RLock()
+	defer registryL.RUnlock()
+	o, ok := registry[strings.ToLower(name)]
+	return o, ok
+}
+
+// All returns every registered option, sorted by name
+func All() []Option {
+	registryL.RLock()
+	defer registryL.RUnlock()
+	r := make([]Option, 0, len(registry))
+	for _, o := range registry {
+		r = append(r, o)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r
+}
+
+// Validate returns an error for the first unknown or invalid option in opts
+func Validate(opts map[string]string) error {
+	names := make([]string, 0, len(opts))
+	for k := range opts {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		o, ok := Lookup(k)
+		if !ok {
+			return fmt.Errorf("unknown option %q, see vxrnet options", k)
+		}
+		if err := o.Validate(opts[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Env returns the name of the environment variable holding the default of the option
+func (o Option) Env() string {
+	return vxrouter.EnvPrefix + o.Name
+}
+
+// Validate returns an error if v is not a valid value for the option
+func (o Option) Validate(v string) error {
+	err := o.validate(v)
+	if err != nil {
+		return fmt.Errorf("invalid value %q for option %v: %v", v, o.Name, err)
+	}
+	return nil
+}
+
+func (o Option) validate(v string) error {
+	if o.Check != nil {
+		return o.Check(v)
+	}
+
+	switch o.Kind {
+	case Int:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if (o.Min != 0 || o.Max != 0) && (i < o.Min || i > o.Max) {
+			return fmt.Errorf("must be between %v and %v", o.Min, o.Max)
+		}
+	case Bool:
+		_, err := strconv.ParseBool(v)
+		return err
+	case IP:
+		if net.ParseIP(v) == nil {
+			return fmt.Errorf("not an ip address")
+		}
+	case MAC:
+		_, err := net.ParseMAC(v)
+		return err
+	case Interface:
+		return validInterfaceName(v)
+	case String:
+		if len(o.Values) == 0 {
+			return nil
+		}
+		for _, a := range o.Values {
+			if v == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %v", strings.Join(o.Values, ", "))
+	}
+	return nil
+}
+
+// validInterfaceName checks the syntax of an interface name like the kernel does, the interface need not exist on this host
+// since options of global scope networks are validated on whichever host creates the network
+func validInterfaceName(v string) error {
+	if v == "" || len(v) >= ifNameSize || v == "." || v == ".." {
+		return fmt.Errorf("not an interface name")
+	}
+	if strings.ContainsAny(v, "/: \t\n") {
+		return fmt.Errorf("not an interface name")
+	}
+	return nil
+}
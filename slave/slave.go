@@ -0,0 +1,196 @@
+// Package slave holds what macvlans and ipvlans on a vxlan have in common, both are a named link of one type
+// with a parent (lower) device, and the macvlan and ipvlan packages only add creation and their mode
+package slave
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+)
+
+// Slave is a link of type typ, for either a host or a container
+type Slave struct {
+	name string
+	typ  string
+	log  *log.Entry
+}
+
+// New returns a Slave of type typ, as returned by netlink.Link.Type(), called name. The link need not exist yet
+func New(name, typ string) *Slave {
+	log := log.WithField(typ, name)
+	log.WithField("Func", "New()").Debug()
+	return &Slave{name, typ, log}
+}
+
+// Link returns the netlink link of the slave, or an error if it doesn't exist or is of another type
+func (s *Slave) Link() (netlink.Link, error) {
+	log := s.log.WithField("Func", "Link()")
+	log.Debug()
+
+	link, err := kernel.Get().LinkByName(s.name)
+	if err != nil {
+		log.WithError(err).Debug("failed to get link by name")
+		return nil, err
+	}
+
+	return link, s.check(link)
+}
+
+func (s *Slave) check(link netlink.Link) error {
+	if link.Type() != s.typ {
+		return fmt.Errorf("link is not a %v", s.typ)
+	}
+	return nil
+}
+
+// FromName returns a Slave of type typ from an interface name
+func FromName(name, typ string) (*Slave, error) {
+	s := New(name, typ)
+	if _, err := s.Link(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// FromLinkIndex returns a Slave of type typ from an interface index
+func FromLinkIndex(li int, typ string) (*Slave, error) {
+	l, err := kernel.Get().LinkByIndex(li)
+	if err != nil {
+		return nil, err
+	}
+
+	return FromLink(l, typ)
+}
+
+// FromLink returns a Slave of type typ from an interface link
+func FromLink(link netlink.Link, typ string) (*Slave, error) {
+	s := New(link.Attrs().Name, typ)
+	log := s.log.WithField("Func", "FromLink()")
+	log.Debug()
+
+	if err := s.check(link); err != nil {
+		log.WithError(err).Debug()
+		return nil, err
+	}
+	return s, nil
+}
+
+// AddAddress adds an ip address to the interface
+func (s *Slave) AddAddress(addr *net.IPNet) error {
+	log := s.log.WithField("Func", "AddAddress()")
+	log.Debug()
+
+	link, err := s.Link()
+	if err != nil {
+		log.WithError(err).Debug()
+		return err
+	}
+
+	a := &netlink.Addr{IPNet: addr}
+	// skip duplicate address detection on ipv6, addresses are claimed with routes instead
+	// and a tentative gateway would be unusable until dad completes
+	if addr.IP.To4() == nil {
+		a.Flags = syscall.IFA_F_NODAD
+	}
+	return kernel.Get().AddrAdd(link, a)
+}
+
+// Delete deletes the interface
+func (s *Slave) Delete() error {
+	log := s.log.WithField("Func", "Delete()")
+	log.Debug()
+
+	link, err := s.Link()
+	if err != nil {
+		log.WithError(err).Debug("link doesn't exist, nothing to delete")
+		return nil
+	}
+
+	// verify a parent interface isn't being deleted
+	if link.Attrs().ParentIndex == 0 {
+		err = fmt.Errorf("interface is not a slave")
+		log.WithError(err).Debug()
+		return err
+	}
+
+	// delete the slave device
+	return kernel.Get().LinkDel(link)
+}
+
+// GetAddresses returns IP Addresses on the interface
+func (s *Slave) GetAddresses() ([]*net.IPNet, error) {
+	log := s.log.WithField("Func", "GetAddresses()")
+	log.Debug()
+
+	link, err := s.Link()
+	if err != nil {
+		log.WithError(err).Debug()
+		return nil, err
+	}
+
+	addrs, err := kernel.Get().AddrList(link, 0)
+	if err != nil {
+		log.WithError(err).Debug()
+		return nil, err
+	}
+	r := []*net.IPNet{}
+	for _, a := range addrs {
+		r = append(r, a.IPNet)
+	}
+	return r, nil
+}
+
+// HasAddress returns true if addr is bound to the interface
+func (s *Slave) HasAddress(addr *net.IPNet) bool {
+	log := s.log.WithField("Func", "HasAddress()")
+	log.Debug()
+
+	addrs, err := s.GetAddresses()
+	if err != nil {
+		log.WithError(err).Debug()
+	}
+
+	for _, a := range addrs {
+		if a.IP.Equal(addr.IP) && a.Mask.String() == addr.Mask.String() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetParentIndex returns the index of the parent interface
+func (s *Slave) GetParentIndex() int {
+	log := s.log.WithField("Func", "GetParentIndex()")
+	log.Debug()
+
+	link, err := s.Link()
+	if err != nil {
+		log.WithError(err).Debug()
+		return 0
+	}
+	return link.Attrs().ParentIndex
+}
+
+// GetIndex returns the index of the interface
+func (s *Slave) GetIndex() int {
+	log := s.log.WithField("Func", "GetIndex()")
+	log.Debug()
+
+	link, err := s.Link()
+	if err != nil {
+		log.WithError(err).Debug()
+		return 0
+	}
+	return link.Attrs().Index
+}
+
+// Name returns the name
+func (s *Slave) Name() string {
+	return s.name
+}
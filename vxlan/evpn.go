@@ -0,0 +1,173 @@
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+var evpnOption = options.Option{
+	Name:  "evpn",
+	Kind:  options.Bool,
+	Usage: "advertise mac addresses with bgp evpn and program the remote ones, instead of learning them. Requires the bgp speaker",
+}
+
+var _ = options.Register(evpnOption)
+
+// MACIP is a mac address in a vxlan, and optionally an address using it
+type MACIP struct {
+	MAC net.HardwareAddr
+	IP  net.IP
+}
+
+// Remote is a mac address behind a remote vtep
+type Remote struct {
+	MACIP
+	VTEP net.IP
+}
+
+// EVPN returns true if the evpn option, or it's environment default, is set
+func EVPN(opts map[string]string) bool {
+	e, ok := opts[evpnOption.Name]
+	if !ok {
+		e = os.Getenv(evpnOption.Env())
+	}
+	b, _ := strconv.ParseBool(e)
+	return b
+}
+
+// ValidEVPN returns an error if opts enables evpn along with options which manage the fdb another way
+func ValidEVPN(opts map[string]string) error {
+	if !EVPN(opts) {
+		return nil
+	}
+	if l, err := strconv.ParseBool(opts["learning"]); err == nil && l {
+		return fmt.Errorf("learning can't be enabled on an evpn network")
+	}
+	if _, ok := opts[peersOption.Name]; ok {
+		return fmt.Errorf("peers can't be set on an evpn network, flood entries are learned from bgp")
+	}
+	return nil
+}
+
+// SyncRemotes makes the static fdb and neighbor entries of the vxlan match remotes, and it's flood entries match flood
+// on an evpn network the bgp speaker owns the fdb, so any other static entries are removed
+func (v *Vxlan) SyncRemotes(remotes []Remote, flood []net.IP) error {
+	log := v.log.WithField("Func", "SyncRemotes()")
+	log.Debug()
+
+	nl, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return err
+	}
+	idx := nl.Attrs().Index
+
+	// fdb entries are keyed by mac and vtep, neighbor entries by address
+	wantFDB := make(map[string]*netlink.Neigh)
+	wantNeigh := make(map[string]*netlink.Neigh)
+	addFDB := func(mac net.HardwareAddr, vtep net.IP) {
+		wantFDB[mac.String()+" "+vtep.String()] = &netlink.Neigh{
+			LinkIndex:    idx,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			IP:           vtep,
+			HardwareAddr: mac,
+		}
+	}
+	for _, f := range flood {
+		addFDB(zeroMAC, f)
+	}
+	for _, r := range remotes {
+		addFDB(r.MAC, r.VTEP)
+		if r.IP == nil {
+			continue
+		}
+		fam := netlink.FAMILY_V4
+		if r.IP.To4() == nil {
+			fam = netlink.FAMILY_V6
+		}
+		wantNeigh[r.IP.String()] = &netlink.Neigh{
+			LinkIndex:    idx,
+			Family:       fam,
+			State:        netlink.NUD_PERMANENT,
+			IP:           r.IP,
+			HardwareAddr: r.MAC,
+		}
+	}
+
+	fdb, err := kernel.Get().NeighList(idx, syscall.AF_BRIDGE)
+	if err != nil {
+		log.WithError(err).Debug("failed to list fdb")
+		return err
+	}
+	for i := range fdb {
+		n := &fdb[i]
+		if n.IP == nil || n.State&netlink.NUD_PERMANENT == 0 {
+			continue
+		}
+		// the entry for the group option is made by the kernel
+		if bytes.Equal(n.HardwareAddr, zeroMAC) && n.IP.Equal(nl.Group) {
+			continue
+		}
+		k := n.HardwareAddr.String() + " " + n.IP.String()
+		if _, ok := wantFDB[k]; ok {
+			delete(wantFDB, k)
+			continue
+		}
+		log.WithField("mac", n.HardwareAddr.String()).WithField("vtep", n.IP.String()).Debug("removing fdb entry")
+		if err = kernel.Get().NeighDel(n); err != nil {
+			log.WithError(err).WithField("mac", n.HardwareAddr.String()).Error("failed to remove fdb entry")
+			return err
+		}
+	}
+
+	for _, fam := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		var neighs []netlink.Neigh
+		neighs, err = kernel.Get().NeighList(idx, fam)
+		if err != nil {
+			log.WithError(err).Debug("failed to list neighbors")
+			return err
+		}
+		for i := range neighs {
+			n := &neighs[i]
+			if n.State&netlink.NUD_PERMANENT == 0 {
+				continue
+			}
+			if w, ok := wantNeigh[n.IP.String()]; ok && bytes.Equal(w.HardwareAddr, n.HardwareAddr) {
+				delete(wantNeigh, n.IP.String())
+				continue
+			}
+			log.WithField("ip", n.IP.String()).Debug("removing neighbor")
+			if err = kernel.Get().NeighDel(n); err != nil {
+				log.WithError(err).WithField("ip", n.IP.String()).Error("failed to remove neighbor")
+				return err
+			}
+		}
+	}
+
+	for _, n := range wantFDB {
+		log.WithField("mac", n.HardwareAddr.String()).WithField("vtep", n.IP.String()).Debug("adding fdb entry")
+		if err = kernel.Get().NeighAppend(n); err != nil {
+			log.WithError(err).WithField("mac", n.HardwareAddr.String()).Error("failed to add fdb entry")
+			return err
+		}
+	}
+	for _, n := range wantNeigh {
+		log.WithField("ip", n.IP.String()).WithField("mac", n.HardwareAddr.String()).Debug("adding neighbor")
+		if err = kernel.Get().NeighAppend(n); err != nil {
+			log.WithError(err).WithField("ip", n.IP.String()).Error("failed to add neighbor")
+			return err
+		}
+	}
+	return nil
+}
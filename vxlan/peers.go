@@ -0,0 +1,139 @@
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+// zeroMAC is the mac address of fdb entries which flood broadcast, unknown unicast and multicast traffic to a vtep
+var zeroMAC = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+
+var peersOption = options.Option{
+	Name:  "peers",
+	Kind:  options.String,
+	Usage: "comma separated vtep addresses to replicate broadcast and unknown traffic to, or the path of a file listing them",
+	Check: checkPeers,
+}
+
+var _ = options.Register(peersOption)
+
+func checkPeers(v string) error {
+	_, err := ParsePeers(v)
+	return err
+}
+
+// ParsePeers parses a comma or whitespace separated list of vtep addresses, or reads one from the file at s if it is an absolute path
+func ParsePeers(s string) ([]net.IP, error) {
+	if filepath.IsAbs(s) {
+		b, err := ioutil.ReadFile(s) // nolint: gosec
+		if err != nil {
+			return nil, err
+		}
+		s = string(b)
+	}
+
+	r := []net.IP{}
+	for _, p := range strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == ' ' || c == '\t' || c == '\n' || c == '\r' }) {
+		ip := net.ParseIP(p)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid peer address %q", p)
+		}
+		r = append(r, ip)
+	}
+	return r, nil
+}
+
+// peersFromOpts returns the peers option, or it's environment default, and false if neither is set
+func peersFromOpts(opts map[string]string) (string, bool) {
+	if p, ok := opts["peers"]; ok {
+		return p, true
+	}
+	p := os.Getenv(peersOption.Env())
+	return p, p != ""
+}
+
+// SyncPeers makes the all zero fdb entries of the vxlan match the peers option, so traffic without a known destination
+// is replicated to every peer. Addresses on this host are skipped, so every host can share the same peer list
+// without the option every entry but the one the kernel keeps for the group is removed, evpn networks are left alone
+func (v *Vxlan) SyncPeers(opts map[string]string) error {
+	log := v.log.WithField("Func", "SyncPeers()")
+	log.Debug()
+
+	if EVPN(opts) {
+		return nil
+	}
+	po, _ := peersFromOpts(opts)
+	peers, err := ParsePeers(po)
+	if err != nil {
+		log.WithError(err).Error("failed to parse peers")
+		return err
+	}
+
+	nl, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return err
+	}
+
+	local, err := kernel.Get().AddrList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]net.IP)
+	for _, p := range peers {
+		want[p.String()] = p
+	}
+	for _, a := range local {
+		delete(want, a.IP.String())
+	}
+	delete(want, nl.Group.String())
+
+	fdb, err := kernel.Get().NeighList(nl.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		log.WithError(err).Debug("failed to list fdb")
+		return err
+	}
+	for i := range fdb {
+		n := &fdb[i]
+		if !bytes.Equal(n.HardwareAddr, zeroMAC) || n.IP == nil || n.IP.Equal(nl.Group) {
+			continue
+		}
+		if _, ok := want[n.IP.String()]; ok {
+			delete(want, n.IP.String())
+			continue
+		}
+		log.WithField("peer", n.IP.String()).Info("removing peer")
+		if err = kernel.Get().NeighDel(n); err != nil {
+			log.WithError(err).WithField("peer", n.IP.String()).Error("failed to remove peer")
+			return err
+		}
+	}
+
+	for _, p := range want {
+		log.WithField("peer", p.String()).Info("adding peer")
+		err = kernel.Get().NeighAppend(&netlink.Neigh{
+			LinkIndex:    nl.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT | netlink.NUD_NOARP,
+			Flags:        netlink.NTF_SELF,
+			IP:           p,
+			HardwareAddr: zeroMAC,
+		})
+		if err != nil {
+			log.WithError(err).WithField("peer", p.String()).Error("failed to add peer")
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package vxlan
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+// UnderlayDefault selects the interface holding the default route
+const UnderlayDefault = "default"
+
+// bytes added to each packet by vxlan encapsulation, the ethernet header of the encapsulated frame
+// and the outer ip, udp and vxlan headers
+const (
+	overheadV4 = 14 + 20 + 8 + 8
+	overheadV6 = 14 + 40 + 8 + 8
+)
+
+var underlayOption = options.Option{
+	Name: "underlay",
+	Kind: options.String,
+	Usage: "selects vtepdev and srcaddr when they are not set: " + UnderlayDefault +
+		" for the interface holding the default route, a cidr the address must be in, or an interface name pattern",
+	Check: checkUnderlay,
+}
+
+var underlayFamilyOption = options.Option{
+	Name:   "underlayfamily",
+	Kind:   options.String,
+	Usage:  "address family of the underlay, when srcaddr and group don't imply it. Without either ipv4 is preferred",
+	Values: []string{"ipv4", "ipv6"},
+}
+
+var _ = options.Register(underlayOption, underlayFamilyOption)
+
+func checkUnderlay(v string) error {
+	if v == UnderlayDefault {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(v); err == nil {
+		return nil
+	}
+	if _, err := filepath.Match(v, ""); err != nil {
+		return fmt.Errorf("not %v, a cidr or an interface name pattern: %v", UnderlayDefault, err)
+	}
+	return nil
+}
+
+// underlayFromOpts returns the underlay option, or it's environment default
+func underlayFromOpts(opts map[string]string) string {
+	return optOrEnv(opts, underlayOption)
+}
+
+func optOrEnv(opts map[string]string, o options.Option) string {
+	if v, ok := opts[o.Name]; ok {
+		return v
+	}
+	return os.Getenv(o.Env())
+}
+
+// Overhead returns the bytes vxlan encapsulation adds to each packet on an ipv4, or ipv6, underlay
+func Overhead(v6 bool) int {
+	if v6 {
+		return overheadV6
+	}
+	return overheadV4
+}
+
+func isV6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil
+}
+
+// underlayFamily returns the address family of the underlay, from the underlayfamily, srcaddr or group options
+// it returns 0 if none of them are set
+func underlayFamily(opts map[string]string) int {
+	switch optOrEnv(opts, underlayFamilyOption) {
+	case "ipv4":
+		return netlink.FAMILY_V4
+	case "ipv6":
+		return netlink.FAMILY_V6
+	}
+	for _, k := range []string{"srcaddr", "group"} {
+		if ip := net.ParseIP(opts[k]); ip != nil {
+			if isV6(ip) {
+				return netlink.FAMILY_V6
+			}
+			return netlink.FAMILY_V4
+		}
+	}
+	return 0
+}
+
+// ValidUnderlay returns an error if the underlayfamily, srcaddr, group and peers options are not all of the same
+// address family, or if the ipv6 checksum options are set on an ipv4 underlay
+func ValidUnderlay(opts map[string]string) error {
+	type addr struct {
+		opt string
+		v6  bool
+	}
+	addrs := []addr{}
+	if f := optOrEnv(opts, underlayFamilyOption); f != "" {
+		addrs = append(addrs, addr{underlayFamilyOption.Name, f == "ipv6"})
+	}
+	for _, k := range []string{"srcaddr", "group"} {
+		if ip := net.ParseIP(opts[k]); ip != nil {
+			addrs = append(addrs, addr{k, isV6(ip)})
+		}
+	}
+	if p, ok := peersFromOpts(opts); ok && !filepath.IsAbs(p) {
+		peers, err := ParsePeers(p)
+		if err != nil {
+			return err
+		}
+		for _, ip := range peers {
+			addrs = append(addrs, addr{peersOption.Name, isV6(ip)})
+		}
+	}
+
+	for _, a := range addrs {
+		if a.v6 != addrs[0].v6 {
+			return fmt.Errorf("%v and %v are not of the same address family", addrs[0].opt, a.opt)
+		}
+	}
+	if len(addrs) == 0 || addrs[0].v6 {
+		return nil
+	}
+	for _, k := range []string{"udp6zerocsumtx", "udp6zerocsumrx"} {
+		if b, err := strconv.ParseBool(opts[k]); err == nil && b {
+			return fmt.Errorf("%v is only used on an ipv6 underlay", k)
+		}
+	}
+	return nil
+}
+
+// resolveUnderlay sets the vtepdev and srcaddr options from the underlay selector, if they are not set
+// opts must be a copy made by resolveOpts, not the network's options
+// the address is of the underlay's family, or ipv4 if it has none and an ipv4 address is available, otherwise ipv6
+func resolveUnderlay(opts map[string]string) error {
+	sel := underlayFromOpts(opts)
+	_, hasDev := opts["vtepdev"]
+	_, hasSrc := opts["srcaddr"]
+	if sel == "" || (hasDev && hasSrc) {
+		return nil
+	}
+
+	var dev string
+	var src net.IP
+	var err error
+	if fam := underlayFamily(opts); fam != 0 {
+		dev, src, err = SelectUnderlay(sel, fam)
+	} else if dev, src, err = SelectUnderlay(sel, netlink.FAMILY_V4); err != nil {
+		dev, src, err = SelectUnderlay(sel, netlink.FAMILY_V6)
+	}
+	if err != nil {
+		return err
+	}
+	log.WithField("underlay", sel).WithField("vtepdev", dev).WithField("srcaddr", src.String()).Debug("selected underlay")
+
+	if !hasDev {
+		opts["vtepdev"] = dev
+	}
+	if !hasSrc {
+		opts["srcaddr"] = src.String()
+	}
+	return nil
+}
+
+// SelectUnderlay returns the interface and address of family fam picked by the underlay selector sel
+func SelectUnderlay(sel string, fam int) (string, net.IP, error) {
+	if sel == UnderlayDefault {
+		return defaultRouteUnderlay(fam)
+	}
+	if _, sn, err := net.ParseCIDR(sel); err == nil {
+		return cidrUnderlay(sn, fam)
+	}
+	return patternUnderlay(sel, fam)
+}
+
+// usableAddr returns false for addresses which can't be the source of vxlan traffic
+// such as link local addresses, and ipv6 addresses which are deprecated or still in duplicate address detection
+func usableAddr(a netlink.Addr) bool {
+	return a.IP.IsGlobalUnicast() && a.Flags&(syscall.IFA_F_DEPRECATED|syscall.IFA_F_TENTATIVE|syscall.IFA_F_DADFAILED) == 0
+}
+
+// underlayAddr returns the first usable address of family fam on link, preferring pref if it is one of them
+func underlayAddr(link netlink.Link, fam int, pref net.IP) (net.IP, error) {
+	addrs, err := kernel.Get().AddrList(link, fam)
+	if err != nil {
+		return nil, err
+	}
+	var r net.IP
+	for _, a := range addrs {
+		if !usableAddr(a) {
+			continue
+		}
+		if pref != nil && a.IP.Equal(pref) {
+			return a.IP, nil
+		}
+		if r == nil {
+			r = a.IP
+		}
+	}
+	if r == nil {
+		return nil, fmt.Errorf("no usable address on %v", link.Attrs().Name)
+	}
+	return r, nil
+}
+
+func defaultRouteUnderlay(fam int) (string, net.IP, error) {
+	routes, err := kernel.Get().RouteListFiltered(netlink.FAMILY_ALL, nil, 0)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var best *netlink.Route
+	for i := range routes {
+		r := &routes[i]
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if r.Gw == nil || (r.Gw.To4() != nil) != (fam == netlink.FAMILY_V4) || r.LinkIndex == 0 {
+			continue
+		}
+		if best == nil || r.Priority < best.Priority {
+			best = r
+		}
+	}
+	if best == nil {
+		return "", nil, fmt.Errorf("no default route")
+	}
+
+	link, err := kernel.Get().LinkByIndex(best.LinkIndex)
+	if err != nil {
+		return "", nil, err
+	}
+	src, err := underlayAddr(link, fam, best.Src)
+	if err != nil {
+		return "", nil, err
+	}
+	return link.Attrs().Name, src, nil
+}
+
+// cidrUnderlay picks the first interface, by name, with an address in sn
+func cidrUnderlay(sn *net.IPNet, fam int) (string, net.IP, error) {
+	links, err := sortedLinks()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, l := range links {
+		addrs, err := kernel.Get().AddrList(l, fam) // nolint: vetshadow
+		if err != nil {
+			return "", nil, err
+		}
+		for _, a := range addrs {
+			if usableAddr(a) && sn.Contains(a.IP) {
+				return l.Attrs().Name, a.IP, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("no address in %v", sn)
+}
+
+func sortedLinks() ([]netlink.Link, error) {
+	links, err := kernel.Get().LinkList()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Attrs().Name < links[j].Attrs().Name })
+	return links, nil
+}
+
+// patternUnderlay picks the first interface, by name, matching pattern which has a usable address
+func patternUnderlay(pattern string, fam int) (string, net.IP, error) {
+	links, err := sortedLinks()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, l := range links {
+		if ok, _ := filepath.Match(pattern, l.Attrs().Name); !ok {
+			continue
+		}
+		src, err := underlayAddr(l, fam, nil) // nolint: vetshadow
+		if err != nil {
+			continue
+		}
+		return l.Attrs().Name, src, nil
+	}
+	return "", nil, fmt.Errorf("no interface matching %q with an address", pattern)
+}
+
+// Underlay returns the name of the vxlan's vtep device and it's source address, empty and nil if they are not set
+func (v *Vxlan) Underlay() (string, net.IP, error) {
+	nl, err := v.nl()
+	if err != nil {
+		return "", nil, err
+	}
+	if nl.VtepDevIndex == 0 {
+		return "", nl.SrcAddr, nil
+	}
+	dev, err := kernel.Get().LinkByIndex(nl.VtepDevIndex)
+	if err != nil {
+		return "", nl.SrcAddr, err
+	}
+	return dev.Attrs().Name, nl.SrcAddr, nil
+}
@@ -2,6 +2,7 @@ package vxlan
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"strconv"
@@ -10,12 +11,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
 
-	"github.com/TrilliumIT/vxrouter"
+	"github.com/TrilliumIT/vxrouter/ipvlan"
+	"github.com/TrilliumIT/vxrouter/kernel"
 	"github.com/TrilliumIT/vxrouter/macvlan"
-)
-
-const (
-	envPrefix = vxrouter.EnvPrefix
+	"github.com/TrilliumIT/vxrouter/options"
 )
 
 // Vxlan is a vxlan interface
@@ -34,7 +33,7 @@ func (v *Vxlan) nl() (*netlink.Vxlan, error) { // nolint: dupl
 	log := v.log.WithField("Func", "nl()")
 	log.Debug()
 
-	link, err := netlink.LinkByName(v.name)
+	link, err := kernel.Get().LinkByName(v.name)
 	if err != nil {
 		log.WithError(err).Debug("failed to get link by name")
 		return nil, err
@@ -77,7 +76,7 @@ func ParseVxlanID(v string) (int, error) {
 
 func linkIndexByName(name string) (int, error) {
 	var i int
-	dev, err := netlink.LinkByName(name)
+	dev, err := kernel.Get().LinkByName(name)
 	if err == nil {
 		i = dev.Attrs().Index
 	}
@@ -85,16 +84,73 @@ func linkIndexByName(name string) (int, error) {
 
 }
 
-func applyOpts(nl *netlink.Vxlan, opts map[string]string) (bool, error) {
-	var ok bool
-	keys := [...]string{"vxlanmtu", "vxlanhardwareaddr", "vxlantxqlen", "vxlanid", "vtepdev", "srcaddr", "group", "ttl", "tos", "learning", "proxy", "rsc", "l2miss", "l3miss", "noage", "gbp", "age", "limit", "port", "portlow", "porthigh", "vxlanhardwareaddr", "vxlanmtu"}
+// vxlanOptions are the network options applied to the vxlan interface
+var vxlanOptions = []options.Option{
+	{Name: "vxlanid", Kind: options.Int, Usage: "vxlan id (vni) of the network, required", Min: 0, Max: 16777215, Check: checkVxlanID},
+	{Name: "vxlanmtu", Kind: options.Int, Usage: "mtu of the vxlan interface", Min: 68, Max: 65535},
+	{Name: "vxlanhardwareaddr", Kind: options.MAC, Usage: "mac address of the vxlan interface"},
+	{Name: "vxlantxqlen", Kind: options.Int, Usage: "transmit queue length of the vxlan interface", Min: 0, Max: math.MaxInt32},
+	{Name: "vtepdev", Kind: options.Interface, Usage: "underlay interface to send vxlan traffic from"},
+	{Name: "srcaddr", Kind: options.IP, Usage: "source address of vxlan traffic"},
+	{Name: "group", Kind: options.IP, Usage: "multicast group or remote address to send unknown traffic to"},
+	{Name: "ttl", Kind: options.Int, Usage: "ttl of vxlan packets", Min: 0, Max: 255},
+	{Name: "tos", Kind: options.Int, Usage: "tos of vxlan packets", Min: 0, Max: 255},
+	{Name: "learning", Kind: options.Bool, Usage: "learn remote mac addresses from received traffic"},
+	{Name: "proxy", Kind: options.Bool, Usage: "answer arp and neighbor discovery from the neighbor table"},
+	{Name: "rsc", Kind: options.Bool, Usage: "route short circuit"},
+	{Name: "l2miss", Kind: options.Bool, Usage: "notify on missing fdb entries"},
+	{Name: "l3miss", Kind: options.Bool, Usage: "notify on missing neighbor entries"},
+	{Name: "noage", Kind: options.Bool, Usage: "never expire learned fdb entries"},
+	{Name: "gbp", Kind: options.Bool, Usage: "group based policy extension"},
+	{Name: "age", Kind: options.Int, Usage: "seconds before learned fdb entries expire", Min: 0, Max: math.MaxInt32},
+	{Name: "limit", Kind: options.Int, Usage: "maximum number of fdb entries, 0 for no limit", Min: 0, Max: math.MaxInt32},
+	{Name: "port", Kind: options.Int, Usage: "udp destination port of vxlan packets", Min: 0, Max: 65535},
+	{Name: "portlow", Kind: options.Int, Usage: "lowest udp source port of vxlan packets", Min: 0, Max: 65535},
+	{Name: "porthigh", Kind: options.Int, Usage: "highest udp source port of vxlan packets", Min: 0, Max: 65535},
+	{Name: "udpcsum", Kind: options.Bool, Usage: "send udp checksums on an ipv4 underlay"},
+	{Name: "udp6zerocsumtx", Kind: options.Bool, Usage: "send zero udp checksums on an ipv6 underlay"},
+	{Name: "udp6zerocsumrx", Kind: options.Bool, Usage: "accept zero udp checksums on an ipv6 underlay"},
+}
 
-	for _, k := range keys {
-		if _, ok = opts[k]; !ok && os.Getenv(envPrefix+k) != "" {
-			opts[k] = os.Getenv(envPrefix + k)
+var _ = options.Register(vxlanOptions...)
+
+func checkVxlanID(v string) error {
+	_, err := ParseVxlanID(v)
+	return err
+}
+
+// resolveOpts returns a copy of opts with the environment defaults, the options implied by evpn, and the interface
+// and address picked by the underlay selector filled in. opts are the cached options of the network, and are left alone
+// so the underlay is selected again every time
+func resolveOpts(opts map[string]string) (map[string]string, error) {
+	r := make(map[string]string, len(opts))
+	for k, v := range opts {
+		r[k] = v
+	}
+	for _, o := range vxlanOptions {
+		k := o.Name
+		if _, ok := r[k]; !ok && os.Getenv(o.Env()) != "" {
+			r[k] = os.Getenv(o.Env())
 		}
 	}
+	// the fdb of an evpn vxlan is programmed from bgp
+	if EVPN(r) {
+		r["learning"] = "false"
+	}
+	if err := resolveUnderlay(r); err != nil {
+		log.WithError(err).Error("failed to select underlay")
+		return nil, err
+	}
+	if err := ValidUnderlay(r); err != nil {
+		log.WithError(err).Error()
+		return nil, err
+	}
+	return r, nil
+}
 
+// applyOpts sets the attributes of nl from opts, which were returned by resolveOpts
+// it returns true if an attribute which can't be changed on a live vxlan was changed
+func applyOpts(nl *netlink.Vxlan, opts map[string]string) (bool, error) {
 	var changed bool
 	var err error
 
@@ -107,10 +163,8 @@ func applyOpts(nl *netlink.Vxlan, opts map[string]string) (bool, error) {
 			nl.LinkAttrs.MTU, err = strconv.Atoi(v)
 		case "vxlanhardwareaddr": // don't check for change, can be changed after up
 			nl.LinkAttrs.HardwareAddr, err = net.ParseMAC(v)
-		case "vxlantxqlen":
-			o = strconv.Itoa(nl.LinkAttrs.TxQLen)
+		case "vxlantxqlen": // don't check for change, can be changed after up
 			nl.LinkAttrs.TxQLen, err = strconv.Atoi(v)
-			n = strconv.Itoa(nl.LinkAttrs.TxQLen)
 		case "vxlanid":
 			o = strconv.Itoa(nl.VxlanId)
 			nl.VxlanId, err = ParseVxlanID(v)
@@ -183,6 +237,18 @@ func applyOpts(nl *netlink.Vxlan, opts map[string]string) (bool, error) {
 			o = strconv.Itoa(nl.PortHigh)
 			nl.PortHigh, err = strconv.Atoi(v)
 			n = strconv.Itoa(nl.PortHigh)
+		case "udpcsum":
+			o = strconv.FormatBool(nl.UDPCSum)
+			nl.UDPCSum, err = strconv.ParseBool(v)
+			n = strconv.FormatBool(nl.UDPCSum)
+		case "udp6zerocsumtx":
+			o = strconv.FormatBool(nl.UDP6ZeroCSumTx)
+			nl.UDP6ZeroCSumTx, err = strconv.ParseBool(v)
+			n = strconv.FormatBool(nl.UDP6ZeroCSumTx)
+		case "udp6zerocsumrx":
+			o = strconv.FormatBool(nl.UDP6ZeroCSumRx)
+			nl.UDP6ZeroCSumRx, err = strconv.ParseBool(v)
+			n = strconv.FormatBool(nl.UDP6ZeroCSumRx)
 		}
 		if err != nil {
 			log.WithError(err).Debug()
@@ -193,6 +259,17 @@ func applyOpts(nl *netlink.Vxlan, opts map[string]string) (bool, error) {
 		}
 	}
 
+	// without a vxlanmtu, fit the encapsulated packets in the mtu of the vtep device
+	if _, ok := opts["vxlanmtu"]; !ok && nl.VtepDevIndex != 0 {
+		var dev netlink.Link
+		dev, err = kernel.Get().LinkByIndex(nl.VtepDevIndex)
+		if err != nil {
+			log.WithError(err).Debug("failed to get vtep device")
+			return changed, err
+		}
+		nl.LinkAttrs.MTU = dev.Attrs().MTU - Overhead(isV6(nl.SrcAddr) || isV6(nl.Group))
+	}
+
 	return changed, nil
 }
 
@@ -218,6 +295,11 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 		}
 	}
 
+	opts, err = resolveOpts(opts)
+	if err != nil {
+		log.WithError(err).Debug()
+		return nil, err
+	}
 	var changed bool
 	changed, err = applyOpts(nl, opts)
 	if err != nil {
@@ -232,7 +314,7 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 	}
 
 	if new {
-		err = netlink.LinkAdd(nl)
+		err = kernel.Get().LinkAdd(nl)
 		if err != nil {
 			if retry { // try again, in case another thread already brought it up
 				log.WithError(err).Debug("retrying")
@@ -241,6 +323,9 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 			log.WithError(err).Debug("not retrying")
 			return nil, err
 		}
+		if sel := underlayFromOpts(opts); sel != "" {
+			log.WithField("underlay", sel).WithField("vtepdev", opts["vtepdev"]).WithField("srcaddr", opts["srcaddr"]).Info("created vxlan on selected underlay")
+		}
 	}
 
 	// Parse interface options
@@ -256,7 +341,7 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 			if hardwareAddr.String() == nl.HardwareAddr.String() {
 				break
 			}
-			err = netlink.LinkSetHardwareAddr(nl, hardwareAddr)
+			err = kernel.Get().LinkSetHardwareAddr(nl, hardwareAddr)
 		case "vxlanmtu":
 			var mtu int
 			mtu, err = strconv.Atoi(v)
@@ -266,7 +351,7 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 			if mtu == nl.MTU {
 				break
 			}
-			err = netlink.LinkSetMTU(nl, mtu)
+			err = kernel.Get().LinkSetMTU(nl, mtu)
 		}
 		if err != nil {
 			log.WithError(err).Debug()
@@ -275,7 +360,7 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 	}
 
 	// bring interfaces up
-	err = netlink.LinkSetUp(nl)
+	err = kernel.Get().LinkSetUp(nl)
 	if err != nil {
 		log.WithError(err).Debug("failed to bring up vxlan")
 		return nil, err
@@ -284,6 +369,82 @@ func newVxlan(vxlanName string, opts map[string]string, retry bool) (*Vxlan, err
 	return v, nil
 }
 
+// Drift returns true if the vxlan's attributes differ from opts
+func (v *Vxlan) Drift(opts map[string]string) (bool, error) {
+	cur, err := v.nl()
+	if err != nil {
+		return false, err
+	}
+	want, err := v.nl()
+	if err != nil {
+		return false, err
+	}
+
+	opts, err = resolveOpts(opts)
+	if err != nil {
+		return false, err
+	}
+	recreate, err := applyOpts(want, opts)
+	if err != nil {
+		return false, err
+	}
+	return recreate || liveDrift(cur, want), nil
+}
+
+// Reconfigure applies the attributes in opts which can be changed on a live vxlan (mtu, mac address and txqlen)
+// it returns true if other attributes differ, which can only be changed by recreating the vxlan
+func (v *Vxlan) Reconfigure(opts map[string]string) (bool, error) {
+	log := v.log.WithField("Func", "Reconfigure()")
+	log.Debug()
+
+	cur, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return false, err
+	}
+	want, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return false, err
+	}
+
+	opts, err = resolveOpts(opts)
+	if err != nil {
+		log.WithError(err).Debug()
+		return false, err
+	}
+	recreate, err := applyOpts(want, opts)
+	if err != nil {
+		log.WithError(err).Debug()
+		return false, err
+	}
+
+	if want.MTU != cur.MTU {
+		log.WithField("mtu", want.MTU).Info("changing mtu")
+		if err = kernel.Get().LinkSetMTU(cur, want.MTU); err != nil {
+			return recreate, err
+		}
+	}
+	if want.HardwareAddr.String() != cur.HardwareAddr.String() {
+		log.WithField("hardwareaddr", want.HardwareAddr.String()).Info("changing mac address")
+		if err = kernel.Get().LinkSetHardwareAddr(cur, want.HardwareAddr); err != nil {
+			return recreate, err
+		}
+	}
+	if want.TxQLen != cur.TxQLen {
+		log.WithField("txqlen", want.TxQLen).Info("changing txqlen")
+		if err = kernel.Get().LinkSetTxQLen(cur, want.TxQLen); err != nil {
+			return recreate, err
+		}
+	}
+
+	return recreate, nil
+}
+
+func liveDrift(cur, want *netlink.Vxlan) bool {
+	return want.MTU != cur.MTU || want.HardwareAddr.String() != cur.HardwareAddr.String() || want.TxQLen != cur.TxQLen
+}
+
 // FromName gets a vxlan interface by name
 func FromName(name string) (*Vxlan, error) {
 	v := fromName(name)
@@ -301,7 +462,7 @@ func FromName(name string) (*Vxlan, error) {
 
 // FromLinkIndex returns a Vxlan from an interface name
 func FromLinkIndex(li int) (*Vxlan, error) { // nolint: dupl
-	l, err := netlink.LinkByIndex(li)
+	l, err := kernel.Get().LinkByIndex(li)
 	if err != nil {
 		return nil, err
 	}
@@ -323,8 +484,8 @@ func FromLink(link netlink.Link) (*Vxlan, error) { // nolint: dupl
 	return m, nil
 }
 
-// CreateMacvlan creates a macvlan as a slave to v
-func (v *Vxlan) CreateMacvlan(name string) (*macvlan.Macvlan, error) {
+// CreateMacvlan creates a macvlan in mode as a slave to v, with a random mac address if mac is nil
+func (v *Vxlan) CreateMacvlan(name string, mode netlink.MacvlanMode, mac net.HardwareAddr) (*macvlan.Macvlan, error) {
 	log := v.log.WithField("Func", "CreateMacvlan()")
 	log.Debug()
 
@@ -334,7 +495,7 @@ func (v *Vxlan) CreateMacvlan(name string) (*macvlan.Macvlan, error) {
 		return nil, err
 	}
 
-	return macvlan.New(name, nl.LinkAttrs.Index)
+	return macvlan.New(name, nl.LinkAttrs.Index, mode, mac)
 }
 
 // DeleteMacvlan deletes the slave macvlan interface by name
@@ -361,8 +522,46 @@ func (v *Vxlan) DeleteMacvlan(name string) error {
 	return mvl.Delete()
 }
 
+// CreateIpvlan creates an ipvlan in mode as a slave to v
+func (v *Vxlan) CreateIpvlan(name string, mode netlink.IPVlanMode) (*ipvlan.Ipvlan, error) {
+	log := v.log.WithField("Func", "CreateIpvlan()")
+	log.Debug()
+
+	nl, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return nil, err
+	}
+
+	return ipvlan.New(name, nl.LinkAttrs.Index, mode)
+}
+
+// DeleteIpvlan deletes the slave ipvlan interface by name
+func (v *Vxlan) DeleteIpvlan(name string) error {
+	log := v.log.WithField("Func", "DeleteIpvlan()")
+	log.Debug()
+
+	nl, err := v.nl()
+	if err != nil {
+		log.WithError(err).Debug()
+		return err
+	}
+
+	ivl, err := ipvlan.FromName(name)
+	if err != nil {
+		log.WithError(err).Debug()
+		return err
+	}
+
+	if nl.Index != ivl.GetParentIndex() {
+		return fmt.Errorf("ipvlan is not a child of this vxlan")
+	}
+
+	return ivl.Delete()
+}
+
 // Delete deletes the vxlan interface.
-// Any child macvlans will automatically be deleted by the kernel.
+// Any child macvlans or ipvlans will automatically be deleted by the kernel.
 func (v *Vxlan) Delete() error {
 	log := v.log.WithField("Func", "Delete()")
 	log.Debug()
@@ -373,7 +572,7 @@ func (v *Vxlan) Delete() error {
 		return nil
 	}
 
-	return netlink.LinkDel(nl)
+	return kernel.Get().LinkDel(nl)
 }
 
 // GetMacVlans returns all slave macvlan interfaces
@@ -399,6 +598,29 @@ func (v *Vxlan) GetMacVlans() ([]*macvlan.Macvlan, error) {
 	return r, nil
 }
 
+// GetIpvlans returns all slave ipvlan interfaces
+func (v *Vxlan) GetIpvlans() ([]*ipvlan.Ipvlan, error) {
+	log := v.log.WithField("Func", "GetIpvlans()")
+	log.Debug()
+
+	r := []*ipvlan.Ipvlan{}
+
+	allSlaves, err := v.GetSlaveDevices()
+	if err != nil {
+		return r, err
+	}
+
+	var ivl *ipvlan.Ipvlan
+	for _, link := range allSlaves {
+		ivl, err = ipvlan.FromLink(link)
+		if err != nil {
+			continue
+		}
+		r = append(r, ivl)
+	}
+	return r, nil
+}
+
 // GetSlaveDevices gets all slave devices, including macvlans, but possibly others
 func (v *Vxlan) GetSlaveDevices() ([]netlink.Link, error) {
 	log := v.log.WithField("Func", "GetSlaveDevices()")
@@ -412,14 +634,15 @@ func (v *Vxlan) GetSlaveDevices() ([]netlink.Link, error) {
 
 	r := []netlink.Link{}
 
-	allLinks, err := netlink.LinkList()
+	allLinks, err := kernel.Get().LinkList()
 	if err != nil {
 		log.WithError(err).Debug("failed to get all links")
 		return r, err
 	}
 
 	for _, link := range allLinks {
-		if link.Attrs().MasterIndex != nl.Attrs().Index {
+		// macvlans and ipvlans reference the vxlan as their lower device (parent), not their master
+		if link.Attrs().MasterIndex != nl.Attrs().Index && link.Attrs().ParentIndex != nl.Attrs().Index {
 			continue
 		}
 		r = append(r, link)
@@ -427,6 +650,15 @@ func (v *Vxlan) GetSlaveDevices() ([]netlink.Link, error) {
 	return r, nil
 }
 
+// VNI returns the vxlan id
+func (v *Vxlan) VNI() (int, error) {
+	nl, err := v.nl()
+	if err != nil {
+		return 0, err
+	}
+	return nl.VxlanId, nil
+}
+
 // Name returns the name
 func (v *Vxlan) Name() string {
 	return v.name
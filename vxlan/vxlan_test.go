@@ -0,0 +1,175 @@
+package vxlan
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/TrilliumIT/vxrouter/kernel"
+	"github.com/TrilliumIT/vxrouter/kernel/kerneltest"
+	"github.com/TrilliumIT/vxrouter/options"
+)
+
+func useFakeKernel() func() {
+	old := kernel.Set(kerneltest.New())
+	return func() { kernel.Set(old) }
+}
+
+func TestGetSlaveDevices(t *testing.T) {
+	defer useFakeKernel()()
+
+	vxl, err := New("slv", map[string]string{"vxlanid": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New("slvo", map[string]string{"vxlanid": "101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vxl.CreateMacvlan("mvl_slv", netlink.MACVLAN_MODE_BRIDGE, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vxl.CreateIpvlan("ivl_slv", netlink.IPVLAN_MODE_L2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.CreateMacvlan("mvl_slvo", netlink.MACVLAN_MODE_BRIDGE, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// macvlans and ipvlans on the vxlan are found by their lower device
+	slaves, err := vxl.GetSlaveDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, l := range slaves {
+		names[l.Attrs().Name] = true
+	}
+	if len(names) != 2 || !names["mvl_slv"] || !names["ivl_slv"] {
+		t.Errorf("expected the macvlan and ipvlan on the vxlan, got %v", names)
+	}
+
+	mvls, err := vxl.GetMacVlans()
+	if err != nil || len(mvls) != 1 {
+		t.Errorf("expected one macvlan, got %v %v", len(mvls), err)
+	}
+	ivls, err := vxl.GetIpvlans()
+	if err != nil || len(ivls) != 1 {
+		t.Errorf("expected one ipvlan, got %v %v", len(ivls), err)
+	}
+}
+
+// testValues are valid values for each kind of option, which differ from the zero value of the attribute
+var testValues = map[options.Kind]string{
+	options.Int:       "100",
+	options.Bool:      "true",
+	options.IP:        "192.0.2.1",
+	options.MAC:       "02:00:00:00:00:01",
+	options.Interface: "lo",
+}
+
+func TestApplyOptsHandlesEveryOption(t *testing.T) {
+	defer useFakeKernel()()
+
+	for _, o := range vxlanOptions {
+		v, ok := testValues[o.Kind]
+		if !ok {
+			t.Fatalf("option %v: no test value for kind %v", o.Name, o.Kind)
+		}
+		if err := o.Validate(v); err != nil {
+			t.Fatalf("option %v: %v", o.Name, err)
+		}
+		nl := &netlink.Vxlan{}
+		if _, err := applyOpts(nl, map[string]string{o.Name: v}); err != nil {
+			t.Errorf("option %v: %v", o.Name, err)
+			continue
+		}
+		if reflect.DeepEqual(nl, &netlink.Vxlan{}) {
+			t.Errorf("option %v is registered, but not applied to the vxlan", o.Name)
+		}
+	}
+}
+
+func TestValidateInterfaceOption(t *testing.T) {
+	defer useFakeKernel()()
+
+	o, ok := options.Lookup("vtepdev")
+	if !ok {
+		t.Fatal("vtepdev is not registered")
+	}
+	// options of global scope networks are validated on one host, and the interface may only exist on others
+	if err := o.Validate("eth9"); err != nil {
+		t.Errorf("expected an interface missing on this host to be valid, got %v", err)
+	}
+	for _, v := range []string{"", "averyverylongname", "eth/0", "eth 0"} {
+		if err := o.Validate(v); err == nil {
+			t.Errorf("expected %q to be refused", v)
+		}
+	}
+}
+
+func TestValidUnderlay(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts map[string]string
+		ok   bool
+	}{
+		{"no addresses", map[string]string{}, true},
+		{"ipv4", map[string]string{"srcaddr": "192.0.2.1", "group": "239.1.1.1", "peers": "192.0.2.2,192.0.2.3"}, true},
+		{"ipv6", map[string]string{"underlayfamily": "ipv6", "srcaddr": "2001:db8::1", "group": "ff05::100", "peers": "2001:db8::2"}, true},
+		{"srcaddr and group", map[string]string{"srcaddr": "192.0.2.1", "group": "ff05::100"}, false},
+		{"mixed peers", map[string]string{"peers": "192.0.2.2,2001:db8::2"}, false},
+		{"srcaddr and peers", map[string]string{"srcaddr": "2001:db8::1", "peers": "192.0.2.2"}, false},
+		{"underlayfamily and srcaddr", map[string]string{"underlayfamily": "ipv4", "srcaddr": "2001:db8::1"}, false},
+		{"underlayfamily and group", map[string]string{"underlayfamily": "ipv6", "group": "239.1.1.1"}, false},
+		{"ipv6 checksums", map[string]string{"srcaddr": "2001:db8::1", "udp6zerocsumtx": "true", "udp6zerocsumrx": "true"}, true},
+		{"ipv6 checksums on ipv4", map[string]string{"srcaddr": "192.0.2.1", "udp6zerocsumtx": "true"}, false},
+		{"ipv6 rx checksums on ipv4", map[string]string{"underlayfamily": "ipv4", "udp6zerocsumrx": "true"}, false},
+		{"ipv6 checksums unset on ipv4", map[string]string{"srcaddr": "192.0.2.1", "udp6zerocsumtx": "false"}, true},
+	} {
+		if err := ValidUnderlay(tc.opts); (err == nil) != tc.ok {
+			t.Errorf("%v: expected valid %v, got %v", tc.name, tc.ok, err)
+		}
+	}
+}
+
+func TestUnderlayMTU(t *testing.T) {
+	defer useFakeKernel()()
+
+	if o := Overhead(false); o != 50 {
+		t.Errorf("expected 50 bytes of overhead on ipv4, got %v", o)
+	}
+	if o := Overhead(true); o != 70 {
+		t.Errorf("expected 70 bytes of overhead on ipv6, got %v", o)
+	}
+
+	if err := kernel.Get().LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "mtu0", MTU: 9000}}); err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		opts map[string]string
+		mtu  int
+	}{
+		{map[string]string{"srcaddr": "192.0.2.1"}, 8950},
+		{map[string]string{"srcaddr": "2001:db8::1"}, 8930},
+		{map[string]string{"group": "ff05::100"}, 8930},
+		// an explicit mtu is left alone
+		{map[string]string{"srcaddr": "2001:db8::1", "vxlanmtu": "1400"}, 1400},
+	} {
+		tc.opts["vtepdev"] = "mtu0"
+		tc.opts["vxlanid"] = strconv.Itoa(110 + i)
+		vxl, err := New("mtu"+strconv.Itoa(i+1), tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link, err := kernel.Get().LinkByName(vxl.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := link.Attrs().MTU; m != tc.mtu {
+			t.Errorf("%v: expected mtu %v, got %v", tc.opts, tc.mtu, m)
+		}
+	}
+}